@@ -0,0 +1,49 @@
+package record
+
+import (
+	"time"
+)
+
+// now之后的下一个对齐时刻，按所在时区从零点开始每隔Fragment一个
+func (r *Record) nextBoundary(now time.Time) time.Time {
+	now = now.In(r.loc())
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	elapsed := now.Sub(midnight)
+	return midnight.Add((elapsed/r.Fragment + 1) * r.Fragment)
+}
+
+// 是否需要切片。文件超过MaxFileSize后的第一个关键帧切片；
+// 对齐模式下到达整点后的第一个关键帧切片，超过AlignHardCut仍没有关键帧时强制切片
+func (r *Recorder) needCut(absTime uint32, keyFrame bool) bool {
+	if keyFrame && r.MaxFileSize > 0 && r.fileSize() >= r.MaxFileSize<<20 {
+		return true
+	}
+	if r.Fragment <= 0 {
+		return false
+	}
+	if !r.Align {
+		return keyFrame && time.Duration(absTime-r.SkipTS)*time.Millisecond >= r.Fragment
+	}
+	now := time.Now()
+	if r.nextCut.IsZero() {
+		r.nextCut = r.nextBoundary(now)
+	}
+	if now.Before(r.nextCut) {
+		return false
+	}
+	return keyFrame || r.AlignHardCut > 0 && now.Sub(r.nextCut) >= r.AlignHardCut
+}
+
+// 切片后记录时间，非关键帧处切片时在新文件的信息中标记
+func (r *Recorder) onCut(keyFrame bool) {
+	now := time.Now()
+	r.LastCutTime = now
+	if r.Align {
+		r.nextCut = r.nextBoundary(now)
+		if !keyFrame && r.segment != nil {
+			r.segment.HardCut = true
+			r.Warn("hard cut without key frame")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package record
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/log"
+)
+
+// 对齐时刻按配置的时区从零点开始计算，正好在对齐时刻时取下一个
+func TestNextBoundary(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	r := &Record{Fragment: 15 * time.Minute, location: loc}
+	tests := []struct {
+		now, want time.Time
+	}{
+		{time.Date(2024, 1, 1, 10, 7, 30, 0, loc), time.Date(2024, 1, 1, 10, 15, 0, 0, loc)},
+		{time.Date(2024, 1, 1, 10, 15, 0, 0, loc), time.Date(2024, 1, 1, 10, 30, 0, 0, loc)},
+		{time.Date(2024, 1, 1, 23, 50, 0, 0, loc), time.Date(2024, 1, 2, 0, 0, 0, 0, loc)},
+		// 其他时区的时间按配置的时区对齐
+		{time.Date(2024, 1, 1, 2, 7, 0, 0, time.UTC), time.Date(2024, 1, 1, 10, 15, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		if got := r.nextBoundary(tt.now); !got.Equal(tt.want) {
+			t.Errorf("next boundary of %v = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
+
+// 对齐模式到达对齐时刻后的第一个关键帧切片，超过AlignHardCut仍没有关键帧时强制切片
+func TestNeedCutAlign(t *testing.T) {
+	r := &Recorder{}
+	r.Logger = &log.Logger{Logger: zap.NewNop()}
+	r.Fragment = time.Hour
+	r.Align = true
+	r.nextCut = time.Now().Add(time.Minute)
+	if r.needCut(0, true) {
+		t.Error("cut before boundary")
+	}
+	r.nextCut = time.Now().Add(-time.Second)
+	if !r.needCut(0, true) {
+		t.Error("no cut on key frame after boundary")
+	}
+	if r.needCut(0, false) {
+		t.Error("cut on non key frame without hard cut")
+	}
+	r.AlignHardCut = 2 * time.Second
+	if r.needCut(0, false) {
+		t.Error("hard cut too early")
+	}
+	r.nextCut = time.Now().Add(-3 * time.Second)
+	if !r.needCut(0, false) {
+		t.Error("no hard cut after AlignHardCut")
+	}
+	// 切片后标记非关键帧处切片，下一个对齐时刻在切片之后
+	r.segment = &SegmentInfo{}
+	r.onCut(false)
+	if !r.segment.HardCut || !r.nextCut.After(time.Now()) {
+		t.Errorf("after cut hard cut %v next %v", r.segment.HardCut, r.nextCut)
+	}
+}
+
+// 文件超过MaxFileSize后在第一个关键帧切片，不受时长影响
+func TestNeedCutMaxFileSize(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "test.flv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r := &Recorder{}
+	r.MaxFileSize = 1
+	r.File = file
+	if !r.fragmented() {
+		t.Fatal("MaxFileSize not fragmented")
+	}
+	if _, err = file.Write(make([]byte, 1<<20-1)); err != nil {
+		t.Fatal(err)
+	}
+	if r.needCut(0, true) {
+		t.Error("cut below MaxFileSize")
+	}
+	file.Write([]byte{0})
+	if r.needCut(0, false) {
+		t.Error("cut on non key frame")
+	}
+	if !r.needCut(0, true) {
+		t.Error("no cut after MaxFileSize")
+	}
+	// 同时按时长切片时先到者生效
+	r.MaxFileSize = 2
+	r.Fragment = 10 * time.Second
+	if r.needCut(5000, true) || !r.needCut(10000, true) {
+		t.Error("fragment with MaxFileSize")
+	}
+}
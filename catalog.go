@@ -0,0 +1,355 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/log"
+)
+
+// 录像片段信息
+type SegmentInfo struct {
+	StreamPath    string
+	Type          string    //录像类型 flv|mp4|fmp4|hls|raw|raw_audio
+	Path          string    //相对于存储根目录的文件路径
+	StartTime     time.Time //开始时间
+	EndTime       time.Time //结束时间
+	Size          int64
+	Duration      uint32 //时长 毫秒
+	VideoCodec    string `json:",omitempty"`
+	AudioCodec    string `json:",omitempty"`
+	Interrupted   bool   `json:",omitempty"` //异常退出时未正常关闭的文件
+	HardCut       bool   `json:",omitempty"` //对齐时强制在非关键帧处切片，文件不是从关键帧开始
+	InitPath      string `json:",omitempty"` //hls fmp4分片的初始化段
+	Discontinuity bool   `json:",omitempty"` //hls分片与上一个分片不连续，点播时写入EXT-X-DISCONTINUITY
+	Label         string `json:",omitempty"` //录像标签，同一个流的多个hls录像按标签区分
+}
+
+// 目录日志中的一条记录
+type catalogEntry struct {
+	Op string `json:",omitempty"` //空:新增 del:删除
+	SegmentInfo
+}
+
+// 录像目录，录像文件关闭时记录，查询时不再遍历目录
+// 以追加日志的形式保存在本地文件中，启动时加载到内存
+type Catalog struct {
+	sync.RWMutex
+	Path     string
+	segments map[string]*SegmentInfo
+	file     *os.File
+	garbage  int //日志中无效记录数，超过有效记录数时压缩
+}
+
+func catalogKey(typ, name string) string {
+	return typ + ":" + slashPath(name)
+}
+
+// 打开录像目录，返回目录文件是否已存在
+func OpenCatalog(filePath string) (c *Catalog, exist bool, err error) {
+	c = &Catalog{Path: filePath, segments: make(map[string]*SegmentInfo)}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
+		return
+	}
+	var f *os.File
+	if f, err = os.Open(filePath); err == nil {
+		exist = true
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry catalogEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				c.garbage++
+				continue
+			}
+			c.apply(&entry)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	c.file, err = os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	return
+}
+
+func (c *Catalog) apply(entry *catalogEntry) {
+	key := catalogKey(entry.Type, entry.Path)
+	if _, ok := c.segments[key]; ok {
+		c.garbage++
+	}
+	if entry.Op == "del" {
+		delete(c.segments, key)
+		c.garbage++
+	} else {
+		seg := entry.SegmentInfo
+		c.segments[key] = &seg
+	}
+}
+
+func (c *Catalog) write(entry *catalogEntry) {
+	c.apply(entry)
+	if data, err := json.Marshal(entry); err == nil {
+		if _, err = c.file.Write(append(data, '\n')); err != nil {
+			log.Errorf("写入录像目录出错：%v", err)
+		}
+	}
+	if c.garbage > 1000 && c.garbage > len(c.segments) {
+		c.compact()
+	}
+}
+
+// 添加录像片段
+func (c *Catalog) Add(seg *SegmentInfo) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.write(&catalogEntry{SegmentInfo: *seg})
+}
+
+// 删除录像片段
+func (c *Catalog) Remove(typ, name string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.segments[catalogKey(typ, name)]; ok {
+		c.write(&catalogEntry{Op: "del", SegmentInfo: SegmentInfo{Type: typ, Path: slashPath(name)}})
+	}
+}
+
+// 查询条件，空值表示不限制
+type CatalogQuery struct {
+	Type       string
+	StreamPath string
+	StartTime  time.Time
+	EndTime    time.Time
+}
+
+// 查询录像片段，按开始时间排序
+func (c *Catalog) Query(q CatalogQuery) (segs []*SegmentInfo) {
+	if c == nil {
+		return
+	}
+	c.RLock()
+	for _, seg := range c.segments {
+		if q.Type != "" && seg.Type != q.Type {
+			continue
+		}
+		if q.StreamPath != "" && seg.StreamPath != q.StreamPath {
+			continue
+		}
+		if !q.StartTime.IsZero() && !seg.EndTime.After(q.StartTime) {
+			continue
+		}
+		if !q.EndTime.IsZero() && !seg.StartTime.Before(q.EndTime) {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	c.RUnlock()
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].StartTime.Before(segs[j].StartTime)
+	})
+	return
+}
+
+// 某种类型当前的全部记录，重新扫描前取得，合并时用来判断扫描期间的变化
+func (c *Catalog) Snapshot(typ string) map[string]*SegmentInfo {
+	c.RLock()
+	defer c.RUnlock()
+	before := make(map[string]*SegmentInfo)
+	for key, seg := range c.segments {
+		if seg.Type == typ {
+			before[key] = seg
+		}
+	}
+	return before
+}
+
+// 把重新扫描的结果合并到目录中。扫描前已有且扫描期间没有变化的记录按扫描结果更新，扫描中没有的删除；
+// 扫描期间新增、更新或删除的记录（如扫描时关闭的录像）以目录为准
+func (c *Catalog) Merge(typ string, segs []*SegmentInfo, before map[string]*SegmentInfo) {
+	c.Lock()
+	defer c.Unlock()
+	scanned := make(map[string]bool, len(segs))
+	for _, seg := range segs {
+		key := catalogKey(typ, seg.Path)
+		scanned[key] = true
+		cur, exist := c.segments[key]
+		old, existed := before[key]
+		if exist != existed || cur != old {
+			continue
+		}
+		c.segments[key] = seg
+	}
+	for key, old := range before {
+		if !scanned[key] && c.segments[key] == old {
+			delete(c.segments, key)
+		}
+	}
+	c.compact()
+}
+
+// 重写日志文件，只保留有效记录
+func (c *Catalog) compact() {
+	tempPath := c.Path + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		log.Errorf("压缩录像目录出错：%v", err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, seg := range c.segments {
+		enc.Encode(&catalogEntry{SegmentInfo: *seg})
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tempPath, c.Path)
+	}
+	if err != nil {
+		log.Errorf("压缩录像目录出错：%v", err)
+		os.Remove(tempPath)
+		return
+	}
+	c.file.Close()
+	if c.file, err = os.OpenFile(c.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666); err != nil {
+		log.Errorf("打开录像目录出错：%v", err)
+	}
+	c.garbage = 0
+}
+
+func videoCodecName(id codec.VideoCodecID) string {
+	switch id {
+	case codec.CodecID_H264:
+		return "h264"
+	case codec.CodecID_H265:
+		return "h265"
+	}
+	return ""
+}
+
+func audioCodecName(id codec.AudioCodecID) string {
+	switch id {
+	case codec.CodecID_AAC:
+		return "aac"
+	case codec.CodecID_PCMA:
+		return "pcma"
+	case codec.CodecID_PCMU:
+		return "pcmu"
+	}
+	return ""
+}
+
+// 重新扫描存储中的录像文件，用于补全目录
+func (r *Record) ScanSegments() (segs []*SegmentInfo, err error) {
+	var playlistTs = make(map[string]*TsInfo) //hls每天m3u8中记录的ts时长和开始时刻
+	err = r.walk("", func(name string, info fs.FileInfo) {
+		if r.typ == "hls" {
+			if path.Ext(name) == ".m3u8" && path.Base(path.Dir(name)) != "vod" {
+				if m3u8, err := ReadM3u8Info(r.storage, name); err == nil {
+					for _, ts := range m3u8.TsFiles {
+						if ts.Map != "" {
+							ts.Map = path.Join(path.Dir(name), ts.Map) //转为相对于存储根目录
+						}
+						playlistTs[path.Join(path.Dir(name), ts.FileName)] = ts
+					}
+				}
+			}
+			if !isHlsSegment(name) {
+				return
+			}
+		} else if !r.matchExt(name) {
+			return
+		}
+		seg := &SegmentInfo{
+			Type:       r.typ,
+			Path:       name,
+			StreamPath: r.streamPathOf(name),
+			Size:       info.Size(),
+			EndTime:    info.ModTime(),
+			Label:      r.parseLabel(name),
+		}
+		if r.GetDurationFn != nil {
+			if file, err := r.storage.OpenFile(name); err == nil {
+				seg.Duration = r.GetDurationFn(file)
+				file.Close()
+			}
+		}
+		// 按路径模板解析开始时间
+		if _, start, ok := r.parsePath(name); ok {
+			seg.StartTime = start
+		}
+		segs = append(segs, seg)
+	})
+	for _, seg := range segs {
+		if ts, ok := playlistTs[seg.Path]; ok {
+			seg.Duration = uint32(ts.Len * 1000)
+			seg.InitPath = ts.Map
+			seg.Discontinuity = ts.Discontinuity
+			if !ts.ProgramDateTime.IsZero() {
+				seg.StartTime = ts.ProgramDateTime
+			}
+		}
+		if seg.StartTime.IsZero() {
+			seg.StartTime = seg.EndTime.Add(-time.Duration(seg.Duration) * time.Millisecond)
+		} else if seg.Duration > 0 {
+			seg.EndTime = seg.StartTime.Add(time.Duration(seg.Duration) * time.Millisecond)
+		}
+	}
+	return
+}
+
+// 递归遍历存储中的文件
+func (r *Record) walk(dir string, fn func(name string, info fs.FileInfo)) error {
+	infos, err := r.storage.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := path.Join(slashPath(dir), info.Name())
+		if info.IsDir() {
+			if err = r.walk(name, fn); err != nil {
+				return err
+			}
+		} else {
+			fn(name, info)
+		}
+	}
+	return nil
+}
+
+// 重新扫描某种类型的录像文件并重建目录
+func (conf *RecordConfig) RebuildCatalog(typ string) (count int, err error) {
+	r := conf.getRecorderConfigByType(typ)
+	if r == nil {
+		return 0, fmt.Errorf("type %v not supported", typ)
+	}
+	if conf.catalog == nil {
+		return 0, errors.New("catalog disabled")
+	}
+	var segs []*SegmentInfo
+	before := conf.catalog.Snapshot(typ)
+	if segs, err = r.ScanSegments(); err != nil {
+		return
+	}
+	conf.catalog.Merge(typ, segs, before)
+	log.Infof("录像目录[%v]已重建，共%v个文件", typ, len(segs))
+	return len(segs), nil
+}
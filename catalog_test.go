@@ -0,0 +1,68 @@
+package record
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCatalogQuery(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "catalog.jsonl")
+	c, exist, err := OpenCatalog(file)
+	if err != nil || exist {
+		t.Fatal(err, exist)
+	}
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		c.Add(&SegmentInfo{Type: "flv", StreamPath: "live/a", Path: "live/a/" + string(rune('0'+i)) + ".flv", StartTime: now.Add(time.Duration(i) * time.Minute), EndTime: now.Add(time.Duration(i+1) * time.Minute)})
+	}
+	c.Remove("flv", "live/a/0.flv")
+	c2, exist, err := OpenCatalog(file)
+	if err != nil || !exist {
+		t.Fatal(err, exist)
+	}
+	segs := c2.Query(CatalogQuery{Type: "flv", StartTime: now.Add(90 * time.Second), EndTime: now.Add(3 * time.Minute)})
+	if len(segs) != 2 || segs[0].Path != "live/a/1.flv" || segs[1].Path != "live/a/2.flv" {
+		t.Fatalf("query %v", segs)
+	}
+}
+
+// 扫描期间新增、删除的记录不被扫描结果覆盖
+func TestCatalogMerge(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "catalog.jsonl")
+	c, _, err := OpenCatalog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Add(&SegmentInfo{Type: "flv", Path: "kept.flv"})
+	c.Add(&SegmentInfo{Type: "flv", Path: "gone.flv"})
+	c.Add(&SegmentInfo{Type: "flv", Path: "deleted.flv"})
+	c.Add(&SegmentInfo{Type: "mp4", Path: "other.mp4"})
+	before := c.Snapshot("flv")
+	// 扫描期间关闭了一个录像，清理删除了一个文件
+	c.Add(&SegmentInfo{Type: "flv", Path: "closed.flv", Duration: 1000})
+	c.Remove("flv", "deleted.flv")
+	c.Merge("flv", []*SegmentInfo{
+		{Type: "flv", Path: "kept.flv", Duration: 2000},
+		{Type: "flv", Path: "deleted.flv"},
+		{Type: "flv", Path: "found.flv"},
+	}, before)
+
+	c2, _, err := OpenCatalog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]uint32)
+	for _, seg := range c2.Query(CatalogQuery{}) {
+		got[seg.Path] = seg.Duration
+	}
+	want := map[string]uint32{"kept.flv": 2000, "closed.flv": 1000, "found.flv": 0, "other.mp4": 0}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for path, duration := range want {
+		if d, ok := got[path]; !ok || d != duration {
+			t.Errorf("%s: got %v %v, want %v", path, d, ok, duration)
+		}
+	}
+}
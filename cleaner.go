@@ -1,7 +1,9 @@
 package record
 
 import (
-	"os"
+	"errors"
+	"io/fs"
+	"path"
 	"time"
 
 	"m7s.live/engine/v4/log"
@@ -43,18 +45,60 @@ func (r *Record) execClean() {
 		return
 	}
 	log.Infof("自动清理任务执行...")
+	//先根据录像目录删除过期录像
+	r.cleanCatalog(r.AutoClean)
 	//递归扫描所有文件
-	var cleanPath = r.Path
-	var err = CleanFiles(cleanPath, r.AutoClean)
+	var err = r.CleanFiles("", r.AutoClean)
+	//hls去掉m3u8中已删除的分片
+	r.syncHlsPlaylists()
 	if err != nil {
 		panic(err)
 	}
 }
 
-// 递归清理文件和文件夹
+// 删除录像文件，同时从录像目录中移除，mp4一并删除恢复用的日志文件
+func (r *Record) removeFile(name string) (err error) {
+	err = r.storage.Remove(name)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		RecordPluginConfig.catalog.Remove(r.typ, name)
+		if r.typ == "mp4" {
+			r.storage.Remove(name + mp4JournalExt)
+		}
+	}
+	return
+}
+
+// 删除录像目录中N天前结束的录像
+func (r *Record) cleanCatalog(days int32) {
+	var catalog = RecordPluginConfig.catalog
+	if catalog == nil {
+		return
+	}
+	var y, m, d = time.Now().Date()
+	var before = time.Date(y, m, d, 0, 0, 0, 0, time.Now().Location()).AddDate(0, 0, -int(days))
+	for _, seg := range catalog.Query(CatalogQuery{Type: r.typ, EndTime: before}) {
+		if !seg.EndTime.Before(before) || r.retentionRule(seg.StreamPath) != nil {
+			continue
+		}
+		if err := r.removeFile(seg.Path); err == nil {
+			log.Infof("文件已删除：%v", seg.Path)
+		} else {
+			log.Errorf("文件删除出错：%v,%v", seg.Path, err)
+		}
+	}
+}
+
+// 递归清理本地目录中的文件和文件夹，保留原有的导出函数，pathname为本地路径
 func CleanFiles(pathname string, days int32) error {
+	r := &Record{storage: NewLocalStorage(pathname)}
+	return r.CleanFiles("", days)
+}
+
+// 递归清理文件和文件夹，pathname为相对于存储根目录的路径
+func (r *Record) CleanFiles(pathname string, days int32) error {
+	var s = r.storage
 
-	fis, err := os.ReadDir(pathname)
+	fis, err := s.ReadDir(pathname)
 	if err != nil {
 		log.Errorf("读取文件目录出错！pathname=%v, err=%v \n", pathname, err)
 		return err
@@ -62,7 +106,7 @@ func CleanFiles(pathname string, days int32) error {
 
 	if len(fis) == 0 {
 		//删除空目录
-		err = os.Remove(pathname)
+		err = s.Remove(pathname)
 		if err == nil {
 			log.Infof("目录已删除：%v", pathname)
 		} else {
@@ -74,25 +118,20 @@ func CleanFiles(pathname string, days int32) error {
 
 	// 所有文件/文件夹
 	for _, fi := range fis {
-		fullname := pathname + "/" + fi.Name()
+		fullname := path.Join(pathname, fi.Name())
 		// 是文件夹则递归进入获取;是文件，则压入数组
 		if fi.IsDir() {
-			err := CleanFiles(fullname, days)
+			err := r.CleanFiles(fullname, days)
 			if err != nil {
 				log.Errorf("清理目录出错！fullname=%v, err=%v", fullname, err)
 				//return err
 			}
-		} else {
-			var finfo, err = os.Stat(fullname)
-			if err != nil {
-				log.Errorf("获取文件信息出错：%v,%v", fullname, err)
-			} else if needClean(finfo, days) {
-				err = os.Remove(fullname)
-				if err == nil {
-					log.Infof("文件已删除：%v", fullname)
-				} else {
-					log.Errorf("文件删除出错：%v,%v", fullname, err)
-				}
+		} else if needClean(fi, days) && r.retentionRule(r.streamPathOf(fullname)) == nil {
+			err = r.removeFile(fullname)
+			if err == nil {
+				log.Infof("文件已删除：%v", fullname)
+			} else {
+				log.Errorf("文件删除出错：%v,%v", fullname, err)
 			}
 		}
 	}
@@ -100,7 +139,7 @@ func CleanFiles(pathname string, days int32) error {
 	return nil
 }
 
-func needClean(finfo os.FileInfo, days int32) bool {
+func needClean(finfo fs.FileInfo, days int32) bool {
 	var y, m, d = time.Now().Date()
 	var date = time.Date(y, m, d, 0, 0, 0, 0, time.Now().Location())
 	var isDel = (date.Sub(finfo.ModTime()).Hours() > float64(days*24))
@@ -127,3 +166,104 @@ func DailyCron(dateTime time.Time, tasks ...func()) {
 		}
 	}
 }
+
+// 文件是否正在录制中，包括正在追加的每天的m3u8
+func isRecordingFile(name string) (recording bool) {
+	RecordPluginConfig.recordings.Range(func(key, value any) bool {
+		recording = value.(IRecorder).GetRecorder().isRecording(name)
+		if h, ok := value.(*HLSRecorder); ok && !recording {
+			h.fileLock.RLock()
+			recording = h.dayPlaylistPath == name
+			h.fileLock.RUnlock()
+		}
+		return !recording
+	})
+	return
+}
+
+// 是否正在写入该文件
+func (r *Recorder) isRecording(name string) bool {
+	r.fileLock.RLock()
+	defer r.fileLock.RUnlock()
+	return r.segment != nil && r.segment.Path == name
+}
+
+// 删除分片后同步流的m3u8：每天的m3u8去掉已删除的分片，没有剩余分片时删除；引用了已删除分片的点播m3u8直接删除
+// streamPaths为空时同步全部
+func (r *Record) syncHlsPlaylists(streamPaths ...string) {
+	if r.typ != "hls" {
+		return
+	}
+	var playlists []string
+	collect := func(name string, info fs.FileInfo) {
+		if !info.IsDir() && path.Ext(name) == ".m3u8" {
+			playlists = append(playlists, name)
+		}
+	}
+	if len(streamPaths) == 0 {
+		r.walk("", collect)
+	}
+	for _, streamPath := range streamPaths {
+		for _, dir := range []string{streamPath, path.Join(streamPath, "vod")} {
+			if infos, err := r.storage.ReadDir(dir); err == nil {
+				for _, info := range infos {
+					collect(path.Join(dir, info.Name()), info)
+				}
+			}
+		}
+	}
+	for _, name := range playlists {
+		if isRecordingFile(name) {
+			continue
+		}
+		m3u8, err := ReadM3u8Info(r.storage, name)
+		if err != nil {
+			continue
+		}
+		var tsFiles []*TsInfo
+		var discontinuity bool //已删除分片的EXT-X-DISCONTINUITY移到下一个分片，第一个分片前不写入
+		for _, ts := range m3u8.TsFiles {
+			if _, err := r.storage.Stat(path.Join(path.Dir(name), ts.FileName)); err == nil {
+				ts.Discontinuity = (ts.Discontinuity || discontinuity) && len(tsFiles) > 0
+				discontinuity = false
+				tsFiles = append(tsFiles, ts)
+			} else if ts.Discontinuity {
+				discontinuity = true
+			}
+		}
+		if len(tsFiles) == len(m3u8.TsFiles) {
+			continue
+		}
+		if path.Base(path.Dir(name)) == "vod" {
+			r.removeSidecar(name)
+			continue
+		}
+		// 每天的m3u8使用各自的fmp4初始化段，不再被引用时一并删除
+		removed := m3u8.TsFiles
+		if len(tsFiles) == 0 {
+			r.removeSidecar(name)
+		} else {
+			m3u8.TsFiles = tsFiles
+			if err = writeFileAtomic(r.storage, name, []byte(m3u8.ToPlaylistContent())); err != nil {
+				log.Errorf("m3u8更新出错：%v,%v", name, err)
+				continue
+			}
+			log.Infof("m3u8已更新：%v", name)
+		}
+		r.removeUnusedInits(name, removed, tsFiles)
+	}
+}
+
+// 删除每天的m3u8中去掉的分片不再使用的初始化段
+func (r *Record) removeUnusedInits(playlist string, before, after []*TsInfo) {
+	used := make(map[string]bool)
+	for _, ts := range after {
+		used[ts.Map] = true
+	}
+	for _, ts := range before {
+		if ts.Map != "" && !used[ts.Map] {
+			used[ts.Map] = true
+			r.removeSidecar(path.Join(path.Dir(playlist), ts.Map))
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package record
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 包级的CleanFiles按本地路径清理过期文件，删除空目录
+func TestCleanFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "live", "old", "a.flv")
+	recent := filepath.Join(dir, "live", "new", "b.flv")
+	for _, name := range []string{old, recent} {
+		os.MkdirAll(filepath.Dir(name), 0777)
+		if err := os.WriteFile(name, []byte{1}, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().AddDate(0, 0, -3)
+	os.Chtimes(old, past, past)
+	if err := CleanFiles(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("%s not cleaned: %v", old, err)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Error(err)
+	}
+	// 第二次清理时删除已经空了的目录
+	CleanFiles(dir, 1)
+	if _, err := os.Stat(filepath.Dir(old)); !os.IsNotExist(err) {
+		t.Errorf("empty dir not removed: %v", err)
+	}
+}
+
+// 删除分片后每天的m3u8去掉已删除的分片，不连续标记移到下一个分片；没有剩余分片的m3u8、不再使用的初始化段和引用了已删除分片的点播m3u8一并删除
+func TestSyncHlsPlaylists(t *testing.T) {
+	dir := t.TempDir()
+	r := &Record{typ: "hls", Ext: ".m3u8", storage: NewLocalStorage(dir)}
+	head := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-TARGETDURATION:10\n"
+	writeTestFile(t, dir, "live/test/20240101.m3u8", []byte(head+
+		"#EXT-X-MAP:URI=\"a.init.mp4\"\n#EXTINF:10.000,\na.m4s\n"+
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"b.init.mp4\"\n#EXTINF:10.000,\nb.m4s\n"+
+		"#EXTINF:10.000,\nc.m4s\n"))
+	writeTestFile(t, dir, "live/test/20240102.m3u8", []byte(head+"#EXTINF:10.000,\nd.m4s\n"))
+	writeTestFile(t, dir, "live/test/20240103.m3u8", []byte(head+"#EXTINF:10.000,\ne.m4s\n"))
+	writeTestFile(t, dir, "live/test/20240104.m3u8", []byte(head+"#EXTINF:10.000,\nf.m4s\n#EXT-X-DISCONTINUITY\n#EXTINF:10.000,\ng.m4s\n#EXTINF:10.000,\nh.m4s\n"))
+	writeTestFile(t, dir, "live/test/vod/1-2.m3u8", []byte(head+"#EXTINF:10.000,\n../a.m4s\n#EXT-X-ENDLIST\n"))
+	for _, name := range []string{"a.init.mp4", "b.init.mp4", "b.m4s", "c.m4s", "e.m4s", "f.m4s", "h.m4s"} {
+		writeTestFile(t, dir, "live/test/"+name, []byte{1})
+	}
+	// a.m4s、d.m4s和g.m4s已被删除
+	r.syncHlsPlaylists("live/test")
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, "live/test", name))
+		return err == nil
+	}
+	for name, want := range map[string]bool{"20240101.m3u8": true, "20240102.m3u8": false, "20240103.m3u8": true, "vod/1-2.m3u8": false, "a.init.mp4": false, "b.init.mp4": true} {
+		if exists(name) != want {
+			t.Errorf("%s exists %v, want %v", name, !want, want)
+		}
+	}
+	m3u8, err := ReadM3u8Info(r.storage, "live/test/20240101.m3u8")
+	if err != nil || len(m3u8.TsFiles) != 2 {
+		t.Fatalf("playlist %v %v", m3u8, err)
+	}
+	// 第一个分片前不写入EXT-X-DISCONTINUITY
+	if b := m3u8.TsFiles[0]; b.FileName != "b.m4s" || b.Discontinuity || b.Map != "b.init.mp4" {
+		t.Errorf("first segment %+v", b)
+	}
+	// 已删除分片的EXT-X-DISCONTINUITY移到下一个分片
+	m3u8, err = ReadM3u8Info(r.storage, "live/test/20240104.m3u8")
+	if err != nil || len(m3u8.TsFiles) != 2 || m3u8.TsFiles[0].Discontinuity || !m3u8.TsFiles[1].Discontinuity {
+		t.Errorf("discontinuity not moved: %v", err)
+	}
+}
@@ -2,13 +2,13 @@ package record
 
 import (
 	"io"
+	"io/fs"
 	"net/http"
-	"os"
 	"path"
-	"path/filepath"
 	"regexp"
-	"strings"
 	"time"
+
+	"m7s.live/engine/v4/log"
 )
 
 type FileWr interface {
@@ -24,23 +24,38 @@ type VideoFileInfo struct {
 }
 
 type Record struct {
-	Ext           string //文件扩展名
-	Path          string //存储文件的目录
-	AutoRecord    bool
-	Filter        string
-	Fragment      time.Duration //分片大小，0表示不分片
-	AutoClean     int32         //自动清理N天前的录像，0表示不清理，30表示30天前
-	Retry         int32         //意外停止自动重试次数，-1:无限重试，0:不重试，
-	RetryInterval time.Duration //重试时间间隔,最小1秒
-	filterReg     *regexp.Regexp
-	fs            http.Handler
-	CreateFileFn  func(filename string, append bool) (FileWr, error) `json:"-" yaml:"-"`
-	GetDurationFn func(file io.ReadSeeker) uint32                    `json:"-" yaml:"-"`
+	Ext              string //文件扩展名
+	Path             string //存储文件的目录
+	AutoRecord       bool
+	Filter           string
+	Fragment         time.Duration   //分片大小，0表示不分片
+	Align            bool            //分片按时钟对齐，在每个Fragment整数倍时刻之后的第一个关键帧切片
+	AlignHardCut     time.Duration   //对齐时超过该时长仍没有关键帧则在非关键帧处强制切片，0表示不强制
+	MaxFileSize      int64           //单个文件大小上限(MB)，超过后在下一个关键帧切片，可与Fragment同时使用，0表示不限制
+	AutoClean        int32           //自动清理N天前的录像，0表示不清理，30表示30天前
+	Retry            int32           //意外停止自动重试次数，-1:无限重试，0:不重试，
+	RetryInterval    time.Duration   //重试时间间隔,最小1秒
+	Storage          StorageConfig   //存储配置，默认存储在本地磁盘Path目录
+	MaxSize          int64           //录像文件总大小上限(MB)，超过时删除最早的录像，0表示不限制
+	MinFreePercent   float64         //本地磁盘最小剩余空间百分比，低于时删除最早的录像，0表示不限制
+	QuotaInterval    time.Duration   //配额和保留策略检查间隔，默认1分钟
+	Retention        []RetentionRule //按流设置的保留策略，匹配的流不再按AutoClean清理
+	PathTemplate     string          //文件路径模板（不含扩展名），为空时使用默认布局
+	TimeZone         string          //路径模板中时间所用的时区，如Asia/Shanghai，为空时使用本地时区
+	SegmentFormat    string          //hls分片格式，ts(默认)或fmp4（初始化段加.m4s分片）
+	template         *pathTemplate
+	location         *time.Location
+	periodicCleaning bool
+	filterReg        *regexp.Regexp
+	storage          Storage
+	typ              string                                             //录像类型 flv|mp4|fmp4|hls|raw|raw_audio
+	CreateFileFn     func(filename string, append bool) (FileWr, error) `json:"-" yaml:"-"`
+	GetDurationFn    func(file io.ReadSeeker) uint32                    `json:"-" yaml:"-"`
 	// recording     map[string]IRecorder
 }
 
 func (r *Record) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	r.fs.ServeHTTP(w, req)
+	r.storage.ServeHTTP(w, req)
 }
 
 func (r *Record) NeedRecord(streamPath string) bool {
@@ -49,63 +64,92 @@ func (r *Record) NeedRecord(streamPath string) bool {
 
 func (r *Record) Init() {
 	// r.recording = make(map[string]IRecorder)
-	os.MkdirAll(r.Path, 0777)
 	if r.Filter != "" {
 		r.filterReg = regexp.MustCompile(r.Filter)
 	}
-	r.fs = http.FileServer(http.Dir(r.Path))
-	r.CreateFileFn = func(filename string, append bool) (file FileWr, err error) {
-		filePath := filepath.Join(r.Path, filename)
-		if err = os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
-			return file, err
-		}
-		file, err = os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0777)
-		return
+	r.initRetention()
+	if err := r.initTemplate(); err != nil {
+		log.Errorf("录像路径模板配置错误[%v]：%v", r.typ, err)
 	}
+	r.storage = r.Storage.NewStorage(r.Path)
+	r.CreateFileFn = r.storage.CreateFile
+}
 
+// 录像类型 flv|mp4|fmp4|hls|raw|raw_audio
+func (r *Record) Type() string {
+	return r.typ
 }
 
+// 录像文件所在的存储
+func (r *Record) GetStorage() Storage {
+	return r.storage
+}
+
+// 递归列出dstPath（相对于存储根目录）下的录像文件
 func (r *Record) Tree(dstPath string, level int) (files []*VideoFileInfo, err error) {
-	var dstF *os.File
-	dstF, err = os.Open(dstPath)
-	if err != nil {
+	var fileInfo fs.FileInfo
+	if fileInfo, err = r.storage.Stat(dstPath); err != nil {
 		return
 	}
-	defer dstF.Close()
-	fileInfo, err := dstF.Stat()
-	if err != nil {
+	if !fileInfo.IsDir() { //如果dstPath是文件
+		if file := r.videoFileInfo(dstPath, fileInfo); file != nil {
+			files = append(files, file)
+		}
 		return
 	}
-	if !fileInfo.IsDir() { //如果dstF是文件
-		if r.Ext == "." || path.Ext(fileInfo.Name()) == r.Ext {
-			p := strings.TrimPrefix(dstPath, r.Path)
-			p = strings.ReplaceAll(p, "\\", "/")
-			var duration uint32
-			if r.GetDurationFn != nil {
-				duration = r.GetDurationFn(dstF)
-			}
-			files = append(files, &VideoFileInfo{
-				Path:     strings.TrimPrefix(p, "/"),
-				Size:     fileInfo.Size(),
-				Duration: duration,
-			})
-		}
+	return r.treeDir(dstPath)
+}
+
+func (r *Record) treeDir(dir string) (files []*VideoFileInfo, err error) {
+	var infos []fs.FileInfo
+	infos, err = r.storage.ReadDir(dir) //获取文件夹下各个文件或文件夹的fileInfo
+	if err != nil {
 		return
-	} else { //如果dstF是文件夹
-		var dir []os.FileInfo
-		dir, err = dstF.Readdir(0) //获取文件夹下各个文件或文件夹的fileInfo
-		if err != nil {
-			return
-		}
-		for _, fileInfo = range dir {
+	}
+	for _, fileInfo := range infos {
+		name := path.Join(slashPath(dir), fileInfo.Name())
+		if fileInfo.IsDir() {
 			var _files []*VideoFileInfo
-			_files, err = r.Tree(filepath.Join(dstPath, fileInfo.Name()), level+1)
-			if err != nil {
+			if _files, err = r.treeDir(name); err != nil {
 				return
 			}
 			files = append(files, _files...)
+		} else if file := r.videoFileInfo(name, fileInfo); file != nil {
+			files = append(files, file)
 		}
-		return
 	}
+	return
+}
 
+// 文件扩展名是否属于该类型的录像，裸流根据编码确定扩展名
+func (r *Record) matchExt(name string) bool {
+	var ext = path.Ext(name)
+	if r.Ext != "." {
+		return ext == r.Ext
+	}
+	switch r.typ {
+	case "raw":
+		return ext == ".h264" || ext == ".h265"
+	case "raw_audio":
+		return ext == ".aac" || ext == ".pcma" || ext == ".pcmu"
+	}
+	return true
+}
+
+func (r *Record) videoFileInfo(name string, fileInfo fs.FileInfo) *VideoFileInfo {
+	if !r.matchExt(fileInfo.Name()) {
+		return nil
+	}
+	var duration uint32
+	if r.GetDurationFn != nil {
+		if file, err := r.storage.OpenFile(name); err == nil {
+			duration = r.GetDurationFn(file)
+			file.Close()
+		}
+	}
+	return &VideoFileInfo{
+		Path:     slashPath(name),
+		Size:     fileInfo.Size(),
+		Duration: duration,
+	}
 }
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package record
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// 获取目录所在磁盘的剩余空间和总空间
+func diskUsage(dir string) (free, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(dir, &stat); err != nil {
+		return
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
+
+// 目录所在磁盘的标识，同一磁盘上的目录相同
+func volumeID(dir string) (string, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(dir, &stat); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(uint64(stat.Dev), 10), nil
+}
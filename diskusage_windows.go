@@ -0,0 +1,32 @@
+package record
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// 获取目录所在磁盘的剩余空间和总空间
+func diskUsage(dir string) (free, total uint64, err error) {
+	var p *uint16
+	if p, err = syscall.UTF16PtrFromString(dir); err != nil {
+		return
+	}
+	ret, _, e := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), 0)
+	if ret == 0 {
+		err = e
+	}
+	return
+}
+
+// 目录所在磁盘的标识，同一磁盘上的目录相同
+func volumeID(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(filepath.VolumeName(abs)), nil
+}
@@ -44,8 +44,12 @@ func (p *RecordConfig) API_download(w http.ResponseWriter, r *http.Request) {
 	var startTime = q.Get("st")
 	var endTime = q.Get("et")
 	var streamPath = q.Get("path")
+	var label = q.Get("label")
+	if !labelReg.MatchString(label) {
+		panic("invalid label")
+	}
 
-	var m3u8Info = p.genVod(startTime, endTime, streamPath)
+	var m3u8Info = p.genVod(startTime, endTime, streamPath, label)
 	if m3u8Info == nil {
 		panic("生成HLS点播文件失败！")
 	}
@@ -55,7 +59,12 @@ func (p *RecordConfig) API_download(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "video/mpeg")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%v", downloadName))
 	var errOut util.Buffer
-	cmd := exec.Command(p.FFmpeg, "-i", m3u8Info.Path, "-vcodec", "copy", "-acodec", "copy", "-f", "mpegts", "pipe:1")
+	//非本地存储时通过点播地址读取
+	var input = m3u8Info.Path
+	if _, ok := p.Hls.GetStorage().(*LocalStorage); !ok {
+		input = vodUrl(r.Host, m3u8Info.VodPath)
+	}
+	cmd := exec.Command(p.FFmpeg, "-i", input, "-vcodec", "copy", "-acodec", "copy", "-f", "mpegts", "pipe:1")
 	cmd.Stderr = &errOut
 	cmd.Stdout = w
 	cmd.Run()
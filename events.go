@@ -0,0 +1,49 @@
+package record
+
+import (
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+)
+
+// 发布到引擎事件总线的录像事件，其他插件可在OnEvent中处理，Target为录像器
+type RecordStarted struct{ Event[*Recorder] }
+
+// 录像文件写完，Segment包含文件路径和起止时间
+type SegmentClosed struct {
+	Event[*Recorder]
+	Segment *SegmentInfo
+}
+
+type RecordStopped struct{ Event[*Recorder] }
+
+// 录像出错，创建或写入文件失败，或者订阅流失败
+type RecordFailed struct {
+	Event[*Recorder]
+	Error error
+}
+
+// 不阻塞录像，事件总线满时丢弃事件并记录日志
+func (r *Recorder) publishEvent(event string, seg *SegmentInfo, err error) {
+	if EventBus == nil {
+		return
+	}
+	base := CreateEvent(r)
+	var e any
+	switch event {
+	case RecordEventStart:
+		e = RecordStarted{base}
+	case RecordEventSegment:
+		e = SegmentClosed{base, seg}
+	case RecordEventStop:
+		e = RecordStopped{base}
+	case RecordEventError:
+		e = RecordFailed{base, err}
+	default:
+		return
+	}
+	select {
+	case EventBus <- e:
+	default:
+		plugin.Logger.Warn("event bus full, drop record event", zap.String("event", event), zap.String("id", r.ID))
+	}
+}
@@ -0,0 +1,183 @@
+package record
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+)
+
+// 共享订阅，每个流只订阅一次，把帧分发给该流的所有录像器
+type sharedSubscriber struct {
+	Subscriber
+	sync.Mutex
+	sinks  []*Recorder
+	closed bool
+	ready  chan struct{}
+	err    error
+}
+
+var sharedSubscribers sync.Map
+
+// 获取流的共享订阅，不存在时创建
+func getSharedSubscriber(streamPath string) (*sharedSubscriber, error) {
+	for {
+		s := &sharedSubscriber{ready: make(chan struct{})}
+		s.ID = streamPath + "/shared"
+		if value, loaded := sharedSubscribers.LoadOrStore(streamPath, s); loaded {
+			old := value.(*sharedSubscriber)
+			<-old.ready
+			if old.err != nil {
+				return nil, old.err
+			}
+			old.Lock()
+			closed := old.closed
+			old.Unlock()
+			if !closed {
+				return old, nil
+			}
+			// 已关闭的还未移除
+			sharedSubscribers.CompareAndDelete(streamPath, old)
+			continue
+		}
+		s.err = plugin.Subscribe(streamPath, s)
+		close(s.ready)
+		if s.err != nil {
+			sharedSubscribers.CompareAndDelete(streamPath, s)
+			return nil, s.err
+		}
+		go func() {
+			s.PlayBlock(SUBTYPE_RAW)
+			s.close("shared subscriber closed")
+		}()
+		return s, nil
+	}
+}
+
+// 流关闭或没有录像器时关闭共享订阅，停止剩余的录像器
+func (s *sharedSubscriber) close(reason string) {
+	s.Lock()
+	sinks := s.sinks
+	s.sinks = nil
+	s.closed = true
+	s.Unlock()
+	sharedSubscribers.CompareAndDelete(s.Stream.Path, s)
+	s.Stop(zap.String("reason", reason))
+	for _, r := range sinks {
+		r.Stop(zap.String("reason", reason))
+	}
+}
+
+func (s *sharedSubscriber) OnEvent(event any) {
+	switch event.(type) {
+	case VideoFrame, AudioFrame:
+		// 写入时不持有锁，录像器写盘慢时不阻塞其他录像器接入和退出
+		s.Lock()
+		sinks := append([]*Recorder(nil), s.sinks...)
+		s.Unlock()
+		for _, r := range sinks {
+			r.feed(event)
+		}
+	default:
+		s.Subscriber.OnEvent(event)
+	}
+}
+
+// 录像器接入共享订阅，不再单独订阅
+func (s *sharedSubscriber) attach(re IRecorder) {
+	r := re.GetRecorder()
+	r.shared = s
+	r.sink = sharedSink{}
+	r.Stream = s.Stream
+	r.Config = s.Config
+	r.Logger = s.Logger.With(zap.String("recorder", r.ID))
+	r.Spesific = re
+	r.Context, r.CancelFunc = context.WithCancel(s.Context)
+}
+
+// 代替PlayBlock，先发送轨道和录像器事件，之后由共享订阅分发帧，直到录像停止
+func (s *sharedSubscriber) play(re IRecorder) {
+	r := re.GetRecorder()
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		r.Stop(zap.String("reason", "shared subscriber closed"))
+		return
+	}
+	if s.Video != nil {
+		re.OnEvent(s.Video)
+	}
+	if s.Audio != nil {
+		re.OnEvent(s.Audio)
+	}
+	re.OnEvent(re)
+	s.sinks = append(s.sinks, r)
+	s.Unlock()
+	<-r.Done()
+	s.Lock()
+	for i, sink := range s.sinks {
+		if sink == r {
+			s.sinks = append(s.sinks[:i], s.sinks[i+1:]...)
+			break
+		}
+	}
+	last := len(s.sinks) == 0 && !s.closed
+	s.Unlock()
+	if last {
+		s.close("no recorder")
+	}
+}
+
+// 共享订阅中录像器的时间戳状态，录像从接入后的第一个关键帧开始
+type sharedSink struct {
+	started     bool
+	base        time.Duration //录像开始时帧的时间戳
+	prerecorded bool          //已写入预录缓存，实时帧从缓存之后开始
+	videoAfter  time.Duration
+	audioAfter  time.Duration
+}
+
+// 计算帧相对于录像开始的时间，返回false时丢弃
+func (r *Recorder) sinkTime(frame *AVFrame, video bool) (abs time.Duration, ok bool) {
+	s := &r.sink
+	if !s.started {
+		// 从视频关键帧开始，纯音频从第一帧开始
+		if video && !frame.IFrame || !video && r.VideoReader != nil {
+			return
+		}
+		s.started = true
+		s.base = frame.Timestamp
+	}
+	if s.prerecorded && (video && frame.Timestamp <= s.videoAfter || !video && frame.Timestamp <= s.audioAfter) {
+		return
+	}
+	abs = frame.Timestamp - s.base
+	return abs, abs >= 0
+}
+
+// 把共享订阅的帧换算为录像自己的时间戳后写入，录像停止后（finish关闭文件时已停止）不再写入
+func (r *Recorder) feed(event any) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	if r.IsClosed() {
+		return
+	}
+	switch v := event.(type) {
+	case VideoFrame:
+		if abs, ok := r.sinkTime(v.AVFrame, true); ok {
+			cts := v.PTS - v.DTS
+			v.AbsTime, v.DTS = uint32(abs.Milliseconds()), uint32(abs*90/time.Millisecond)
+			v.PTS = v.DTS + cts
+			r.Spesific.OnEvent(v)
+		}
+	case AudioFrame:
+		if abs, ok := r.sinkTime(v.AVFrame, false); ok {
+			cts := v.PTS - v.DTS
+			v.AbsTime, v.DTS = uint32(abs.Milliseconds()), uint32(abs*90/time.Millisecond)
+			v.PTS = v.DTS + cts
+			r.Spesific.OnEvent(v)
+		}
+	}
+}
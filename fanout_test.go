@@ -0,0 +1,89 @@
+package record
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/log"
+)
+
+// 记录写入和关闭的录像器，写入较慢，便于和关闭交错
+type fanoutTestRecorder struct {
+	Recorder
+	writes      atomic.Int32
+	afterClose  atomic.Int32
+	closed      atomic.Bool
+	closeCalled atomic.Int32
+}
+
+func (r *fanoutTestRecorder) Start(streamPath string) error { return nil }
+
+func (r *fanoutTestRecorder) CreateFile() (FileWr, error) { return nil, nil }
+
+func (r *fanoutTestRecorder) OnEvent(event any) {
+	if _, ok := event.(AudioFrame); ok {
+		if r.closed.Load() {
+			r.afterClose.Add(1)
+		}
+		time.Sleep(100 * time.Microsecond)
+		if r.closed.Load() {
+			r.afterClose.Add(1)
+		}
+		r.writes.Add(1)
+	}
+}
+
+func (r *fanoutTestRecorder) Close() error {
+	r.closed.Store(true)
+	r.closeCalled.Add(1)
+	return nil
+}
+
+// 共享订阅的协程写入帧时录像停止，finish等待正在写入的帧写完后再关闭文件，关闭后不再写入
+func TestFeedAndFinish(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	for i := 0; i < 20; i++ {
+		re := &fanoutTestRecorder{}
+		r := &re.Recorder
+		r.ID = "fanout-test"
+		r.Logger = plugin.Logger
+		r.Spesific = re
+		r.Context, r.CancelFunc = context.WithCancel(context.Background())
+		r.stopped = make(chan struct{})
+		r.State.set(RecorderRecording)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		done := make(chan struct{})
+		go func() {
+			defer wg.Done()
+			for ts := time.Duration(0); ; ts += 20 * time.Millisecond {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				r.feed(AudioFrame{AVFrame: &AVFrame{Timestamp: ts}})
+			}
+		}()
+		waitFor(t, func() bool { return re.writes.Load() > 0 })
+		r.finish(re)
+		close(done)
+		wg.Wait()
+		if n := re.afterClose.Load(); n != 0 {
+			t.Fatalf("%d writes after close", n)
+		}
+		if re.closeCalled.Load() != 1 || r.State.Load() != RecorderStopped {
+			t.Fatalf("close called %d, state %s", re.closeCalled.Load(), r.State.Load())
+		}
+		writes := re.writes.Load()
+		r.feed(AudioFrame{AVFrame: &AVFrame{Timestamp: time.Hour}})
+		if re.writes.Load() != writes {
+			t.Fatal("feed after finish")
+		}
+	}
+}
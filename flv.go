@@ -1,9 +1,10 @@
 package record
 
 import (
+	"bytes"
 	"io"
 	"net"
-	"os"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -18,6 +19,8 @@ type FLVRecorder struct {
 	times         []float64
 	Offset        int64
 	duration      int64
+	videoSeqHead  []byte //新文件开始时已写入的序列头，跳过订阅开始时重复发送的序列头
+	audioSeqHead  []byte
 }
 
 func NewFLVRecorder() (r *FLVRecorder) {
@@ -27,16 +30,19 @@ func NewFLVRecorder() (r *FLVRecorder) {
 }
 
 func (r *FLVRecorder) Start(streamPath string) (err error) {
-	r.ID = streamPath + "/flv"
 	return r.start(r, streamPath, SUBTYPE_FLV)
 }
 
-func (r *FLVRecorder) writeMetaData(file FileWr, duration int64) {
-	defer file.Close()
+// 文件头后预留的onMetaData标签数据大小，关闭文件时原地写入最终的元数据
+const flvMetaDataSize = 32 * 1024
+
+// 元数据标签（含标签头和PreviousTagSize）之后的第一个字节在文件中的位置
+var flvDataOffset = int64(len(codec.FLVHeader)) + 11 + flvMetaDataSize + 4
+
+func (r *FLVRecorder) metaData(duration int64) (metaData util.EcmaArray, flags byte) {
 	at, vt := r.Audio, r.Video
 	hasAudio, hasVideo := at != nil, vt != nil
-	var amf util.AMF
-	metaData := util.EcmaArray{
+	metaData = util.EcmaArray{
 		"MetaDataCreator": "m7s " + Engine.Version,
 		"hasVideo":        hasVideo,
 		"hasAudio":        hasAudio,
@@ -44,9 +50,8 @@ func (r *FLVRecorder) writeMetaData(file FileWr, duration int64) {
 		"canSeekToEnd":    false,
 		"duration":        float64(duration) / 1000,
 		"hasKeyFrames":    len(r.filepositions) > 0,
-		"filesize":        0,
+		"filesize":        uint64(flvDataOffset + r.Offset),
 	}
-	var flags byte
 	if hasAudio {
 		flags |= (1 << 2)
 		metaData["audiocodecid"] = int(at.CodecID)
@@ -61,76 +66,169 @@ func (r *FLVRecorder) writeMetaData(file FileWr, duration int64) {
 		metaData["height"] = vt.SPSInfo.Height
 		metaData["framerate"] = vt.FPS
 		metaData["videodatarate"] = vt.BPS
-		metaData["keyframes"] = map[string]any{
-			"filepositions": r.filepositions,
-			"times":         r.times,
-		}
-		defer func() {
-			r.filepositions = []uint64{0}
-			r.times = []float64{0}
-		}()
-	}
-	amf.Marshals("onMetaData", metaData)
-	offset := amf.Len() + len(codec.FLVHeader) + 15
-	if keyframesCount := len(r.filepositions); keyframesCount > 0 {
-		metaData["filesize"] = uint64(offset) + r.filepositions[keyframesCount-1]
-		for i := range r.filepositions {
-			r.filepositions[i] += uint64(offset)
-		}
-		metaData["keyframes"] = map[string]any{
-			"filepositions": r.filepositions,
-			"times":         r.times,
-		}
 	}
+	return
+}
 
-	if tempFile, err := os.CreateTemp("", "*.flv"); err != nil {
-		r.Error("create temp file failed: ", zap.Error(err))
-		return
-	} else {
-		defer func() {
-			tempFile.Close()
-			os.Remove(tempFile.Name())
-			r.Info("writeMetaData success")
-		}()
-		_, err := tempFile.Write([]byte{'F', 'L', 'V', 0x01, flags, 0, 0, 0, 9, 0, 0, 0, 0})
-		if err != nil {
-			r.Error("", zap.Error(err))
-			return
+// 按预留大小编码onMetaData，关键帧过多时按间隔抽取
+func (r *FLVRecorder) marshalMetaData(duration int64) (data []byte, flags byte) {
+	var amf util.AMF
+	metaData, flags := r.metaData(duration)
+	filepositions, times := r.filepositions, r.times
+	for {
+		if len(filepositions) > 0 {
+			positions := make([]uint64, len(filepositions))
+			for i := range filepositions {
+				positions[i] = filepositions[i] + uint64(flvDataOffset)
+			}
+			metaData["keyframes"] = map[string]any{
+				"filepositions": positions,
+				"times":         times,
+			}
 		}
+		// 用padding字段补齐到预留大小
+		metaData["padding"] = ""
 		amf.Reset()
-		marshals := amf.Marshals("onMetaData", metaData)
-		codec.WriteFLVTag(tempFile, codec.FLV_TAG_TYPE_SCRIPT, 0, marshals)
-		_, err = file.Seek(int64(len(codec.FLVHeader)), io.SeekStart)
-		if err != nil {
-			r.Error("writeMetaData Seek failed: ", zap.Error(err))
-			return
+		size := len(amf.Marshals("onMetaData", metaData))
+		if padding := flvMetaDataSize - size; padding >= 0 {
+			metaData["padding"] = strings.Repeat(" ", padding)
+			amf.Reset()
+			return amf.Marshals("onMetaData", metaData), flags
 		}
-		_, err = io.Copy(tempFile, file)
-		if err != nil {
-			r.Error("writeMetaData Copy failed: ", zap.Error(err))
-			return
+		if len(filepositions) == 0 {
+			r.Error("flv metadata too large", zap.Int("size", size))
+			return nil, flags
 		}
-		tempFile.Seek(0, io.SeekStart)
-		file.Seek(0, io.SeekStart)
-		_, err = io.Copy(file, tempFile)
-		if err != nil {
-			r.Error("writeMetaData Copy failed: ", zap.Error(err))
-			return
+		var positions []uint64
+		var ts []float64
+		for i := 0; i < len(filepositions); i += 2 {
+			positions = append(positions, filepositions[i])
+			ts = append(ts, times[i])
 		}
+		filepositions, times = positions, ts
+	}
+}
+
+// 写入文件头和预留的onMetaData标签
+func (r *FLVRecorder) writeHeader(file FileWr) (err error) {
+	r.Offset = 0
+	r.filepositions = nil
+	r.times = nil
+	r.videoSeqHead, r.audioSeqHead = nil, nil
+	if _, err = file.Write(codec.FLVHeader); err != nil {
+		return
+	}
+	data, _ := r.marshalMetaData(0)
+	return codec.WriteFLVTag(file, codec.FLV_TAG_TYPE_SCRIPT, 0, data)
+}
+
+// 新文件开始时自己写入序列头，保证预录缓存中的帧在解码配置之后
+// 共享订阅没有FLV格式的序列头，独立订阅时PlayBlock随后发送的相同序列头会被跳过
+func (r *FLVRecorder) writeSequenceHead(file FileWr) {
+	var flv net.Buffers
+	if r.Video != nil && len(r.Video.SequenceHead) > 0 {
+		r.videoSeqHead = r.Video.SequenceHead
+		flv = codec.VideoAVCC2FLV(0, r.videoSeqHead)
+	}
+	if r.Audio != nil && r.Audio.CodecID == codec.CodecID_AAC && len(r.Audio.SequenceHead) > 0 {
+		r.audioSeqHead = r.Audio.SequenceHead
+		flv = append(flv, codec.AudioAVCC2FLV(0, r.audioSeqHead)...)
+	}
+	n, err := flv.WriteTo(file)
+	r.Offset += n
+	if err != nil {
+		r.Error("write sequence head failed", zap.Error(err))
+		r.fail(err)
+	}
+}
+
+// 是否为已经写入过的序列头，每个序列头只跳过一次，之后的序列头变化照常写入
+func (r *FLVRecorder) duplicateSequenceHead(v FLVFrame) bool {
+	seqHead := &r.audioSeqHead
+	if v.IsVideo() {
+		seqHead = &r.videoSeqHead
+	}
+	if *seqHead == nil {
+		return false
+	}
+	size := 0
+	for _, b := range v {
+		size += len(b)
+	}
+	// 标签头11字节，末尾4字节PreviousTagSize
+	if size != 11+len(*seqHead)+4 {
+		return false
+	}
+	tag := util.ConcatBuffers(v)
+	if !bytes.Equal(tag[11:size-4], *seqHead) {
+		return false
+	}
+	*seqHead = nil
+	return true
+}
+
+// 原地改写文件头的音视频标志和预留的onMetaData标签
+func (r *FLVRecorder) writeMetaData(file FileWr, duration int64) {
+	data, flags := r.marshalMetaData(duration)
+	if data == nil {
+		return
+	}
+	if _, err := file.Seek(4, io.SeekStart); err != nil {
+		r.Error("writeMetaData Seek failed: ", zap.Error(err))
+		return
+	}
+	if _, err := file.Write([]byte{flags}); err != nil {
+		r.Error("writeMetaData failed: ", zap.Error(err))
+		return
 	}
+	if _, err := file.Seek(int64(len(codec.FLVHeader)), io.SeekStart); err != nil {
+		r.Error("writeMetaData Seek failed: ", zap.Error(err))
+		return
+	}
+	if err := codec.WriteFLVTag(file, codec.FLV_TAG_TYPE_SCRIPT, 0, data); err != nil {
+		r.Error("writeMetaData failed: ", zap.Error(err))
+		return
+	}
+	file.Seek(0, io.SeekEnd)
+	r.Info("writeMetaData success")
 }
 
 func (r *FLVRecorder) OnEvent(event any) {
+	switch v := event.(type) {
+	case VideoFrame: //预录缓存中的帧，共享订阅时为实时帧
+		if r.shared != nil {
+			r.Recorder.OnEvent(event)
+		}
+		ts := v.AbsTime - r.SkipTS //切片后从0开始
+		r.lastTS, r.duration = v.AbsTime, int64(ts)
+		r.writeFrame(FLVFrame(codec.VideoAVCC2FLV(ts, v.AVCC.ToBuffers()...)), ts, v.IFrame)
+		return
+	case AudioFrame:
+		if r.shared != nil {
+			r.Recorder.OnEvent(event)
+		}
+		ts := v.AbsTime - r.SkipTS
+		if r.VideoReader == nil {
+			r.lastTS, r.duration = v.AbsTime, int64(ts)
+		}
+		r.writeFrame(FLVFrame(codec.AudioAVCC2FLV(ts, v.AVCC.ToBuffers()...)), ts, false)
+		return
+	}
 	r.Recorder.OnEvent(event)
 	switch v := event.(type) {
 	case FileWr:
 		// 写入文件头
 		if !r.append {
-			v.Write(codec.FLVHeader)
+			if err := r.writeHeader(v); err != nil {
+				r.Error("write header failed", zap.Error(err))
+				r.fail(err)
+				return
+			}
+			r.writeSequenceHead(v)
 		} else {
 			if _, err := v.Seek(-4, io.SeekEnd); err != nil {
 				r.Error("seek file failed", zap.Error(err))
-				v.Write(codec.FLVHeader)
+				r.writeHeader(v)
 			} else {
 				tmp := make(util.Buffer, 4)
 				tmp2 := tmp
@@ -151,6 +249,9 @@ func (r *FLVRecorder) OnEvent(event any) {
 			}
 		}
 	case FLVFrame:
+		if r.duplicateSequenceHead(v) {
+			return
+		}
 		check := false
 		var absTime uint32
 		if r.VideoReader == nil {
@@ -159,52 +260,94 @@ func (r *FLVRecorder) OnEvent(event any) {
 		} else if v.IsVideo() {
 			check = r.VideoReader.Value.IFrame
 			absTime = r.VideoReader.AbsTime
-			if check {
-				r.filepositions = append(r.filepositions, uint64(r.Offset))
-				r.times = append(r.times, float64(absTime)/1000)
-			}
 		}
 
-		if r.duration = int64(absTime); r.Fragment > 0 && check && time.Duration(r.duration)*time.Millisecond >= r.Fragment {
+		if v.IsVideo() || r.VideoReader == nil {
+			r.lastTS = absTime
+			r.duration = int64(absTime)
+		}
+		if r.fragmented() && (v.IsVideo() || r.VideoReader == nil) && r.needCut(absTime, check) {
 			r.Close()
-			r.Offset = 0
-			if file, err := r.createFile(); err == nil {
-				r.File = file
-				file.Write(codec.FLVHeader)
-				var dcflv net.Buffers
-				if r.VideoReader != nil {
-					r.VideoReader.ResetAbsTime()
-					dcflv = codec.VideoAVCC2FLV(0, r.VideoReader.Track.SequenceHead)
-					flv := append(dcflv, codec.VideoAVCC2FLV(0, r.VideoReader.Value.AVCC.ToBuffers()...)...)
-					flv.WriteTo(file)
-				}
-				if r.AudioReader != nil {
-					r.AudioReader.ResetAbsTime()
-					if r.Audio.CodecID == codec.CodecID_AAC {
-						dcflv = codec.AudioAVCC2FLV(0, r.AudioReader.Track.SequenceHead)
-					}
-					flv := append(dcflv, codec.AudioAVCC2FLV(0, r.AudioReader.Value.AVCC.ToBuffers()...)...)
-					flv.WriteTo(file)
-				}
+			r.File = nil
+			r.lastTS = 0
+			r.duration = 0
+			file, err := r.createFile()
+			if err != nil {
+				// 已关闭的文件不能再写入
+				r.fail(err)
 				return
 			}
+			r.File = file
+			r.onCut(check)
+			if err = r.writeCutHead(file, check); err != nil {
+				r.Error("write file failed", zap.Error(err))
+				r.fail(err)
+			}
+			return
 		}
-		if n, err := v.WriteTo(r.File); err != nil {
-			r.Error("write file failed", zap.Error(err))
-			r.Stop(zap.Error(err))
-		} else {
-			r.Offset += n
+		r.writeFrame(v, absTime, check && v.IsVideo())
+	}
+}
+
+// 切片后的新文件写入文件头、序列头和当前帧，时间戳从0开始
+func (r *FLVRecorder) writeCutHead(file FileWr, keyFrame bool) (err error) {
+	if err = r.writeHeader(file); err != nil {
+		return
+	}
+	var n int64
+	if r.VideoReader != nil {
+		r.VideoReader.ResetAbsTime()
+		dcflv := codec.VideoAVCC2FLV(0, r.VideoReader.Track.SequenceHead)
+		n, err = dcflv.WriteTo(file)
+		r.Offset += n
+		if err != nil {
+			return
+		}
+		if keyFrame {
+			r.filepositions = append(r.filepositions, uint64(r.Offset))
+			r.times = append(r.times, 0)
+		}
+		flv := codec.VideoAVCC2FLV(0, r.VideoReader.Value.AVCC.ToBuffers()...)
+		n, err = flv.WriteTo(file)
+		r.Offset += n
+		if err != nil {
+			return
 		}
 	}
+	if r.AudioReader != nil {
+		r.AudioReader.ResetAbsTime()
+		var flv net.Buffers
+		if r.Audio.CodecID == codec.CodecID_AAC {
+			flv = codec.AudioAVCC2FLV(0, r.AudioReader.Track.SequenceHead)
+		}
+		flv = append(flv, codec.AudioAVCC2FLV(0, r.AudioReader.Value.AVCC.ToBuffers()...)...)
+		n, err = flv.WriteTo(file)
+		r.Offset += n
+	}
+	return
+}
+
+// 写入一个标签，视频关键帧记录其位置
+func (r *FLVRecorder) writeFrame(v FLVFrame, absTime uint32, keyFrame bool) {
+	if keyFrame {
+		r.filepositions = append(r.filepositions, uint64(r.Offset))
+		r.times = append(r.times, float64(absTime)/1000)
+	}
+	if n, err := v.WriteTo(r.File); err != nil {
+		r.Error("write file failed", zap.Error(err))
+		r.fail(err)
+	} else {
+		r.Offset += n
+	}
 }
 
 func (r *FLVRecorder) Close() error {
-	if r.File != nil {
-		if !r.append {
-			go r.writeMetaData(r.File, r.duration)
-		} else {
-			return r.File.Close()
-		}
+	if r.File == nil {
+		return nil
+	}
+	if !r.append {
+		r.writeMetaData(r.File, r.duration)
 	}
-	return nil
+	defer r.endSegment()
+	return r.File.Close()
 }
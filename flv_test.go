@@ -0,0 +1,163 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/log"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+func testFrame(iframe bool, avcc []byte) *AVFrame {
+	frame := &AVFrame{IFrame: iframe}
+	frame.AVCC.Push(&util.ListItem[util.Buffer]{Value: avcc})
+	return frame
+}
+
+// 预录缓存的帧必须写在序列头之后，PlayBlock随后发送的相同序列头不再重复写入
+func TestFLVSequenceHeadBeforePreRecord(t *testing.T) {
+	file, err := os.Create(t.TempDir() + "/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	avcSeq := []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f, 0xff}
+	aacSeq := []byte{0xaf, 0, 0x12, 0x10}
+	r := NewFLVRecorder()
+	r.Logger = &log.Logger{Logger: zap.NewNop()}
+	r.Video = &track.Video{CodecID: codec.CodecID_H264}
+	r.Video.SequenceHead = avcSeq
+	r.Audio = &track.Audio{CodecID: codec.CodecID_AAC}
+	r.Audio.SequenceHead = aacSeq
+	r.File = file
+	// 与Recorder.OnEvent的顺序一致：创建文件、写入预录缓存、PlayBlock发送序列头
+	r.OnEvent(FileWr(file))
+	r.OnEvent(VideoFrame{AVFrame: testFrame(true, []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 1, 0x65}), Video: r.Video})
+	r.OnEvent(AudioFrame{AVFrame: testFrame(false, []byte{0xaf, 1, 0x21}), Audio: r.Audio, AbsTime: 20})
+	r.OnEvent(FLVFrame(codec.VideoAVCC2FLV(0, avcSeq)))
+	r.OnEvent(FLVFrame(codec.AudioAVCC2FLV(0, aacSeq)))
+
+	if _, err = file.Seek(int64(len(codec.FLVHeader)), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	type tag struct {
+		typ     byte
+		seqHead bool
+	}
+	var tags []tag
+	for {
+		typ, _, payload, err := codec.ReadFLVTag(file)
+		if err != nil {
+			break
+		}
+		tags = append(tags, tag{typ, typ != codec.FLV_TAG_TYPE_SCRIPT && (bytes.Equal(payload, avcSeq) || bytes.Equal(payload, aacSeq))})
+	}
+	want := []tag{
+		{codec.FLV_TAG_TYPE_SCRIPT, false},
+		{codec.FLV_TAG_TYPE_VIDEO, true},
+		{codec.FLV_TAG_TYPE_AUDIO, true},
+		{codec.FLV_TAG_TYPE_VIDEO, false},
+		{codec.FLV_TAG_TYPE_AUDIO, false},
+	}
+	if len(tags) != len(want) {
+		t.Fatalf("got %d tags %v, want %v", len(tags), tags, want)
+	}
+	for i := range want {
+		if tags[i] != want[i] {
+			t.Errorf("tag %d = %v, want %v", i, tags[i], want[i])
+		}
+	}
+}
+
+// 写入文件头失败时停止录像，不再写入后续的标签
+func TestFLVWriteHeaderFailed(t *testing.T) {
+	file, err := os.Create(t.TempDir() + "/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	r := NewFLVRecorder()
+	r.Logger = &log.Logger{Logger: zap.NewNop()}
+	r.File = file
+	r.OnEvent(FileWr(file))
+	if r.err == nil {
+		t.Fatal("write header to closed file not failed")
+	}
+	if err = r.writeCutHead(file, true); err == nil {
+		t.Fatal("write cut head to closed file not failed")
+	}
+}
+
+// 文件头后预留固定大小的onMetaData，关闭时原地写入时长和关键帧位置，不移动媒体数据
+func TestFLVMetaDataInPlace(t *testing.T) {
+	file, err := os.Create(t.TempDir() + "/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r := NewFLVRecorder()
+	r.Logger = &log.Logger{Logger: zap.NewNop()}
+	r.Video = &track.Video{CodecID: codec.CodecID_H264}
+	r.Video.SequenceHead = []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f, 0xff}
+	r.File = file
+	r.OnEvent(FileWr(file))
+	for i := 0; i < 3; i++ {
+		r.OnEvent(VideoFrame{AVFrame: testFrame(true, []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 1, 0x65}), Video: r.Video, AbsTime: uint32(i * 1000)})
+		r.OnEvent(VideoFrame{AVFrame: testFrame(false, []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 1, 0x41}), Video: r.Video, AbsTime: uint32(i*1000 + 500)})
+	}
+	size, _ := file.Seek(0, io.SeekEnd)
+	if size != flvDataOffset+r.Offset {
+		t.Fatalf("file size %d, want %d", size, flvDataOffset+r.Offset)
+	}
+	before, _ := os.ReadFile(file.Name())
+	r.writeMetaData(file, 2500)
+	after, _ := os.ReadFile(file.Name())
+	if len(after) != len(before) || !bytes.Equal(after[flvDataOffset:], before[flvDataOffset:]) {
+		t.Fatal("media data moved")
+	}
+	if after[4] != 1 {
+		t.Errorf("flags %x", after[4])
+	}
+	if _, err = file.Seek(int64(len(codec.FLVHeader)), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	typ, _, payload, err := codec.ReadFLVTag(file)
+	if err != nil || typ != codec.FLV_TAG_TYPE_SCRIPT || len(payload) != flvMetaDataSize {
+		t.Fatalf("metadata tag %d %d %v", typ, len(payload), err)
+	}
+	// AMF0：duration为2.5秒，关键帧位置指向各个关键帧标签
+	number := func(f float64) []byte {
+		return binary.BigEndian.AppendUint64([]byte{0}, math.Float64bits(f))
+	}
+	if !bytes.Contains(payload, append([]byte("\x00\x08duration"), number(2.5)...)) {
+		t.Error("duration not written")
+	}
+	if len(r.filepositions) != 3 {
+		t.Fatalf("%d key frames", len(r.filepositions))
+	}
+	for i, pos := range r.filepositions {
+		offset := int64(pos) + flvDataOffset
+		if !bytes.Contains(payload, number(float64(offset))) {
+			t.Errorf("key frame %d position not written", i)
+		}
+		if after[offset] != codec.FLV_TAG_TYPE_VIDEO || after[offset+11] != 0x17 {
+			t.Errorf("key frame %d at %d is not a video key frame", i, offset)
+		}
+	}
+	// 关键帧过多时抽取，仍然写入预留的大小
+	for i := 0; i < 10000; i++ {
+		r.filepositions = append(r.filepositions, uint64(i*1000))
+		r.times = append(r.times, float64(i))
+	}
+	if data, _ := r.marshalMetaData(3600 * 1000); len(data) != flvMetaDataSize {
+		t.Errorf("metadata with many key frames %d bytes", len(data))
+	}
+}
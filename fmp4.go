@@ -1,8 +1,11 @@
 package record
 
 import (
+	"io"
+
 	"github.com/edgeware/mp4ff/aac"
 	"github.com/edgeware/mp4ff/mp4"
+	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
 	"m7s.live/engine/v4/codec"
 )
@@ -13,14 +16,14 @@ type mediaContext struct {
 	ts       uint32 // 每个小片段起始时间戳
 }
 
-func (m *mediaContext) push(recoder *FMP4Recorder, dt uint32, dur uint32, data []byte, flags uint32) {
+func (m *mediaContext) push(muxer *fmp4Muxer, w io.Writer, dt uint32, dur uint32, data []byte, flags uint32) (err error) {
 	if m.fragment != nil && dt-m.ts > 1000 {
-		m.fragment.Encode(recoder.File)
+		err = m.fragment.Encode(w)
 		m.fragment = nil
 	}
 	if m.fragment == nil {
-		recoder.seqNumber++
-		m.fragment, _ = mp4.CreateFragment(recoder.seqNumber, m.trackId)
+		muxer.seqNumber++
+		m.fragment, _ = mp4.CreateFragment(muxer.seqNumber, m.trackId)
 		m.ts = dt
 	}
 	m.fragment.AddFullSample(mp4.FullSample{
@@ -32,17 +35,136 @@ func (m *mediaContext) push(recoder *FMP4Recorder, dt uint32, dur uint32, data [
 			Size:  uint32(len(data)),
 		},
 	})
+	return
 }
 
-type FMP4Recorder struct {
-	Recorder
-	initSegment *mp4.InitSegment `json:"-" yaml:"-"`
+// 写入还未写入的小片段
+func (m *mediaContext) flush(w io.Writer) (err error) {
+	if m.fragment != nil {
+		err = m.fragment.Encode(w)
+		m.fragment = nil
+	}
+	return
+}
+
+// fmp4封装，fmp4录像和hls的fmp4分片共用
+type fmp4Muxer struct {
+	initSegment *mp4.InitSegment
 	video       mediaContext
 	audio       mediaContext
 	seqNumber   uint32
 	ftyp        *mp4.FtypBox
 }
 
+// 按当前的音视频轨道生成初始化段（ftyp+moov）
+func (m *fmp4Muxer) init(r *Recorder) {
+	m.initSegment = mp4.CreateEmptyInit()
+	m.initSegment.Moov.Mvhd.NextTrackID = 1
+	m.video, m.audio = mediaContext{}, mediaContext{}
+	if r.VideoReader != nil {
+		moov := m.initSegment.Moov
+		trackID := moov.Mvhd.NextTrackID
+		moov.Mvhd.NextTrackID++
+		newTrak := mp4.CreateEmptyTrak(trackID, 1000, "video", "chi")
+		moov.AddChild(newTrak)
+		moov.Mvex.AddChild(mp4.CreateTrex(trackID))
+		m.video.trackId = trackID
+		switch r.Video.CodecID {
+		case codec.CodecID_H264:
+			m.ftyp = mp4.NewFtyp("isom", 0x200, []string{
+				"isom", "iso2", "avc1", "mp41",
+			})
+			newTrak.SetAVCDescriptor("avc1", r.Video.ParamaterSets[0:1], r.Video.ParamaterSets[1:2], true)
+		case codec.CodecID_H265:
+			m.ftyp = mp4.NewFtyp("isom", 0x200, []string{
+				"isom", "iso2", "hvc1", "mp41",
+			})
+			newTrak.SetHEVCDescriptor("hvc1", r.Video.ParamaterSets[0:1], r.Video.ParamaterSets[1:2], r.Video.ParamaterSets[2:3], r.Video.ParamaterSets[3:4], true)
+		}
+	}
+	if r.AudioReader != nil {
+		moov := m.initSegment.Moov
+		trackID := moov.Mvhd.NextTrackID
+		moov.Mvhd.NextTrackID++
+		newTrak := mp4.CreateEmptyTrak(trackID, 1000, "audio", "chi")
+		moov.AddChild(newTrak)
+		moov.Mvex.AddChild(mp4.CreateTrex(trackID))
+		m.audio.trackId = trackID
+		switch r.Audio.CodecID {
+		case codec.CodecID_AAC:
+			switch r.Audio.AudioObjectType {
+			case 1:
+				newTrak.SetAACDescriptor(aac.HEAACv1, int(r.Audio.SampleRate))
+			case 2:
+				newTrak.SetAACDescriptor(aac.AAClc, int(r.Audio.SampleRate))
+			case 3:
+				newTrak.SetAACDescriptor(aac.HEAACv2, int(r.Audio.SampleRate))
+			}
+		case codec.CodecID_PCMA:
+			stsd := newTrak.Mdia.Minf.Stbl.Stsd
+			pcma := mp4.CreateAudioSampleEntryBox("pcma",
+				uint16(r.Audio.Channels),
+				uint16(r.Audio.SampleSize), uint16(r.Audio.SampleRate), nil)
+			stsd.AddChild(pcma)
+		case codec.CodecID_PCMU:
+			stsd := newTrak.Mdia.Minf.Stbl.Stsd
+			pcmu := mp4.CreateAudioSampleEntryBox("pcmu",
+				uint16(r.Audio.Channels),
+				uint16(r.Audio.SampleSize), uint16(r.Audio.SampleRate), nil)
+			stsd.AddChild(pcmu)
+		}
+	}
+	if m.ftyp == nil {
+		m.ftyp = mp4.NewFtyp("isom", 0x200, []string{
+			"isom", "iso2", "avc1", "mp41",
+		})
+	}
+	m.seqNumber = 0
+}
+
+// 写入初始化段
+func (m *fmp4Muxer) writeInit(w io.Writer) error {
+	if err := m.ftyp.Encode(w); err != nil {
+		return err
+	}
+	return m.initSegment.Moov.Encode(w)
+}
+
+// 写入一帧，每个轨道每秒生成一个小片段
+func (m *fmp4Muxer) writeFrame(w io.Writer, event any) error {
+	switch v := event.(type) {
+	case AudioFrame:
+		if m.audio.trackId != 0 {
+			return m.audio.push(m, w, v.AbsTime, v.DeltaTime, v.AUList.ToBytes(), mp4.SyncSampleFlags)
+		}
+	case VideoFrame:
+		if m.video.trackId != 0 {
+			flag := mp4.NonSyncSampleFlags
+			if v.IFrame {
+				flag = mp4.SyncSampleFlags
+			}
+			if data := v.AVCC.ToBytes(); len(data) > 5 {
+				return m.video.push(m, w, v.AbsTime, v.DeltaTime, data[5:], flag)
+			}
+		}
+	}
+	return nil
+}
+
+// 写入各个轨道剩余的小片段
+func (m *fmp4Muxer) flush(w io.Writer) error {
+	err := m.video.flush(w)
+	if e := m.audio.flush(w); err == nil {
+		err = e
+	}
+	return err
+}
+
+type FMP4Recorder struct {
+	Recorder
+	fmp4Muxer
+}
+
 func NewFMP4Recorder() *FMP4Recorder {
 	r := &FMP4Recorder{}
 	r.Record = RecordPluginConfig.Fmp4
@@ -50,105 +172,34 @@ func NewFMP4Recorder() *FMP4Recorder {
 }
 
 func (r *FMP4Recorder) Start(streamPath string) (err error) {
-	r.ID = streamPath + "/fmp4"
 	return r.start(r, streamPath, SUBTYPE_RAW)
 }
 
-func (r *FMP4Recorder) Close() error {
+func (r *FMP4Recorder) Close() (err error) {
 	if r.File != nil {
-		if r.video.fragment != nil {
-			r.video.fragment.Encode(r.File)
-			r.video.fragment = nil
+		if err = r.flush(r.File); err != nil {
+			r.Error("fmp4 flush", zap.Error(err))
 		}
-		if r.audio.fragment != nil {
-			r.audio.fragment.Encode(r.File)
-			r.audio.fragment = nil
+		if e := r.File.Close(); err == nil {
+			err = e
 		}
-		r.File.Close()
+		r.endSegment()
 	}
-	return nil
+	return
 }
 
 func (r *FMP4Recorder) OnEvent(event any) {
+	var err error
 	r.Recorder.OnEvent(event)
 	switch v := event.(type) {
 	case FileWr:
-		r.initSegment = mp4.CreateEmptyInit()
-		r.initSegment.Moov.Mvhd.NextTrackID = 1
-		if r.VideoReader != nil {
-			moov := r.initSegment.Moov
-			trackID := moov.Mvhd.NextTrackID
-			moov.Mvhd.NextTrackID++
-			newTrak := mp4.CreateEmptyTrak(trackID, 1000, "video", "chi")
-			moov.AddChild(newTrak)
-			moov.Mvex.AddChild(mp4.CreateTrex(trackID))
-			r.video.trackId = trackID
-			switch r.Video.CodecID {
-			case codec.CodecID_H264:
-				r.ftyp = mp4.NewFtyp("isom", 0x200, []string{
-					"isom", "iso2", "avc1", "mp41",
-				})
-				newTrak.SetAVCDescriptor("avc1", r.Video.ParamaterSets[0:1], r.Video.ParamaterSets[1:2], true)
-			case codec.CodecID_H265:
-				r.ftyp = mp4.NewFtyp("isom", 0x200, []string{
-					"isom", "iso2", "hvc1", "mp41",
-				})
-				newTrak.SetHEVCDescriptor("hvc1", r.Video.ParamaterSets[0:1], r.Video.ParamaterSets[1:2], r.Video.ParamaterSets[2:3], r.Video.ParamaterSets[3:4], true)
-			}
-		}
-		if r.AudioReader != nil {
-			moov := r.initSegment.Moov
-			trackID := moov.Mvhd.NextTrackID
-			moov.Mvhd.NextTrackID++
-			newTrak := mp4.CreateEmptyTrak(trackID, 1000, "audio", "chi")
-			moov.AddChild(newTrak)
-			moov.Mvex.AddChild(mp4.CreateTrex(trackID))
-			r.audio.trackId = trackID
-			switch r.Audio.CodecID {
-			case codec.CodecID_AAC:
-				switch r.Audio.AudioObjectType {
-				case 1:
-					newTrak.SetAACDescriptor(aac.HEAACv1, int(r.Audio.SampleRate))
-				case 2:
-					newTrak.SetAACDescriptor(aac.AAClc, int(r.Audio.SampleRate))
-				case 3:
-					newTrak.SetAACDescriptor(aac.HEAACv2, int(r.Audio.SampleRate))
-				}
-			case codec.CodecID_PCMA:
-				stsd := newTrak.Mdia.Minf.Stbl.Stsd
-				pcma := mp4.CreateAudioSampleEntryBox("pcma",
-					uint16(r.Audio.Channels),
-					uint16(r.Audio.SampleSize), uint16(r.Audio.SampleRate), nil)
-				stsd.AddChild(pcma)
-			case codec.CodecID_PCMU:
-				stsd := newTrak.Mdia.Minf.Stbl.Stsd
-				pcmu := mp4.CreateAudioSampleEntryBox("pcmu",
-					uint16(r.Audio.Channels),
-					uint16(r.Audio.SampleSize), uint16(r.Audio.SampleRate), nil)
-				stsd.AddChild(pcmu)
-			}
-		}
-		if r.ftyp == nil {
-			r.ftyp = mp4.NewFtyp("isom", 0x200, []string{
-				"isom", "iso2", "avc1", "mp41",
-			})
-		}
-		r.ftyp.Encode(v)
-		r.initSegment.Moov.Encode(v)
-		r.seqNumber = 0
-	case AudioFrame:
-		if r.audio.trackId != 0 {
-			r.audio.push(r, v.AbsTime, v.DeltaTime, v.AUList.ToBytes(), mp4.SyncSampleFlags)
-		}
-	case VideoFrame:
-		if r.video.trackId != 0 {
-			flag := mp4.NonSyncSampleFlags
-			if v.IFrame {
-				flag = mp4.SyncSampleFlags
-			}
-			if data := v.AVCC.ToBytes(); len(data) > 5 {
-				r.video.push(r, v.AbsTime, v.DeltaTime, data[5:], flag)
-			}
-		}
+		r.init(&r.Recorder)
+		err = r.writeInit(v)
+	case AudioFrame, VideoFrame:
+		err = r.writeFrame(r.File, v)
+	}
+	if err != nil {
+		r.Error("fmp4 write", zap.Error(err))
+		r.fail(err)
 	}
 }
@@ -1,11 +1,14 @@
 package record
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math"
 	"os"
+	"path"
 	"path/filepath"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,12 +23,26 @@ import (
 type HLSRecorder struct {
 	streamPath string
 	//playlist           hls.Playlist
-	dayPlayList        *hls.Playlist
+	dayPlayList        *M3u8FileInfo //当前每天的m3u8内容
 	video_cc, audio_cc byte
 	//packet             mpegts.MpegTsPESPacket
 	Recorder
 	MemoryTs `json:"-" yaml:"-"`
 	lastInf  MyInf //记录最后一个Inf
+	span     tsSpan
+
+	discontinuity bool      //下一个分片前写入EXT-X-DISCONTINUITY
+	mediaInfo     string    //上一个分片的编码和分辨率
+	nextTime      time.Time //上一个分片的结束时刻，连续的分片按时长推算开始时刻
+
+	dayPlaylistPath string    //当前每天的m3u8路径
+	playlistPending int       //还未写入每天的m3u8的分片数
+	playlistRewrite bool      //头部变化或写入失败，需要整体替换每天的m3u8
+	playlistSaved   time.Time //最后写入每天的m3u8的时间
+
+	muxer        fmp4Muxer //fmp4分片的封装
+	initFile     string    //当前fmp4分片的初始化段路径
+	initPlaylist string    //初始化段所属的每天的m3u8，每天的m3u8使用各自的初始化段
 
 	// locker sync.RWMutex
 	isStarting bool //开始中
@@ -35,7 +52,67 @@ var hlsLocker sync.RWMutex
 
 type MyInf struct {
 	hls.PlaylistInf
-	Time time.Time //时间
+	Time          time.Time //时间，写入EXT-X-PROGRAM-DATE-TIME
+	Discontinuity bool      //录像重新开始或编码、分辨率变化
+	Map           string    //fmp4分片的初始化段，写入EXT-X-MAP
+}
+
+const hlsInitExt = ".init.mp4" //fmp4分片初始化段的扩展名
+
+// hls是否使用fmp4（CMAF）分片
+func (r *Record) hlsFMP4() bool {
+	return r.typ == "hls" && r.SegmentFormat == "fmp4"
+}
+
+// 是否为hls分片，ts或fmp4
+func isHlsSegment(name string) bool {
+	ext := path.Ext(name)
+	return ext == ".ts" || ext == ".m4s"
+}
+
+// 是否为hls fmp4分片的初始化段
+func isHlsInit(name string) bool {
+	return strings.HasSuffix(name, hlsInitExt)
+}
+
+// 当前ts文件的DTS范围（90kHz），用于计算分片时长，有视频时按视频帧计算
+type tsSpan struct {
+	first, last uint32
+	delta       uint32 //最后一帧的时长
+	frames      int
+	next        uint32 //正在处理、还未写入的帧，在此处切片时为上一个分片的结束
+	pending     bool
+}
+
+func (s *tsSpan) begin(dts uint32) {
+	s.next, s.pending = dts, true
+}
+
+func (s *tsSpan) add(dts uint32) {
+	if s.frames == 0 {
+		s.first = dts
+	} else {
+		s.delta = dts - s.last
+	}
+	s.last = dts
+	s.frames++
+	s.pending = false
+}
+
+func (s *tsSpan) reset() {
+	s.first, s.last, s.delta, s.frames = 0, 0, 0, 0
+}
+
+// 分片时长（秒），切片时到下一个分片的第一帧为止，停止时加上最后一帧的时长
+func (s *tsSpan) duration() float64 {
+	if s.frames == 0 {
+		return 0
+	}
+	end := s.last + s.delta
+	if s.pending {
+		end = s.next
+	}
+	return float64(end-s.first) / 90000
 }
 
 var HlsRecorders sync.Map
@@ -51,41 +128,166 @@ func IsFileExist(path string) bool {
 	}
 	return true
 }
-func (h *HLSRecorder) initDayPlaylist() {
 
-	h.dayPlayList = &hls.Playlist{
-		Writer:         h.Writer,
-		Version:        3,
-		Sequence:       0,
-		Targetduration: int(math.Ceil(h.Fragment.Seconds())),
+// 每天的m3u8路径，{streamPath}/yyyyMMdd.m3u8，带标签的录像为{streamPath}/yyyyMMdd_{label}.m3u8，同一个流的多个录像各自一个
+func (r *Record) dayPlaylistName(streamPath string, t time.Time, label string) string {
+	name := t.In(r.loc()).Format("20060102")
+	if label != "" {
+		name += "_" + label
 	}
-	var err error
+	return path.Join(slashPath(streamPath), name+r.Ext)
+}
 
-	var now = time.Now()
-	filePath := filepath.Join(h.Stream.Path, fmt.Sprintf("%v%v", now.Format("20060102"), h.Ext))
+var ErrHlsPlaylistInUse = errors.New("hls day playlist is used by another recorder, use a different label")
 
-	var isExist = IsFileExist(filepath.Join(h.Path, filePath))
-	var f FileWr
-	f, err = h.CreateFileFn(filePath, h.append) //创建或者打开
-	if err == nil {
+// 每天的m3u8由录像器在内存中维护并整体写入，同一个流同一个标签（包括不带标签）同时只能有一个hls录像
+type hlsPlaylistKey struct {
+	streamPath string
+	label      string
+}
+
+type hlsPlaylistClaim struct {
+	id string //占用的录像器ID
+}
+
+var hlsPlaylists sync.Map //hlsPlaylistKey -> *hlsPlaylistClaim
+
+// 占用流和标签对应的每天的m3u8，已被其他录像器占用时返回错误，录像停止后调用release
+func (h *HLSRecorder) claimDayPlaylist(streamPath string) (release func(), err error) {
+	key, claim := hlsPlaylistKey{streamPath, h.Label}, &hlsPlaylistClaim{h.ID}
+	if value, loaded := hlsPlaylists.LoadOrStore(key, claim); loaded {
+		if owner := value.(*hlsPlaylistClaim).id; owner != h.ID {
+			return nil, fmt.Errorf("%w: %s", ErrHlsPlaylistInUse, owner)
+		}
+		return nil, ErrRecordExist
+	}
+	return func() {
+		hlsPlaylists.CompareAndDelete(key, claim)
+	}, nil
+}
+
+// 对象存储不能追加，每次写入都要上传整个m3u8，按此间隔合并写入
+const hlsPlaylistFlushInterval = time.Minute
+
+// 打开当天的m3u8，内容保存在内存中，写完分片后追加或整体替换文件
+func (h *HLSRecorder) initDayPlaylist() {
+	if h.dayPlayList != nil {
+		// 换天前写入前一天剩余的分片
+		h.flushDayPlaylist(true)
+	}
+	h.playlistPending, h.playlistRewrite = 0, false
+	filePath := h.dayPlaylistName(h.Stream.Path, time.Now(), h.Label)
+	h.fileLock.Lock()
+	h.dayPlaylistPath = filePath
+	h.fileLock.Unlock()
+	target := int(math.Ceil(h.Fragment.Seconds()))
+	if _, err := h.storage.Stat(filePath); err == nil {
+		m3u8, err := ReadM3u8Info(h.storage, filePath)
+		if err == nil {
+			h.dayPlayList = m3u8
+			// 沿用已有m3u8中更大的EXT-X-TARGETDURATION
+			if m3u8.TargetDuration() < target {
+				m3u8.SetTargetDuration(target)
+				h.playlistRewrite = true
+			}
+			h.Info("open file", zap.String("path", filePath))
+			return
+		}
+		h.Error("open file", zap.String("path", filePath), zap.Error(err))
+	}
+	h.dayPlayList = &M3u8FileInfo{
+		Head: playlistHead(target, h.hlsFMP4()),
+		Path: filePath,
+	}
+	if err := h.saveDayPlaylist(); err == nil {
 		h.Info("create file", zap.String("path", filePath))
-	} else {
-		h.Error("create file", zap.String("path", filePath), zap.Error(err))
 	}
+}
+
+// 整体替换每天的m3u8，读取方不会读到写了一半的内容
+func (h *HLSRecorder) saveDayPlaylist() (err error) {
+	if err = writeFileAtomic(h.storage, h.dayPlaylistPath, []byte(h.dayPlayList.ToPlaylistContent())); err != nil {
+		h.Error("write file", zap.String("path", h.dayPlaylistPath), zap.Error(err))
+	}
+	h.playlistSaved = time.Now()
+	return
+}
 
-	h.dayPlayList.Writer = f
-	h.Writer = h.dayPlayList.Writer
-	h.SetIO(h.Writer)
+// 把新的分片写入每天的m3u8。本地存储只追加新分片的几行，头部变化（EXT-X-TARGETDURATION、EXT-X-VERSION）或之前写入失败时整体替换；
+// 对象存储按hlsPlaylistFlushInterval合并写入，force为true时（录像停止、换天）立即写入
+func (h *HLSRecorder) flushDayPlaylist(force bool) (err error) {
+	_, local := h.storage.(*LocalStorage)
+	switch {
+	case h.playlistPending == 0 && !h.playlistRewrite:
+		return
+	case !local && !force && time.Since(h.playlistSaved) < hlsPlaylistFlushInterval:
+		return
+	case local && !h.playlistRewrite:
+		err = h.appendDayPlaylist()
+	default:
+		err = h.saveDayPlaylist()
+	}
 	if err != nil {
-		h.Sugar().Errorf("创建每天的m3u8出错:%v", err.Error)
+		// 追加失败时文件末尾可能有写了一半的内容，下次整体替换
+		h.playlistRewrite = true
+		return
 	}
+	h.playlistPending, h.playlistRewrite = 0, false
+	return
+}
 
-	if !isExist {
-		if err = h.dayPlayList.Init(); err != nil {
-			h.Sugar().Errorf("初始化每天的m3u8出错:%v", err.Error)
+// 在每天的m3u8末尾追加还未写入的分片，一次写入
+func (h *HLSRecorder) appendDayPlaylist() (err error) {
+	var f FileWr
+	if f, err = h.storage.CreateFile(h.dayPlaylistPath, true); err == nil {
+		if _, err = f.Write([]byte(h.dayPlayList.tailContent(h.playlistPending))); err != nil {
+			f.Close()
+		} else {
+			err = f.Close()
 		}
 	}
+	if err != nil {
+		h.Error("append file", zap.String("path", h.dayPlaylistPath), zap.Error(err))
+	}
+	h.playlistSaved = time.Now()
+	return
+}
+
+// 编码和分辨率，变化时写入EXT-X-DISCONTINUITY
+func (h *HLSRecorder) currentMediaInfo() string {
+	var info string
+	if h.Video != nil {
+		info = fmt.Sprintf("%v %dx%d", h.Video.CodecID, h.Video.SPSInfo.Width, h.Video.SPSInfo.Height)
+	}
+	if h.Audio != nil {
+		info += fmt.Sprintf(" %v %d %d", h.Audio.CodecID, h.Audio.SampleRate, h.Audio.Channels)
+	}
+	return info
+}
 
+// 写入一个分片到每天的m3u8，前面有分片时才写入EXT-X-DISCONTINUITY
+func (h *HLSRecorder) writeInf(inf MyInf) error {
+	m3u8 := h.dayPlayList
+	head := m3u8.Head
+	// 分片时长超过EXT-X-TARGETDURATION时按实际的最大值改写
+	if target := int(math.Round(inf.Duration)); target > m3u8.TargetDuration() {
+		m3u8.SetTargetDuration(target)
+	}
+	m3u8.TsFiles = append(m3u8.TsFiles, &TsInfo{
+		EXTINF:          fmt.Sprintf("#EXTINF:%.3f,", inf.Duration),
+		FileName:        slashPath(inf.Title),
+		Time:            inf.Time,
+		Len:             inf.Duration,
+		ProgramDateTime: inf.Time.In(h.loc()),
+		Discontinuity:   inf.Discontinuity && len(m3u8.TsFiles) > 0,
+		Map:             inf.Map,
+	})
+	m3u8.upgradeVersion()
+	h.playlistPending++
+	if m3u8.Head != head {
+		h.playlistRewrite = true
+	}
+	return h.flushDayPlaylist(false)
 }
 
 func GetHLSRecorder(streamPath string) (r *HLSRecorder) {
@@ -135,14 +337,15 @@ func (h *HLSRecorder) Start(streamPath string) error {
 	// defer func() {
 	// 	h.isStarting = false
 	// }()
-	if IsStarting(streamPath) {
+	// 接口开始的录像有各自的ID，同一个流可以同时有多个hls录像
+	if h.ID == "" {
+		h.ID = recorderID(streamPath, h.typ)
+	}
+	if IsStarting(h.ID) {
 		return nil
 	}
-	mapRecordStarting.Store(streamPath, true)
-	defer mapRecordStarting.Store(streamPath, false)
-
-	//plugin.Logger.Debug("hls record start begin", zap.Any("path", streamPath))
-	h.ID = streamPath + "/hls"
+	mapRecordStarting.Store(h.ID, true)
+	defer mapRecordStarting.Store(h.ID, false)
 
 	//清空m3u8info
 
@@ -152,21 +355,35 @@ func (h *HLSRecorder) Start(streamPath string) error {
 		//目录变更，新建新的m3u8文件
 		h.initDayPlaylist()
 	}
-	var err = h.start(h, streamPath, SUBTYPE_RAW)
+	release, err := h.claimDayPlaylist(streamPath)
+	if err != nil {
+		return err
+	}
+	if err = h.start(h, streamPath, SUBTYPE_RAW); err != nil {
+		release()
+		return err
+	}
+	// 写完最后一个分片后释放每天的m3u8
+	go func(stopped chan struct{}) {
+		<-stopped
+		release()
+	}(h.stopped)
 	//plugin.Logger.Debug("hls record start end", zap.Any("path", streamPath))
-	return err
+	return nil
 }
 
 func (h *HLSRecorder) OnEvent(event any) {
 	var err error
 	defer func() {
 		if err != nil {
-			h.Stop(zap.Error(err))
+			h.fail(err)
 		}
 	}()
 	switch v := event.(type) {
 	case *HLSRecorder:
 		h.BytesPool = make(util.BytesPool, 17)
+		//重新开始录像，与之前的分片不连续
+		h.discontinuity = true
 		// if h.Writer, err = h.createFile(); err != nil {
 		// 	return
 		// }
@@ -186,80 +403,168 @@ func (h *HLSRecorder) OnEvent(event any) {
 		if h.dayPlayList == nil {
 			h.initDayPlaylist()
 		}
+		h.flushPreRecord()
 	case AudioFrame:
+		main := h.VideoReader == nil
+		if main {
+			h.span.begin(v.DTS)
+		}
 		h.Recorder.OnEvent(event)
-		pes := &mpegts.MpegtsPESFrame{
-			Pid:                       mpegts.PID_AUDIO,
-			IsKeyFrame:                false,
-			ContinuityCounter:         h.audio_cc,
-			ProgramClockReferenceBase: uint64(v.DTS),
+		if h.hlsFMP4() {
+			err = h.muxer.writeFrame(h.File, v)
+		} else {
+			pes := &mpegts.MpegtsPESFrame{
+				Pid:                       mpegts.PID_AUDIO,
+				IsKeyFrame:                false,
+				ContinuityCounter:         h.audio_cc,
+				ProgramClockReferenceBase: uint64(v.DTS),
+			}
+			if err = h.WriteAudioFrame(v, pes); err == nil {
+				err = h.writePES()
+			}
+			h.audio_cc = pes.ContinuityCounter
+		}
+		if err != nil {
+			h.Error("hls write audio", zap.Error(err))
+			return
+		}
+		if main {
+			h.span.add(v.DTS)
 		}
-		h.WriteAudioFrame(v, pes)
-		h.BLL.WriteTo(h.File)
-		h.Recycle()
-		h.Clear()
-		h.audio_cc = pes.ContinuityCounter
 	case VideoFrame:
+		h.span.begin(v.DTS)
+		if v.IFrame && h.mediaInfo != "" && h.mediaInfo != h.currentMediaInfo() {
+			// 编码或分辨率变化，从这个关键帧开始新的分片
+			h.Info("media info changed", zap.String("from", h.mediaInfo), zap.String("to", h.currentMediaInfo()))
+			h.rotate(v.AbsTime, true)
+		}
 		h.Recorder.OnEvent(event)
-		pes := &mpegts.MpegtsPESFrame{
-			Pid:                       mpegts.PID_VIDEO,
-			IsKeyFrame:                v.IFrame,
-			ContinuityCounter:         h.video_cc,
-			ProgramClockReferenceBase: uint64(v.DTS),
+		if h.hlsFMP4() {
+			err = h.muxer.writeFrame(h.File, v)
+		} else {
+			pes := &mpegts.MpegtsPESFrame{
+				Pid:                       mpegts.PID_VIDEO,
+				IsKeyFrame:                v.IFrame,
+				ContinuityCounter:         h.video_cc,
+				ProgramClockReferenceBase: uint64(v.DTS),
+			}
+			if err = h.WriteVideoFrame(v, pes); err == nil {
+				err = h.writePES()
+			}
+			h.video_cc = pes.ContinuityCounter
 		}
-		if err = h.WriteVideoFrame(v, pes); err != nil {
+		if err != nil {
+			h.Error("hls write video", zap.Error(err))
 			return
 		}
-		h.BLL.WriteTo(h.File)
-		h.Recycle()
-		h.Clear()
-		h.video_cc = pes.ContinuityCounter
+		h.span.add(v.DTS)
 	default:
 		h.Recorder.OnEvent(v)
 	}
 }
 
-// 创建一个新的ts文件
+// 关闭分片文件，把最后一个分片写入每天的m3u8，录像停止时写入所有还未写入的分片
+func (h *HLSRecorder) Close() (err error) {
+	if h.IsClosed() && h.dayPlayList != nil {
+		defer func() {
+			if e := h.flushDayPlaylist(true); err == nil {
+				err = e
+			}
+		}()
+	}
+	if h.File == nil {
+		return
+	}
+	if h.hlsFMP4() {
+		if err = h.muxer.flush(h.File); err != nil {
+			h.Error("hls flush", zap.Error(err))
+		}
+	}
+	if e := h.Recorder.Close(); err == nil {
+		err = e
+	}
+	if !h.lastInf.Time.IsZero() && h.dayPlayList != nil {
+		// 按帧的时间戳计算时长，没有帧时才用创建时间
+		if h.lastInf.Duration = h.span.duration(); h.lastInf.Duration <= 0 {
+			h.lastInf.Duration = time.Since(h.lastInf.Time).Seconds()
+		}
+		if e := h.writeInf(h.lastInf); e != nil && err == nil {
+			err = e
+		}
+		h.nextTime = h.lastInf.Time.Add(time.Duration(h.lastInf.Duration * float64(time.Second)))
+	}
+	h.lastInf = MyInf{}
+	return
+}
+
+// 创建一个新的分片文件，ts或fmp4
 func (h *HLSRecorder) CreateFile() (fw FileWr, err error) {
 	var curTsTime = time.Now()
 
-	var redordDir = h.getLastDir(h.Stream.Path)
-
-	tsFilename := strconv.FormatInt(curTsTime.Unix(), 10) + ".ts"
-	filePath := filepath.Join(redordDir, tsFilename)
-	tsFilename, err = filepath.Rel(h.Stream.Path, filePath)
-	if err != nil {
-		return fw, err
+	h.getLastDir(h.Stream.Path) //日期变更时新建每天的m3u8
+	h.seq++
+	ext := ".ts"
+	if h.hlsFMP4() {
+		ext = ".m4s"
+	}
+	filePath := h.uniqueFilePath(h.pathTemplate().render(&h.Recorder, h.Stream.Path, curTsTime) + ext)
+	tsFilename, err := filepath.Rel(h.Stream.Path, filePath)
+	if err == nil {
+		fw, err = h.CreateFileFn(filePath, false)
 	}
-	fw, err = h.CreateFileFn(filePath, false)
 	if err != nil {
+		h.releaseFilePath(filePath)
 		h.Error("create file", zap.String("path", filePath), zap.Error(err))
 		return
 	}
 	h.FileName = filePath
 	h.Trace("create file", zap.String("path", filePath))
-
-	var duration = h.Fragment.Seconds()
-	if !h.lastInf.Time.IsZero() {
-		duration = float64(curTsTime.Sub(h.lastInf.Time).Seconds())
-		h.lastInf.Duration = duration //修正时长
-
-		//写入上一次Inf
-		// if err = h.playlist.WriteInf(h.lastInf.PlaylistInf); err != nil {
-		// 	return
-		// }
-		if err = h.dayPlayList.WriteInf(h.lastInf.PlaylistInf); err != nil {
-			return
+	h.beginSegment(filePath)
+	defer func() {
+		if err != nil {
+			// 初始化段或分片头写入失败，关闭并删除这个分片，不写入m3u8和录像目录
+			h.Error("create file", zap.String("path", filePath), zap.Error(err))
+			fw.Close()
+			fw = nil
+			h.takeSegment()
+			h.storage.Remove(filePath)
+			h.lastInf = MyInf{}
 		}
-	}
+	}()
 
+	// 文件名的时间只作为分片开始时刻，时长在关闭时按帧的时间戳计算
+	h.span.reset()
 	h.lastInf = MyInf{
 		PlaylistInf: hls.PlaylistInf{
-			Duration: duration,
+			Duration: h.Fragment.Seconds(),
 			Title:    tsFilename},
-		Time: curTsTime,
+		Time:          curTsTime,
+		Discontinuity: h.discontinuity,
+	}
+	if mediaInfo := h.currentMediaInfo(); h.mediaInfo != "" && h.mediaInfo != mediaInfo {
+		h.lastInf.Discontinuity = true
+	} else if !h.discontinuity && !h.nextTime.IsZero() && (curTsTime.Sub(h.nextTime)).Abs() < time.Second {
+		// 连续的分片接着上一个分片的结束时刻，避免创建文件的延迟造成时间抖动
+		h.lastInf.Time = h.nextTime
+	}
+	h.mediaInfo = h.currentMediaInfo()
+	h.discontinuity = false
+	// 录像目录中记录与m3u8一致的开始时刻和不连续标记，点播时生成相同的标签
+	h.segment.StartTime = h.lastInf.Time
+	h.segment.Discontinuity = h.lastInf.Discontinuity
+
+	if h.hlsFMP4() {
+		// 重新开始录像、编码变化或者换了每天的m3u8时写入新的初始化段
+		if h.initFile == "" || h.lastInf.Discontinuity || h.initPlaylist != h.dayPlaylistPath {
+			if err = h.writeInit(strings.TrimSuffix(filePath, ext) + hlsInitExt); err != nil {
+				return
+			}
+		}
+		h.segment.InitPath = h.initFile
+		initName, _ := filepath.Rel(h.Stream.Path, h.initFile)
+		h.lastInf.Map = slashPath(initName)
+		return
 	}
-
 	if err = mpegts.WriteDefaultPATPacket(fw); err != nil {
 		return
 	}
@@ -274,3 +579,26 @@ func (h *HLSRecorder) CreateFile() (fw FileWr, err error) {
 	mpegts.WritePMTPacket(fw, vcodec, acodec)
 	return
 }
+
+// 把打包好的PES写入分片文件，写完后回收内存
+func (h *HLSRecorder) writePES() (err error) {
+	_, err = h.BLL.WriteTo(h.File)
+	h.Recycle()
+	h.Clear()
+	return
+}
+
+// 按当前的音视频轨道写入fmp4分片的初始化段
+func (h *HLSRecorder) writeInit(initFile string) (err error) {
+	var buf bytes.Buffer
+	h.muxer.init(&h.Recorder)
+	if err = h.muxer.writeInit(&buf); err != nil {
+		return
+	}
+	if err = writeFile(h.storage, slashPath(initFile), buf.Bytes()); err != nil {
+		h.Error("create file", zap.String("path", initFile), zap.Error(err))
+		return
+	}
+	h.initFile, h.initPlaylist = slashPath(initFile), h.dayPlaylistPath
+	return
+}
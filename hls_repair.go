@@ -0,0 +1,601 @@
+package record
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/edgeware/mp4ff/mp4"
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/codec/mpegts"
+)
+
+const (
+	tsPacketSize = 188
+	tsProbeSize  = 1024 * 1024 //探测ts时从文件头和文件尾各读取的最大字节数
+	tsTimeMask   = 1<<33 - 1   //PES中的时间戳为33位
+)
+
+// ts文件的探测结果，时间戳为90kHz，有视频时按视频帧计算
+type tsProbe struct {
+	VideoCodec string
+	AudioCodec string
+	FirstDTS   uint64
+	LastDTS    uint64
+	Delta      uint64 //最后一帧的时长，按最后两帧的间隔估算
+}
+
+// 分片时长（秒），包括最后一帧的时长
+func (p *tsProbe) Duration() float64 {
+	return float64((p.LastDTS-p.FirstDTS)&tsTimeMask+p.Delta) / 90000
+}
+
+// 是否接着上一个分片的最后一帧，编码相同且时间戳相差不超过1秒
+func (p *tsProbe) continues(prev *tsProbe) bool {
+	if prev == nil || prev.VideoCodec != p.VideoCodec || prev.AudioCodec != p.AudioCodec {
+		return false
+	}
+	gap := int64((p.FirstDTS - prev.LastDTS - prev.Delta) & tsTimeMask)
+	if gap > tsTimeMask/2 {
+		gap -= tsTimeMask + 1
+	}
+	return gap >= -90000 && gap <= 90000
+}
+
+// 解析ts包时的状态
+type tsDemuxer struct {
+	pmtPID  int
+	streams map[int]byte //pid -> stream_type
+	mainPID int          //计算时长使用的pid，有视频时为视频
+	dts     []uint64     //mainPID的PES时间戳
+}
+
+// 解析一个ts包，遇到mainPID的PES头时记录时间戳
+func (d *tsDemuxer) packet(pkt []byte) {
+	pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+	if pkt[1]&0x40 == 0 {
+		return //只需要各个表和PES的开头
+	}
+	payload := pkt[4:]
+	if afc := pkt[3] >> 4 & 3; afc&1 == 0 {
+		return
+	} else if afc&2 != 0 {
+		if int(pkt[4])+1 >= len(payload) {
+			return
+		}
+		payload = payload[pkt[4]+1:]
+	}
+	switch {
+	case pid == 0:
+		if table := tsSection(payload); table != nil {
+			for i := 8; i+4 <= len(table)-4; i += 4 {
+				if program := int(table[i])<<8 | int(table[i+1]); program != 0 {
+					d.pmtPID = int(table[i+2]&0x1f)<<8 | int(table[i+3])
+				}
+			}
+		}
+	case pid == d.pmtPID:
+		if table := tsSection(payload); table != nil && len(table) >= 12 {
+			i := 12 + (int(table[10]&0x0f)<<8 | int(table[11]))
+			for i+5 <= len(table)-4 {
+				streamPID := int(table[i+1]&0x1f)<<8 | int(table[i+2])
+				d.streams[streamPID] = table[i]
+				if videoCodecName(tsVideoCodec(table[i])) != "" || d.mainPID == 0 {
+					d.mainPID = streamPID
+				}
+				i += 5 + (int(table[i+3]&0x0f)<<8 | int(table[i+4]))
+			}
+		}
+	case pid == d.mainPID:
+		if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+			return
+		}
+		switch payload[7] >> 6 {
+		case 2:
+			d.dts = append(d.dts, tsTimestamp(payload[9:14]))
+		case 3:
+			if len(payload) >= 19 {
+				d.dts = append(d.dts, tsTimestamp(payload[14:19]))
+			}
+		}
+	}
+}
+
+// PSI表的内容，从table_id开始到CRC为止
+func tsSection(payload []byte) []byte {
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil
+	}
+	table := payload[payload[0]+1:]
+	if len(table) < 3 {
+		return nil
+	}
+	end := 3 + (int(table[1]&0x0f)<<8 | int(table[2]))
+	if end > len(table) || end < 12 {
+		return nil
+	}
+	return table[:end]
+}
+
+func tsTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+func tsVideoCodec(streamType byte) codec.VideoCodecID {
+	switch streamType {
+	case mpegts.STREAM_TYPE_H264:
+		return codec.CodecID_H264
+	case mpegts.STREAM_TYPE_H265:
+		return codec.CodecID_H265
+	}
+	return 0
+}
+
+func tsAudioCodec(streamType byte) codec.AudioCodecID {
+	switch streamType {
+	case mpegts.STREAM_TYPE_AAC:
+		return codec.CodecID_AAC
+	case mpegts.STREAM_TYPE_G711A:
+		return codec.CodecID_PCMA
+	case mpegts.STREAM_TYPE_G711U:
+		return codec.CodecID_PCMU
+	}
+	return 0
+}
+
+// 读取ts包直到limit字节或文件末尾，崩溃时最后一个包可能不完整
+func (d *tsDemuxer) read(r io.Reader, limit int64) {
+	reader := bufio.NewReader(io.LimitReader(r, limit))
+	pkt := make([]byte, tsPacketSize)
+	for {
+		if _, err := io.ReadFull(reader, pkt); err != nil {
+			return
+		}
+		if pkt[0] == 0x47 {
+			d.packet(pkt)
+		}
+	}
+}
+
+// 探测ts文件的编码和首尾帧的时间戳，只读取文件头和文件尾
+func probeTS(file io.ReadSeeker, size int64) (probe *tsProbe, err error) {
+	d := &tsDemuxer{pmtPID: -1, streams: make(map[int]byte)}
+	d.read(file, tsProbeSize)
+	if d.mainPID == 0 || len(d.dts) == 0 {
+		return nil, errors.New("no pes found in ts")
+	}
+	probe = &tsProbe{FirstDTS: d.dts[0]}
+	for _, streamType := range d.streams {
+		if name := videoCodecName(tsVideoCodec(streamType)); name != "" {
+			probe.VideoCodec = name
+		} else if name := audioCodecName(tsAudioCodec(streamType)); name != "" {
+			probe.AudioCodec = name
+		}
+	}
+	if size > tsProbeSize {
+		// ts文件按包写入，文件尾从包边界开始读
+		offset := (size - tsProbeSize) / tsPacketSize * tsPacketSize
+		if _, err = file.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		d.dts = d.dts[:0]
+		d.read(file, tsProbeSize)
+	}
+	if n := len(d.dts); n > 0 {
+		probe.LastDTS = d.dts[n-1]
+		if n > 1 {
+			probe.Delta = (d.dts[n-1] - d.dts[n-2]) & tsTimeMask
+		}
+	} else {
+		probe.LastDTS = probe.FirstDTS
+	}
+	return probe, nil
+}
+
+// fmp4轨道的编码名称，按初始化段中的sample entry判断
+func fmp4CodecName(stsd *mp4.StsdBox) string {
+	switch {
+	case stsd.AvcX != nil:
+		return videoCodecName(codec.CodecID_H264)
+	case stsd.HvcX != nil:
+		return videoCodecName(codec.CodecID_H265)
+	case stsd.Mp4a != nil:
+		return audioCodecName(codec.CodecID_AAC)
+	}
+	for _, box := range stsd.Children {
+		switch box.Type() {
+		case "pcma":
+			return audioCodecName(codec.CodecID_PCMA)
+		case "pcmu":
+			return audioCodecName(codec.CodecID_PCMU)
+		}
+	}
+	return ""
+}
+
+// 探测fmp4分片的编码和首尾帧的时间戳，编码和时间刻度从初始化段读取，时间戳换算为90kHz。
+// 崩溃时分片末尾的小片段可能不完整，只使用完整的moof+mdat
+func probeFMP4(init, segment io.Reader) (probe *tsProbe, err error) {
+	initFile, err := mp4.DecodeFile(init)
+	if err != nil {
+		return nil, err
+	}
+	if initFile.Init == nil || initFile.Init.Moov.Mvex == nil {
+		return nil, errors.New("no fragmented moov in init segment")
+	}
+	probe = &tsProbe{}
+	var mainTrak *mp4.TrakBox //计算时长使用的轨道，有视频时为视频
+	for _, trak := range initFile.Init.Moov.Traks {
+		name := fmp4CodecName(trak.Mdia.Minf.Stbl.Stsd)
+		switch trak.Mdia.Hdlr.HandlerType {
+		case "vide":
+			probe.VideoCodec, mainTrak = name, trak
+		case "soun":
+			probe.AudioCodec = name
+			if mainTrak == nil {
+				mainTrak = trak
+			}
+		}
+	}
+	if mainTrak == nil {
+		return nil, errors.New("no track in init segment")
+	}
+	trackID, timescale := mainTrak.Tkhd.TrackID, uint64(mainTrak.Mdia.Mdhd.Timescale)
+	if timescale == 0 {
+		timescale = 1000
+	}
+	var trex *mp4.TrexBox
+	for _, box := range initFile.Init.Moov.Mvex.Trexs {
+		if box.TrackID == trackID {
+			trex = box
+		}
+	}
+	var first, last, delta uint64 //主轨道第一帧和最后一帧的时间戳、最后一帧的时长
+	var samples int
+	var pos uint64
+	var moof *mp4.MoofBox
+	reader := bufio.NewReader(segment)
+	for {
+		box, err := mp4.DecodeBox(pos, reader)
+		if err != nil {
+			break
+		}
+		pos += box.Size()
+		switch box.Type() {
+		case "moof":
+			moof = box.(*mp4.MoofBox)
+		case "mdat":
+			if moof == nil {
+				continue
+			}
+			for _, traf := range moof.Trafs {
+				if traf.Tfhd.TrackID != trackID || traf.Tfdt == nil {
+					continue
+				}
+				decodeTime := traf.Tfdt.BaseMediaDecodeTime()
+				for _, trun := range traf.Truns {
+					trun.AddSampleDefaultValues(traf.Tfhd, trex)
+					for _, sample := range trun.Samples {
+						if samples == 0 {
+							first = decodeTime
+						}
+						samples++
+						last, delta = decodeTime, uint64(sample.Dur)
+						decodeTime += delta
+					}
+				}
+			}
+			moof = nil
+		}
+	}
+	if samples == 0 {
+		return nil, errors.New("no sample found in fmp4 segment")
+	}
+	probe.FirstDTS = first * 90000 / timescale & tsTimeMask
+	probe.LastDTS = last * 90000 / timescale & tsTimeMask
+	probe.Delta = delta * 90000 / timescale
+	return probe, nil
+}
+
+// hls每天的m3u8修复结果
+type HLSRepairResult struct {
+	Path     string //m3u8路径
+	Segments int    //修复后的分片数
+	Added    int    //补入的分片数
+	Removed  int    //去掉的已不存在的分片数
+	Rebuilt  bool   //是否按ts文件重新生成（指定重建或原m3u8已损坏）
+}
+
+// 磁盘上的一个ts分片
+type hlsRepairSegment struct {
+	path     string
+	info     fs.FileInfo
+	start    time.Time
+	probe    *tsProbe
+	ts       *TsInfo //在m3u8中的条目
+	playlist string  //所在的m3u8
+	init     string  //fmp4分片的初始化段
+}
+
+// 每天的m3u8文件名（不含扩展名），yyyyMMdd或yyyyMMdd_标签
+var dayPlaylistReg = regexp.MustCompile(`^\d{8}(?:_([\p{L}\p{N}_-]+))?$`)
+
+// 根据磁盘上的ts分片修复或重建每天的m3u8，补入m3u8中缺少的分片（如异常退出时最后一个分片），去掉已不存在的分片，
+// 同时把补入的分片写入录像目录。rebuild为true时不使用原有m3u8的内容，按ts文件重新生成；streamPath为空时修复全部流。
+// 正在录制的m3u8不修改
+func (r *Record) RepairHlsPlaylists(streamPath string, rebuild bool) (results []*HLSRepairResult, err error) {
+	if r.typ != "hls" {
+		return nil, errors.New("only hls playlists can be repaired")
+	}
+	streams := make(map[string]map[string]*hlsRepairSegment) //流路径 -> ts路径 -> 分片
+	playlists := make(map[string][]string)                   //流路径 -> 每天的m3u8
+	inits := make(map[string][]string)                       //目录 -> fmp4初始化段
+	err = r.walk(streamPath, func(name string, info fs.FileInfo) {
+		if path.Base(path.Dir(name)) == "vod" {
+			return
+		}
+		switch path.Ext(name) {
+		case ".ts", ".m4s":
+			sp := r.streamPathOf(name)
+			if streamPath != "" && sp != streamPath || isRecordingFile(name) {
+				return
+			}
+			seg := &hlsRepairSegment{path: name, info: info}
+			if _, start, ok := r.parsePath(name); ok {
+				seg.start = start
+			}
+			if streams[sp] == nil {
+				streams[sp] = make(map[string]*hlsRepairSegment)
+			}
+			streams[sp][name] = seg
+		case ".mp4":
+			if isHlsInit(name) {
+				inits[path.Dir(name)] = append(inits[path.Dir(name)], name)
+			}
+		case r.Ext:
+			if dayPlaylistReg.MatchString(strings.TrimSuffix(path.Base(name), r.Ext)) {
+				playlists[path.Dir(name)] = append(playlists[path.Dir(name)], name)
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+	for _, segs := range streams {
+		for _, seg := range segs {
+			if path.Ext(seg.path) == ".m4s" {
+				seg.init = r.findHlsInit(seg.path, inits[path.Dir(seg.path)])
+			}
+		}
+	}
+	for sp := range playlists {
+		if streams[sp] == nil && (streamPath == "" || sp == streamPath) {
+			streams[sp] = make(map[string]*hlsRepairSegment)
+		}
+	}
+	for sp, segs := range streams {
+		results = append(results, r.repairStreamPlaylists(sp, segs, playlists[sp], rebuild)...)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Path < results[j].Path
+	})
+	return
+}
+
+func (r *Record) repairStreamPlaylists(streamPath string, segs map[string]*hlsRepairSegment, names []string, rebuild bool) (results []*HLSRepairResult) {
+	m3u8s := make(map[string]*M3u8FileInfo)
+	rebuilt := make(map[string]bool)
+	for _, name := range names {
+		recording := isRecordingFile(name)
+		data, err := readFile(r.storage, name)
+		if err != nil {
+			continue
+		}
+		if !strings.HasPrefix(string(data), "#EXTM3U") {
+			plugin.Logger.Warn("hls playlist corrupted", zap.String("path", name))
+			rebuilt[name] = true
+			continue
+		}
+		m3u8 := ParseM3u8Info(data)
+		for _, ts := range m3u8.TsFiles {
+			if seg, ok := segs[path.Join(path.Dir(name), ts.FileName)]; ok {
+				if recording {
+					// 正在录制的m3u8中的分片不再加入其他m3u8
+					delete(segs, seg.path)
+				} else if seg.ts == nil {
+					if ts.Map != "" {
+						seg.init = path.Join(path.Dir(name), ts.Map)
+					}
+					if !rebuild {
+						seg.ts, seg.playlist = ts, name
+					}
+				}
+			}
+		}
+		if !recording {
+			m3u8.Path = name
+			m3u8s[name] = m3u8
+			rebuilt[name] = rebuilt[name] || rebuild
+		}
+	}
+	// 按分片开始时间分到每天的m3u8
+	entries := make(map[string][]*hlsRepairSegment)
+	for _, seg := range segs {
+		if seg.ts == nil {
+			if r.probeSegment(seg) != nil {
+				continue
+			}
+			if seg.start.IsZero() {
+				seg.start = seg.info.ModTime().Add(-time.Duration(seg.probe.Duration() * float64(time.Second)))
+			}
+			seg.playlist = r.dayPlaylistName(streamPath, seg.start, r.parseLabel(seg.path))
+			if isRecordingFile(seg.playlist) {
+				continue
+			}
+		} else if seg.start.IsZero() || !seg.ts.ProgramDateTime.IsZero() {
+			seg.start = seg.ts.Time
+		}
+		entries[seg.playlist] = append(entries[seg.playlist], seg)
+	}
+	for name := range m3u8s {
+		if _, ok := entries[name]; !ok {
+			entries[name] = nil
+		}
+	}
+	for name, list := range entries {
+		result := &HLSRepairResult{Path: name, Rebuilt: rebuilt[name]}
+		m3u8 := m3u8s[name]
+		if m3u8 == nil || result.Rebuilt {
+			m3u8 = &M3u8FileInfo{Head: playlistHead(int(math.Ceil(r.Fragment.Seconds())), false), Path: name}
+		}
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].start.Before(list[j].start)
+		})
+		original := len(m3u8.TsFiles)
+		m3u8.TsFiles = nil
+		var prev *hlsRepairSegment
+		var added []*hlsRepairSegment
+		for _, seg := range list {
+			if seg.ts == nil {
+				// 上一个分片是原有的条目时也需要探测，判断是否连续
+				if prev != nil && prev.probe == nil {
+					r.probeSegment(prev)
+				}
+				seg.ts = r.repairTsInfo(name, seg, prev, len(m3u8.TsFiles) > 0)
+				added = append(added, seg)
+			}
+			m3u8.TsFiles = append(m3u8.TsFiles, seg.ts)
+			prev = seg
+		}
+		result.Segments = len(m3u8.TsFiles)
+		result.Added = len(added)
+		if !result.Rebuilt {
+			result.Removed = original - (result.Segments - result.Added)
+		}
+		if result.Added == 0 && result.Removed == 0 && !result.Rebuilt {
+			continue
+		}
+		results = append(results, result)
+		if result.Segments == 0 {
+			r.removeSidecar(name)
+			continue
+		}
+		if target := maxTargetDuration(m3u8.TsFiles); target > m3u8.TargetDuration() {
+			m3u8.SetTargetDuration(target)
+		}
+		m3u8.upgradeVersion()
+		if err := writeFileAtomic(r.storage, name, []byte(m3u8.ToPlaylistContent())); err != nil {
+			plugin.Logger.Error("repair hls playlist", zap.String("path", name), zap.Error(err))
+			continue
+		}
+		r.catalogRepairedSegments(streamPath, added)
+		plugin.Logger.Info("repair hls playlist", zap.String("path", name), zap.Int("segments", result.Segments), zap.Int("added", result.Added), zap.Int("removed", result.Removed), zap.Bool("rebuilt", result.Rebuilt))
+	}
+	return
+}
+
+// 探测分片的编码和时长
+func (r *Record) probeSegment(seg *hlsRepairSegment) (err error) {
+	var file io.ReadSeekCloser
+	if file, err = r.storage.OpenFile(seg.path); err != nil {
+		return
+	}
+	defer file.Close()
+	if path.Ext(seg.path) == ".m4s" {
+		var init io.ReadSeekCloser
+		if seg.init == "" {
+			err = errors.New("no init segment found")
+		} else if init, err = r.storage.OpenFile(seg.init); err == nil {
+			defer init.Close()
+			seg.probe, err = probeFMP4(init, file)
+		}
+	} else {
+		seg.probe, err = probeTS(file, seg.info.Size())
+	}
+	if err != nil {
+		plugin.Logger.Warn("probe hls segment", zap.String("path", seg.path), zap.Error(err))
+	}
+	return
+}
+
+// 查找fmp4分片使用的初始化段：初始化段以使用它的第一个分片命名，取同一目录下标签相同、不晚于该分片的最后一个
+func (r *Record) findHlsInit(name string, inits []string) (init string) {
+	base, label := strings.TrimSuffix(name, path.Ext(name)), r.parseLabel(name)
+	for _, candidate := range inits {
+		if b := strings.TrimSuffix(candidate, hlsInitExt); b <= base && b > strings.TrimSuffix(init, hlsInitExt) && r.parseLabel(b+".m4s") == label {
+			init = candidate
+		}
+	}
+	return
+}
+
+// 把补入m3u8的分片写入录像目录，保留异常退出时标记的中断
+func (r *Record) catalogRepairedSegments(streamPath string, segs []*hlsRepairSegment) {
+	catalog := RecordPluginConfig.catalog
+	if catalog == nil || len(segs) == 0 {
+		return
+	}
+	existing := make(map[string]*SegmentInfo)
+	for _, seg := range catalog.Query(CatalogQuery{Type: r.typ, StreamPath: streamPath}) {
+		existing[seg.Path] = seg
+	}
+	for _, seg := range segs {
+		duration := time.Duration(seg.ts.Len * float64(time.Second))
+		info := &SegmentInfo{
+			StreamPath:    streamPath,
+			Type:          r.typ,
+			Path:          seg.path,
+			StartTime:     seg.ts.Time,
+			EndTime:       seg.ts.Time.Add(duration),
+			Size:          seg.info.Size(),
+			Duration:      uint32(duration.Milliseconds()),
+			VideoCodec:    seg.probe.VideoCodec,
+			AudioCodec:    seg.probe.AudioCodec,
+			Discontinuity: seg.ts.Discontinuity,
+			Label:         r.parseLabel(seg.path),
+			InitPath:      seg.init,
+		}
+		if old, ok := existing[seg.path]; ok {
+			info.Interrupted, info.HardCut = old.Interrupted, old.HardCut
+		}
+		catalog.Add(info)
+	}
+}
+
+// 按探测结果生成m3u8条目，与上一个分片连续时接着上一个分片的结束时刻，否则写入EXT-X-DISCONTINUITY
+func (r *Record) repairTsInfo(playlist string, seg, prev *hlsRepairSegment, hasPrev bool) *TsInfo {
+	fileName, _ := filepath.Rel(path.Dir(playlist), seg.path)
+	duration := seg.probe.Duration()
+	ts := &TsInfo{
+		FileName:        filepath.ToSlash(fileName),
+		Time:            seg.start,
+		Len:             duration,
+		ProgramDateTime: seg.start.In(r.loc()),
+		Discontinuity:   hasPrev,
+	}
+	if seg.init != "" {
+		mapName, _ := filepath.Rel(path.Dir(playlist), seg.init)
+		ts.Map = filepath.ToSlash(mapName)
+	}
+	if prev != nil && prev.ts != nil {
+		prevEnd := prev.ts.Time.Add(time.Duration(prev.ts.Len * float64(time.Second)))
+		// 换了初始化段的分片前需要EXT-X-DISCONTINUITY
+		if seg.probe.continues(prev.probe) && prev.ts.Map == ts.Map && seg.start.Sub(prevEnd).Abs() <= time.Second {
+			ts.Time, ts.ProgramDateTime = prevEnd, prevEnd.In(r.loc())
+			ts.Discontinuity = false
+		}
+	}
+	seg.start = ts.Time
+	ts.EXTINF = fmt.Sprintf("#EXTINF:%.3f,", duration)
+	return ts
+}
@@ -0,0 +1,283 @@
+package record
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edgeware/mp4ff/aac"
+	"github.com/edgeware/mp4ff/mp4"
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/log"
+)
+
+// 生成一个188字节的ts包，不足的部分填充0xff
+func testTSPacket(pid int, pusi bool, payload []byte) []byte {
+	pkt := bytes.Repeat([]byte{0xff}, tsPacketSize)
+	pkt[0], pkt[1], pkt[2], pkt[3] = 0x47, byte(pid>>8&0x1f), byte(pid), 0x10
+	if pusi {
+		pkt[1] |= 0x40
+	}
+	copy(pkt[4:], payload)
+	return pkt
+}
+
+// PSI表，body从table_id开始，不含长度和CRC
+func testTSSection(body []byte) []byte {
+	l := len(body) + 4
+	section := append([]byte{0, body[0], 0xb0 | byte(l>>8), byte(l)}, body[1:]...)
+	return append(section, 0, 0, 0, 0)
+}
+
+func testPESTimestamp(flag byte, v uint64) []byte {
+	return []byte{flag<<4 | byte(v>>29&0x0e) | 1, byte(v >> 22), byte(v>>14) | 1, byte(v >> 7), byte(v<<1) | 1}
+}
+
+// 生成h264+aac的ts，视频每帧40ms，每帧两个包
+func testTS(firstDTS uint64, frames int) []byte {
+	var out []byte
+	out = append(out, testTSPacket(0, true, testTSSection([]byte{0, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00}))...)
+	out = append(out, testTSPacket(0x1000, true, testTSSection([]byte{2, 0, 1, 0xc1, 0, 0, 0xe1, 0x01, 0xf0, 0, 0x0f, 0xe1, 0x02, 0xf0, 0, 0x1b, 0xe1, 0x01, 0xf0, 0}))...)
+	for i := 0; i < frames; i++ {
+		dts := (firstDTS + uint64(i)*3600) & tsTimeMask
+		pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0xc0, 10}
+		pes = append(pes, testPESTimestamp(3, (dts+3600)&tsTimeMask)...)
+		pes = append(pes, testPESTimestamp(1, dts)...)
+		out = append(out, testTSPacket(0x101, true, pes)...)
+		out = append(out, testTSPacket(0x101, false, nil)...)
+	}
+	return out
+}
+
+func TestProbeTS(t *testing.T) {
+	tests := []struct {
+		name      string
+		firstDTS  uint64
+		frames    int
+		truncated bool
+	}{
+		{"short", 90000, 250, false},
+		{"wrap around 33 bits", tsTimeMask - 450000, 250, false},
+		{"larger than probe size", 90000, 3000, false},
+		{"truncated packet", 90000, 250, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testTS(tt.firstDTS, tt.frames)
+			if tt.truncated {
+				data = append(data, testTSPacket(0x101, true, nil)[:100]...)
+			}
+			probe, err := probeTS(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if probe.VideoCodec != "h264" || probe.AudioCodec != "aac" {
+				t.Errorf("codecs %s %s", probe.VideoCodec, probe.AudioCodec)
+			}
+			if probe.FirstDTS != tt.firstDTS {
+				t.Errorf("first dts %d, want %d", probe.FirstDTS, tt.firstDTS)
+			}
+			if want := (tt.firstDTS + uint64(tt.frames-1)*3600) & tsTimeMask; probe.LastDTS != want {
+				t.Errorf("last dts %d, want %d", probe.LastDTS, want)
+			}
+			if want := float64(tt.frames) * 0.04; probe.Duration() < want-0.001 || probe.Duration() > want+0.001 {
+				t.Errorf("duration %f, want %f", probe.Duration(), want)
+			}
+		})
+	}
+	if _, err := probeTS(bytes.NewReader(make([]byte, tsPacketSize*10)), tsPacketSize*10); err == nil {
+		t.Error("probe ts without pes")
+	}
+	next, _ := probeTS(bytes.NewReader(testTS(90000+250*3600, 10)), 0)
+	prev, _ := probeTS(bytes.NewReader(testTS(90000, 250)), 0)
+	if !next.continues(prev) {
+		t.Error("next segment should continue")
+	}
+	if prev.continues(next) {
+		t.Error("previous segment should not continue")
+	}
+}
+
+// 生成h264+aac的fmp4初始化段，与fmp4Muxer一样时间刻度为1000
+func testFMP4Init(t *testing.T) []byte {
+	init := mp4.CreateEmptyInit()
+	video, audio := mp4.CreateEmptyTrak(1, 1000, "video", "chi"), mp4.CreateEmptyTrak(2, 1000, "audio", "chi")
+	for _, trak := range []*mp4.TrakBox{video, audio} {
+		init.Moov.AddChild(trak)
+		init.Moov.Mvex.AddChild(mp4.CreateTrex(trak.Tkhd.TrackID))
+	}
+	if err := video.SetAVCDescriptor("avc1", [][]byte{testSPS}, [][]byte{testPPS}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := audio.SetAACDescriptor(aac.AAClc, 44100); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := init.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// 生成fmp4分片，视频每帧40ms，每秒一个小片段，音频单独的小片段。truncated为true时末尾追加半个小片段，模拟崩溃
+func testFMP4Segment(t *testing.T, firstMs uint64, frames int, truncated bool) []byte {
+	var buf bytes.Buffer
+	var seq uint32
+	encode := func(trackID uint32, start uint64, count int, w *bytes.Buffer) {
+		seq++
+		frag, _ := mp4.CreateFragment(seq, trackID)
+		for i := 0; i < count; i++ {
+			data := testVideoNALU(i)
+			frag.AddFullSample(mp4.FullSample{Data: data, DecodeTime: start + uint64(i)*40, Sample: mp4.Sample{Flags: mp4.SyncSampleFlags, Dur: 40, Size: uint32(len(data))}})
+		}
+		if err := frag.Encode(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < frames; i += 25 {
+		encode(1, firstMs+uint64(i)*40, min(25, frames-i), &buf)
+		encode(2, firstMs+uint64(i)*40, 10, &buf)
+	}
+	if truncated {
+		var tail bytes.Buffer
+		encode(1, firstMs+uint64(frames)*40, 25, &tail)
+		buf.Write(tail.Bytes()[:tail.Len()-20])
+	}
+	return buf.Bytes()
+}
+
+func TestProbeFMP4(t *testing.T) {
+	init := testFMP4Init(t)
+	for _, truncated := range []bool{false, true} {
+		probe, err := probeFMP4(bytes.NewReader(init), bytes.NewReader(testFMP4Segment(t, 10000, 250, truncated)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if probe.VideoCodec != "h264" || probe.AudioCodec != "aac" {
+			t.Errorf("codecs %s %s", probe.VideoCodec, probe.AudioCodec)
+		}
+		if probe.FirstDTS != 900000 || probe.Delta != 3600 {
+			t.Errorf("first dts %d delta %d", probe.FirstDTS, probe.Delta)
+		}
+		if probe.Duration() != 10 {
+			t.Errorf("truncated %v duration %f", truncated, probe.Duration())
+		}
+	}
+	if _, err := probeFMP4(bytes.NewReader(init), bytes.NewReader(nil)); err == nil {
+		t.Error("probe empty fmp4 segment")
+	}
+	if _, err := probeFMP4(bytes.NewReader(nil), bytes.NewReader(testFMP4Segment(t, 0, 25, false))); err == nil {
+		t.Error("probe fmp4 segment without init")
+	}
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 补入m3u8中缺少的ts分片，去掉已不存在的分片，连续的分片不加EXT-X-DISCONTINUITY
+func TestRepairHlsPlaylists(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	dir := t.TempDir()
+	r := &Record{typ: "hls", Ext: ".m3u8", Fragment: 10 * time.Second}
+	r.storage = NewLocalStorage(dir)
+	start := time.Date(2024, 5, 6, 10, 0, 0, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		unix := start.Add(time.Duration(i) * 10 * time.Second).Unix()
+		writeTestFile(t, dir, fmt.Sprintf("live/test/2024-05/06/%d.ts", unix), testTS(uint64(i)*900000, 250))
+	}
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-TARGETDURATION:10\n#EXT-X-PROGRAM-DATE-TIME:%s\n#EXTINF:10.000,\n2024-05/06/%d.ts\n#EXTINF:10.000,\n2024-05/06/%d.ts\n#EXTINF:10.000,\n2024-05/06/1.ts\n",
+		start.Format(programDateTimeLayout), start.Unix(), start.Add(10*time.Second).Unix())
+	writeTestFile(t, dir, "live/test/20240506.m3u8", []byte(playlist))
+	results, err := r.RepairHlsPlaylists("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Segments != 3 || results[0].Added != 1 || results[0].Removed != 1 || results[0].Rebuilt {
+		t.Fatalf("results %+v", results)
+	}
+	m3u8, err := ReadM3u8Info(r.storage, "live/test/20240506.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m3u8.TsFiles) != 3 {
+		t.Fatalf("segments %d", len(m3u8.TsFiles))
+	}
+	last := m3u8.TsFiles[2]
+	if last.FileName != fmt.Sprintf("2024-05/06/%d.ts", start.Add(20*time.Second).Unix()) || last.Discontinuity || last.Len != 10 {
+		t.Errorf("added segment %+v", last)
+	}
+	// 原m3u8损坏时按ts文件重新生成
+	writeTestFile(t, dir, "live/test/20240506.m3u8", []byte("garbage"))
+	if results, _ = r.RepairHlsPlaylists("live/test", false); len(results) != 1 || !results[0].Rebuilt || results[0].Segments != 3 {
+		t.Errorf("rebuild results %+v", results)
+	}
+	if results, _ = r.RepairHlsPlaylists("live/test", false); len(results) != 0 {
+		t.Errorf("repair again %+v", results)
+	}
+}
+
+// 补入m3u8中缺少的fmp4分片，按同目录的初始化段探测，换了初始化段时加EXT-X-DISCONTINUITY
+func TestRepairHlsFMP4Playlists(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	dir := t.TempDir()
+	r := &Record{typ: "hls", Ext: ".m3u8", Fragment: 10 * time.Second}
+	r.storage = NewLocalStorage(dir)
+	start := time.Date(2024, 5, 6, 10, 0, 0, 0, time.Local)
+	var names, inits []string
+	for i := 0; i < 3; i++ {
+		unix := start.Add(time.Duration(i) * 10 * time.Second).Unix()
+		names = append(names, fmt.Sprintf("2024-05/06/%d.m4s", unix))
+		inits = append(inits, fmt.Sprintf("2024-05/06/%d.init.mp4", unix))
+		writeTestFile(t, dir, "live/test/"+names[i], testFMP4Segment(t, uint64(i)*10000, 250, i == 1))
+	}
+	writeTestFile(t, dir, "live/test/"+inits[0], testFMP4Init(t))
+	writeTestFile(t, dir, "live/test/"+inits[2], testFMP4Init(t))
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-TARGETDURATION:10\n#EXT-X-MAP:URI=\"%s\"\n#EXT-X-PROGRAM-DATE-TIME:%s\n#EXTINF:10.000,\n%s\n",
+		inits[0], start.Format(programDateTimeLayout), names[0])
+	writeTestFile(t, dir, "live/test/20240506.m3u8", []byte(playlist))
+	results, err := r.RepairHlsPlaylists("live/test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Segments != 3 || results[0].Added != 2 {
+		t.Fatalf("results %+v", results)
+	}
+	m3u8, err := ReadM3u8Info(r.storage, "live/test/20240506.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m3u8.TsFiles) != 3 {
+		t.Fatalf("segments %d", len(m3u8.TsFiles))
+	}
+	for i, ts := range m3u8.TsFiles {
+		wantMap := inits[0]
+		if i == 2 {
+			wantMap = inits[2]
+		}
+		if ts.FileName != names[i] || ts.Map != wantMap || ts.Len != 10 || ts.Discontinuity != (i == 2) {
+			t.Errorf("segment %d %+v", i, ts)
+		}
+	}
+	if content := m3u8.ToPlaylistContent(); !strings.Contains(content, "#EXT-X-VERSION:7") {
+		t.Errorf("playlist version\n%s", content)
+	}
+	// 没有初始化段的分片无法探测，不补入
+	for _, name := range []string{inits[0], "20240506.m3u8"} {
+		if err = os.Remove(filepath.Join(dir, "live/test", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if results, _ = r.RepairHlsPlaylists("live/test", false); len(results) != 1 || results[0].Segments != 1 || results[0].Added != 1 {
+		t.Errorf("results without init %+v", results)
+	}
+}
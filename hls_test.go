@@ -0,0 +1,254 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/log"
+	"m7s.live/plugin/hls/v4"
+)
+
+// 同一个流的多个hls录像按标签使用各自的每天的m3u8
+func TestDayPlaylistName(t *testing.T) {
+	r := &Record{typ: "hls", Ext: ".m3u8", location: time.FixedZone("UTC+8", 8*3600)}
+	now := time.Date(2024, 1, 1, 17, 0, 0, 0, time.UTC)
+	if name := r.dayPlaylistName("live/test", now, ""); name != "live/test/20240102.m3u8" {
+		t.Errorf("unlabeled playlist %s", name)
+	}
+	name := r.dayPlaylistName("live/test", now, "event")
+	if name != "live/test/20240102_event.m3u8" {
+		t.Errorf("labeled playlist %s", name)
+	}
+	if m := dayPlaylistReg.FindStringSubmatch("20240102_event"); m == nil || m[1] != "event" {
+		t.Errorf("day playlist label %v", m)
+	}
+}
+
+// 同一个流同一个标签的每天的m3u8同时只能由一个hls录像写入
+func TestClaimDayPlaylist(t *testing.T) {
+	first := &HLSRecorder{}
+	first.ID = "first"
+	release, err := first.claimDayPlaylist("live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := &HLSRecorder{}
+	second.ID = "second"
+	if _, err = second.claimDayPlaylist("live/test"); !errors.Is(err, ErrHlsPlaylistInUse) {
+		t.Errorf("second recorder with the same label: %v", err)
+	}
+	if _, err = first.claimDayPlaylist("live/test"); !errors.Is(err, ErrRecordExist) {
+		t.Errorf("same recorder: %v", err)
+	}
+	labeled := &HLSRecorder{}
+	labeled.ID, labeled.Label = "labeled", "event"
+	releaseLabeled, err := labeled.claimDayPlaylist("live/test")
+	if err != nil {
+		t.Errorf("recorder with another label: %v", err)
+	} else {
+		releaseLabeled()
+	}
+	release()
+	if release, err = second.claimDayPlaylist("live/test"); err != nil {
+		t.Errorf("claim after release: %v", err)
+	} else {
+		release()
+	}
+}
+
+// fmp4初始化段写入失败时关闭并删除分片，不登记为正在写入，不写入m3u8
+func TestHLSCreateFileInitFailed(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	resume := RecordPluginConfig.Resume
+	RecordPluginConfig.Resume = ""
+	defer func() { RecordPluginConfig.Resume = resume }()
+	dir := t.TempDir()
+	// 初始化段的路径被目录占用
+	if err := os.MkdirAll(filepath.Join(dir, "live/test/seg.init.mp4/x"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHLSRecorder()
+	h.Logger = plugin.Logger
+	h.typ, h.SegmentFormat = "hls", "fmp4"
+	h.storage = NewLocalStorage(dir)
+	h.CreateFileFn = h.storage.CreateFile
+	h.template, _ = newPathTemplate("{streamPath}/seg")
+	h.Stream = &Stream{Path: "live/test"}
+	fw, err := h.CreateFile()
+	if err == nil || fw != nil {
+		t.Fatalf("create file %v %v", fw, err)
+	}
+	if isOpenSegment("hls", "live/test/seg.m4s") || h.segment != nil || !h.lastInf.Time.IsZero() {
+		t.Error("segment still registered")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "live/test/seg.m4s")); !os.IsNotExist(err) {
+		t.Errorf("segment file not removed: %v", err)
+	}
+}
+
+func newDayPlaylistTestRecorder(storage Storage) *HLSRecorder {
+	h := NewHLSRecorder()
+	h.Logger = plugin.Logger
+	h.typ, h.Ext = "hls", ".m3u8"
+	h.Fragment = 10 * time.Second
+	h.storage = storage
+	h.Stream = &Stream{Path: "live/test"}
+	h.initDayPlaylist()
+	return h
+}
+
+func testInf(i int, duration float64) MyInf {
+	return MyInf{
+		PlaylistInf: hls.PlaylistInf{Duration: duration, Title: fmt.Sprintf("%d.ts", i)},
+		Time:        time.Unix(int64(i*10), 0),
+	}
+}
+
+// 本地存储只追加新的分片，EXT-X-TARGETDURATION变化时整体替换
+func TestDayPlaylistAppend(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	dir := t.TempDir()
+	h := newDayPlaylistTestRecorder(NewLocalStorage(dir))
+	name := filepath.Join(dir, h.dayPlaylistPath)
+	check := func(i int, duration float64, replaced bool) {
+		t.Helper()
+		before, _ := os.Stat(name)
+		if err := h.writeInf(testInf(i, duration)); err != nil {
+			t.Fatal(err)
+		}
+		after, _ := os.Stat(name)
+		if os.SameFile(before, after) == replaced {
+			t.Errorf("segment %d replaced %v", i, !replaced)
+		}
+		if data, _ := os.ReadFile(name); string(data) != h.dayPlayList.ToPlaylistContent() {
+			t.Errorf("segment %d playlist:\n%s", i, data)
+		}
+	}
+	check(0, 10, false)
+	check(1, 10, false)
+	check(2, 15, true)
+	check(3, 10, false)
+	if m3u8, err := ReadM3u8Info(h.storage, h.dayPlaylistPath); err != nil || len(m3u8.TsFiles) != 4 || m3u8.TargetDuration() != 15 {
+		t.Fatalf("read playlist %v", err)
+	}
+}
+
+// 对象存储合并上传每天的m3u8，录像停止时上传剩余的分片
+func TestDayPlaylistBatchOnS3(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	srv := newFakeS3(t)
+	storage := NewS3Storage(srv.URL, "", testS3Bucket, testS3AccessKey, testS3SecretKey, "record/hls")
+	storage.Spool = t.TempDir()
+	h := newDayPlaylistTestRecorder(storage)
+	key := "record/hls/" + h.dayPlaylistPath
+	puts := func() (n int) {
+		for _, req := range srv.takeRequests() {
+			if req == "PUT "+key {
+				n++
+			}
+		}
+		return
+	}
+	if n := puts(); n != 1 {
+		t.Fatalf("%d uploads on create", n)
+	}
+	for i := 0; i < 5; i++ {
+		if err := h.writeInf(testInf(i, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := puts(); n != 0 {
+		t.Fatalf("%d uploads for 5 segments", n)
+	}
+	h.Context, h.CancelFunc = context.WithCancel(context.Background())
+	h.CancelFunc()
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := puts(); n != 1 {
+		t.Fatalf("%d uploads on stop", n)
+	}
+	if string(srv.objects[key]) != h.dayPlayList.ToPlaylistContent() {
+		t.Errorf("uploaded playlist:\n%s", srv.objects[key])
+	}
+}
+
+// 分片时长按帧的时间戳计算：切片时到下一个分片的第一帧，停止时加上最后一帧的时长，时间戳回绕不影响
+func TestTsSpanDuration(t *testing.T) {
+	for _, first := range []uint32{90000, 1<<32 - 3600*10} {
+		var s tsSpan
+		if s.duration() != 0 {
+			t.Fatal("duration without frames")
+		}
+		dts := first
+		for i := 0; i < 25; i++ {
+			s.begin(dts)
+			s.add(dts)
+			dts += 3600
+		}
+		// 停止时最后一帧按前一帧的间隔计算
+		if d := s.duration(); d != 1 {
+			t.Errorf("first %d: stopped duration %v", first, d)
+		}
+		// 在下一帧切片，该帧还未写入
+		s.begin(dts + 1800)
+		if d := s.duration(); d != 1.02 {
+			t.Errorf("first %d: cut duration %v", first, d)
+		}
+		s.reset()
+		if s.duration() != 0 {
+			t.Errorf("first %d: duration after reset", first)
+		}
+	}
+}
+
+// 每个分片前写入按时区的EXT-X-PROGRAM-DATE-TIME，前面有分片时才写入EXT-X-DISCONTINUITY，解析后保持一致
+func TestDayPlaylistTags(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	dir := t.TempDir()
+	h := newDayPlaylistTestRecorder(NewLocalStorage(dir))
+	h.location = time.FixedZone("UTC+8", 8*3600)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	infs := []MyInf{testInf(0, 10), testInf(1, 10), testInf(2, 10)}
+	for i := range infs {
+		infs[i].Time = start.Add(time.Duration(i*10) * time.Second)
+	}
+	infs[0].Discontinuity = true
+	infs[2].Discontinuity = true
+	infs[2].Time = infs[2].Time.Add(time.Minute)
+	for _, inf := range infs {
+		if err := h.writeInf(inf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, h.dayPlaylistPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	if n := strings.Count(content, discontinuityTag); n != 1 || !strings.Contains(content, discontinuityTag+"\n"+programDateTimeTag+"2024-01-01T08:01:20.000+08:00\n#EXTINF:10.000,\n2.ts\n") {
+		t.Errorf("playlist:\n%s", content)
+	}
+	m3u8 := ParseM3u8Info(data)
+	if len(m3u8.TsFiles) != len(infs) {
+		t.Fatalf("parsed %d segments", len(m3u8.TsFiles))
+	}
+	for i, ts := range m3u8.TsFiles {
+		if !ts.Time.Equal(infs[i].Time) || ts.Discontinuity != (i == 2) {
+			t.Errorf("segment %d time %v discontinuity %v", i, ts.Time, ts.Discontinuity)
+		}
+	}
+	// 没有EXT-X-PROGRAM-DATE-TIME的分片接着上一个分片推算，不连续时不推算
+	m3u8 = ParseM3u8Info([]byte("#EXTM3U\n" + programDateTimeTag + "2024-01-01T08:00:00.000+08:00\n#EXTINF:10.000,\na.ts\n#EXTINF:10.000,\nb.ts\n" + discontinuityTag + "\n#EXTINF:10.000,\n1704067300.ts\n"))
+	if len(m3u8.TsFiles) != 3 || !m3u8.TsFiles[1].Time.Equal(start.Add(10*time.Second)) || !m3u8.TsFiles[2].Time.Equal(time.Unix(1704067300, 0)) {
+		t.Errorf("inferred times %+v", m3u8.TsFiles)
+	}
+}
@@ -13,10 +13,13 @@ import (
 
 // ts文件信息
 type TsInfo struct {
-	EXTINF   string
-	FileName string
-	Time     time.Time //时间
-	Len      float64   //时长 秒
+	EXTINF          string
+	FileName        string
+	Time            time.Time //时间
+	Len             float64   //时长 秒
+	ProgramDateTime time.Time //EXT-X-PROGRAM-DATE-TIME，没有时为零值
+	Discontinuity   bool      //前面有EXT-X-DISCONTINUITY
+	Map             string    //fmp4分片的初始化段（EXT-X-MAP的URI），相对于m3u8所在目录，ts分片为空
 }
 
 // m3u8文件信息
@@ -27,8 +30,16 @@ type M3u8FileInfo struct {
 	TsFiles   []*TsInfo //ts文件信息
 	JoinPath  string    //ts文件所在目录，生成m3u8文件内容时会在ts文件名前拼接该路径
 	Path      string    //m3u8文件路径
+	VodPath   string    //点播m3u8相对于存储根目录的路径
 }
 
+const (
+	programDateTimeTag    = "#EXT-X-PROGRAM-DATE-TIME:"
+	discontinuityTag      = "#EXT-X-DISCONTINUITY"
+	mapTag                = "#EXT-X-MAP:"
+	programDateTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+)
+
 const (
 	M3U_HEAD = `#EXTM3U
 #EXT-X-VERSION:3
@@ -37,60 +48,166 @@ const (
 
 // 根据m3u8文件路径新建m3u8文件信息
 func NewM3u8Info(fileName string) (*M3u8FileInfo, error) {
-	var m3u8 = M3u8FileInfo{}
-	var errOut error
 	data, err_read := os.ReadFile(fileName) // 读取文件
 	if err_read != nil {
-		return &m3u8, err_read
+		return &M3u8FileInfo{}, err_read
 	}
+	return ParseM3u8Info(data), nil
+}
+
+// 从存储中读取m3u8文件信息
+func ReadM3u8Info(s Storage, name string) (*M3u8FileInfo, error) {
+	data, err := readFile(s, name)
+	if err != nil {
+		return &M3u8FileInfo{}, err
+	}
+	return ParseM3u8Info(data), nil
+}
+
+// 解析m3u8文件内容，分片时间优先使用EXT-X-PROGRAM-DATE-TIME，
+// 没有时接着上一个分片推算（中间有EXT-X-DISCONTINUITY时除外），否则使用ts文件名中的时间戳。
+// EXT-X-MAP对之后的所有分片有效，记录在每个分片上
+func ParseM3u8Info(data []byte) *M3u8FileInfo {
+	var m3u8 = M3u8FileInfo{}
 	var fileContent = string(data)
 	if len(fileContent) > 0 {
 		var lines = strings.Split(strings.ReplaceAll(fileContent, "\r\n", "\n"), "\n")
 		var isOverHead = false
-		var totalLen = 0.0
+		var programDateTime time.Time //下一个分片的EXT-X-PROGRAM-DATE-TIME
+		var discontinuity bool
+		var initSegment string //当前的EXT-X-MAP
 		for i, line := range lines {
-			if strings.HasPrefix(line, "#EXTINF") {
+			if v, ok := strings.CutPrefix(line, programDateTimeTag); ok {
 				isOverHead = true
-				var ts = &TsInfo{EXTINF: line, FileName: strings.ReplaceAll(lines[i+1], "\\", "/")}
-				//解析时间
-				var tsTimeStr = strings.ReplaceAll(path.Base(ts.FileName), ".ts", "") //获取时间戳
-				tsTime, errParse := strconv.ParseInt(tsTimeStr, 10, 64)
-				if errParse == nil {
-					ts.Time = time.Unix(tsTime, 0)
-				}
+				programDateTime, _ = time.Parse(time.RFC3339Nano, strings.TrimSpace(v))
+			} else if strings.HasPrefix(line, discontinuityTag) {
+				isOverHead = true
+				discontinuity = true
+			} else if v, ok := strings.CutPrefix(line, mapTag); ok {
+				isOverHead = true
+				initSegment = parseMapURI(v)
+			} else if strings.HasPrefix(line, "#EXTINF") && i+1 < len(lines) {
+				isOverHead = true
+				var ts = &TsInfo{EXTINF: line, FileName: strings.ReplaceAll(lines[i+1], "\\", "/"), Discontinuity: discontinuity, ProgramDateTime: programDateTime, Map: initSegment}
 				//解析时长
 				var lenStr = strings.ReplaceAll(ts.EXTINF, "#EXTINF:", "")
-				lenStr = strings.TrimRight(lenStr, ",")
+				lenStr, _, _ = strings.Cut(lenStr, ",")
 				lenStr = strings.Trim(lenStr, " ")
-				len, errParse := strconv.ParseFloat(lenStr, 64)
-				if errParse == nil {
-					ts.Len = len
-					totalLen += ts.Len
+				if l, errParse := strconv.ParseFloat(lenStr, 64); errParse == nil {
+					ts.Len = l
+				}
+				//解析时间
+				if !ts.ProgramDateTime.IsZero() {
+					ts.Time = ts.ProgramDateTime
+				} else if n := len(m3u8.TsFiles); n > 0 && !discontinuity && !m3u8.TsFiles[n-1].ProgramDateTime.IsZero() {
+					prev := m3u8.TsFiles[n-1]
+					ts.Time = prev.Time.Add(time.Duration(prev.Len * float64(time.Second)))
+					ts.ProgramDateTime = ts.Time
+				} else {
+					var tsTimeStr = strings.TrimSuffix(path.Base(ts.FileName), path.Ext(ts.FileName)) //获取时间戳
+					tsTime, errParse := strconv.ParseInt(tsTimeStr, 10, 64)
+					if errParse == nil {
+						ts.Time = time.Unix(tsTime, 0)
+					}
 				}
 				m3u8.TsFiles = append(m3u8.TsFiles, ts)
-			} else if !isOverHead {
+				programDateTime, discontinuity = time.Time{}, false
+			} else if !isOverHead && line != "" {
 				m3u8.Head += line + "\n"
 			}
 		}
 
 		if len(m3u8.TsFiles) > 0 {
-			// //修正时长
-			// totalLen = 0
-			// for i, ts := range m3u8.TsFiles {
-			// 	if i < (len(m3u8.TsFiles) - 1) {
-			// 		var tsNext = m3u8.TsFiles[i+1]
-			// 		ts.Len = tsNext.Time.Sub(ts.Time).Abs().Seconds()
-			// 	} else {
-			// 		ts.Len = m3u8.TsFiles[i-1].Len
-			// 	}
-			// 	totalLen += ts.Len
-			// }
-
+			var last = m3u8.TsFiles[len(m3u8.TsFiles)-1]
 			m3u8.StartTime = m3u8.TsFiles[0].Time
-			m3u8.EndTime = m3u8.StartTime.Add(time.Second * time.Duration(totalLen))
+			m3u8.EndTime = last.Time.Add(time.Duration(last.Len * float64(time.Second)))
+		}
+	}
+	return &m3u8
+}
+
+// EXT-X-MAP的URI属性
+func parseMapURI(attrs string) string {
+	for _, attr := range strings.Split(attrs, ",") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(attr), "URI="); ok {
+			return strings.ReplaceAll(strings.Trim(v, `"`), "\\", "/")
+		}
+	}
+	return ""
+}
+
+const (
+	targetDurationTag = "#EXT-X-TARGETDURATION:"
+	versionTag        = "#EXT-X-VERSION:"
+)
+
+// 生成m3u8头部，fmp4分片需要EXT-X-MAP，版本为7
+func playlistHead(target int, fmp4 bool) string {
+	version := 3
+	if fmp4 {
+		version = 7
+	}
+	return fmt.Sprintf("#EXTM3U\n%s%d\n#EXT-X-MEDIA-SEQUENCE:0\n%s%d\n", versionTag, version, targetDurationTag, target)
+}
+
+// 头部中某个整数标签的值，没有时返回0
+func (m *M3u8FileInfo) headTag(tag string) int {
+	for _, line := range strings.Split(m.Head, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), tag); ok {
+			value, _ := strconv.Atoi(v)
+			return value
+		}
+	}
+	return 0
+}
+
+// 改写头部中某个整数标签的值
+func (m *M3u8FileInfo) setHeadTag(tag string, value int) {
+	lines := strings.Split(m.Head, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), tag) {
+			lines[i] = tag + strconv.Itoa(value)
+			m.Head = strings.Join(lines, "\n")
+			return
+		}
+	}
+}
+
+// 头部中的EXT-X-TARGETDURATION，没有时返回0
+func (m *M3u8FileInfo) TargetDuration() int {
+	return m.headTag(targetDurationTag)
+}
+
+// 改写头部中的EXT-X-TARGETDURATION
+func (m *M3u8FileInfo) SetTargetDuration(target int) {
+	m.setHeadTag(targetDurationTag, target)
+}
+
+// 有fmp4分片时把EXT-X-VERSION升到7，如同一天先录制ts后改为fmp4
+func (m *M3u8FileInfo) upgradeVersion() {
+	if m.headTag(versionTag) < 7 && hasMap(m.TsFiles) {
+		m.setHeadTag(versionTag, 7)
+	}
+}
+
+// 是否有fmp4分片
+func hasMap(tsInfos []*TsInfo) bool {
+	for _, ts := range tsInfos {
+		if ts.Map != "" {
+			return true
 		}
 	}
-	return &m3u8, errOut
+	return false
+}
+
+// 分片的最大时长，四舍五入为整数，作为EXT-X-TARGETDURATION
+func maxTargetDuration(tsInfos []*TsInfo) (target int) {
+	for _, ts := range tsInfos {
+		if d := int(math.Round(ts.Len)); d > target {
+			target = d
+		}
+	}
+	return
 }
 
 func MakeM3u8Info(tsInfos []*TsInfo) (info *M3u8FileInfo, err error) {
@@ -103,8 +220,8 @@ func MakeM3u8Info(tsInfos []*TsInfo) (info *M3u8FileInfo, err error) {
 
 	var st = tsInfos[0].Time
 	var last = tsInfos[tsLen-1]
-	var et = last.Time.Add(time.Duration(last.Len))
-	var head = M3U_HEAD + fmt.Sprintf("\n#EXT-X-TARGETDURATION:%v\n", math.Ceil(tsInfos[0].Len))
+	var et = last.Time.Add(time.Duration(last.Len * float64(time.Second)))
+	var head = playlistHead(maxTargetDuration(tsInfos), hasMap(tsInfos))
 	info = &M3u8FileInfo{
 		StartTime: st,
 		EndTime:   et,
@@ -152,7 +269,10 @@ func (m *M3u8FileInfo) ToFileContent() string {
 	var sb = strings.Builder{}
 	sb.WriteString(m.Head)
 	if len(m.TsFiles) > 0 {
+		var initSegment string
 		for _, ts := range m.TsFiles {
+			ts.writeTags(&sb, m.JoinPath, initSegment)
+			initSegment = ts.Map
 			sb.WriteString(fmt.Sprintf("#EXTINF:%v,", ts.Len))
 			sb.WriteString("\n")
 			sb.WriteString(m.JoinPath)
@@ -163,3 +283,47 @@ func (m *M3u8FileInfo) ToFileContent() string {
 	sb.WriteString("#EXT-X-ENDLIST")
 	return sb.String()
 }
+
+// 写入分片前的EXT-X-DISCONTINUITY、EXT-X-MAP和EXT-X-PROGRAM-DATE-TIME，初始化段与上一个分片不同时才写入EXT-X-MAP
+func (ts *TsInfo) writeTags(sb *strings.Builder, joinPath string, lastMap string) {
+	if ts.Discontinuity {
+		sb.WriteString(discontinuityTag + "\n")
+	}
+	if ts.Map != "" && ts.Map != lastMap {
+		sb.WriteString(mapTag + `URI="` + joinPath + ts.Map + `"` + "\n")
+	}
+	if !ts.ProgramDateTime.IsZero() {
+		sb.WriteString(programDateTimeTag + ts.ProgramDateTime.Format(programDateTimeLayout) + "\n")
+	}
+}
+
+// 生成每天的m3u8内容，保留原有的头部和EXTINF，不写结束标记以便继续追加
+func (m *M3u8FileInfo) ToPlaylistContent() string {
+	var sb = strings.Builder{}
+	sb.WriteString(m.Head)
+	m.writeTsFiles(&sb, 0)
+	return sb.String()
+}
+
+// 最后n个分片的内容，追加到已写入的每天的m3u8之后
+func (m *M3u8FileInfo) tailContent(n int) string {
+	var sb = strings.Builder{}
+	m.writeTsFiles(&sb, len(m.TsFiles)-n)
+	return sb.String()
+}
+
+// 从第from个分片开始写入，初始化段与前一个分片相同时不重复写入EXT-X-MAP
+func (m *M3u8FileInfo) writeTsFiles(sb *strings.Builder, from int) {
+	var initSegment string
+	if from > 0 {
+		initSegment = m.TsFiles[from-1].Map
+	}
+	for _, ts := range m.TsFiles[from:] {
+		ts.writeTags(sb, "", initSegment)
+		initSegment = ts.Map
+		sb.WriteString(ts.EXTINF)
+		sb.WriteString("\n")
+		sb.WriteString(ts.FileName)
+		sb.WriteString("\n")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	_ "embed"
 	"errors"
 	"io"
+	"regexp"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
@@ -24,35 +26,65 @@ type RecordConfig struct {
 	RawAudio   Record
 	recordings sync.Map
 	FFmpeg     string //ffmpeg路径
+	Catalog    string //录像目录文件路径，为空则不记录目录，查询时遍历文件
+	catalog    *Catalog
+
+	PreRecord       time.Duration //预录时长，大于0时在内存中缓存流最近的GOP，开始录像时先写入缓存
+	PreRecordFilter string        //需要预录的StreamPath正则表达式，为空则全部预录
+	PostRecord      time.Duration //调用停止接口后继续录制的时长
+	preRecordReg    *regexp.Regexp
+	Schedule        []RecordSchedule //定时录像规则
+	Webhook         WebhookConfig    //录像事件通知
+	Resume          string           //录像状态文件路径，重启后恢复通过接口开始的录像，为空则不恢复
+	SharedSubscribe bool             //同一个流的多个录像共用一个订阅
+	ShutdownTimeout time.Duration    //引擎关闭时等待录像写完的最长时间
+	webhook         *Webhook
 }
 
+var recordTypes = []string{"flv", "mp4", "fmp4", "hls", "raw", "raw_audio"}
+
 //go:embed default.yaml
 var defaultYaml DefaultYaml
 var ErrRecordExist = errors.New("recorder exist")
 var RecordPluginConfig = &RecordConfig{
-	DefaultYaml: defaultYaml,
+	DefaultYaml:     defaultYaml,
+	Catalog:         "record/catalog.jsonl",
+	Resume:          "record/recordings.json",
+	ShutdownTimeout: 10 * time.Second,
+	Webhook: WebhookConfig{
+		Timeout:       5 * time.Second,
+		MaxRetry:      10,
+		RetryInterval: time.Second,
+		Outbox:        "record/webhook.jsonl",
+	},
 	Flv: Record{
+		typ:           "flv",
 		Path:          "record/flv",
 		Ext:           ".flv",
 		GetDurationFn: getFLVDuration,
 	},
 	Fmp4: Record{
+		typ:  "fmp4",
 		Path: "record/fmp4",
 		Ext:  ".mp4",
 	},
 	Mp4: Record{
+		typ:  "mp4",
 		Path: "record/mp4",
 		Ext:  ".mp4",
 	},
 	Hls: Record{
+		typ:  "hls",
 		Path: "record/hls",
 		Ext:  ".m3u8",
 	},
 	Raw: Record{
+		typ:  "raw",
 		Path: "record/raw",
 		Ext:  ".", // 默认h264扩展名为.h264,h265扩展名为.h265
 	},
 	RawAudio: Record{
+		typ:  "raw_audio",
 		Path: "record/raw",
 		Ext:  ".", // 默认aac扩展名为.aac,pcma扩展名为.pcma,pcmu扩展名为.pcmu
 	},
@@ -69,6 +101,27 @@ func (conf *RecordConfig) OnEvent(event any) {
 		conf.Hls.Init()
 		conf.Raw.Init()
 		conf.RawAudio.Init()
+		conf.openCatalog()
+		conf.openWebhook()
+		conf.preRecordReg = nil
+		if conf.PreRecordFilter != "" {
+			conf.preRecordReg = regexp.MustCompile(conf.PreRecordFilter)
+		}
+		conf.initSchedule()
+		if _, ok := v.(FirstConfig); ok {
+			//恢复上次退出前通过接口开始的录像
+			conf.loadRecordState()
+			//上传上次异常退出时未上传的s3文件，之后恢复未写入moov的mp4录像。
+			//恢复在后台进行，期间新录像不会选用中断文件的名字（文件或本地缓存存在时加~序号），不会覆盖待恢复的文件
+			spooled := conf.spooledFiles()
+			go func() {
+				uploadSpooled(spooled)
+				conf.Mp4.RecoverInterruptedMP4()
+			}()
+			//引擎关闭时在后台写完录像。m7s v4引擎没有可以阻塞的插件退出回调，Run返回时不等待插件，
+			//这里无法阻止进程退出，需要保证写完时由嵌入m7s的程序在进程退出前调用WaitShutdown
+			go conf.WaitShutdown()
+		}
 
 		//启动清理任务
 		conf.Hls.StartAutoClean()
@@ -77,16 +130,21 @@ func (conf *RecordConfig) OnEvent(event any) {
 		conf.Mp4.StartAutoClean()
 		conf.Raw.StartAutoClean()
 		conf.RawAudio.StartAutoClean()
-
-		// //启动自动重试
-		// conf.Hls.StartRetryRecord()
-		// conf.Flv.StartRetryRecord()
-		// conf.Fmp4.StartRetryRecord()
-		// conf.Mp4.StartRetryRecord()
-		// conf.Raw.StartRetryRecord()
-		// conf.RawAudio.StartRetryRecord()
+		conf.Hls.StartPeriodicClean()
+		conf.Flv.StartPeriodicClean()
+		conf.Fmp4.StartPeriodicClean()
+		conf.Mp4.StartPeriodicClean()
+		conf.Raw.StartPeriodicClean()
+		conf.RawAudio.StartPeriodicClean()
+	case SEclose:
+		scheduler.onClose(v.Target.Path)
 	case SEpublish:
 		streamPath := v.Target.Path
+		scheduler.onPublish(streamPath)
+		retryOnPublish(streamPath)
+		if conf.NeedPreRecord(streamPath) {
+			go StartPreRecord(streamPath, conf.PreRecord)
+		}
 		if conf.Flv.NeedRecord(streamPath) {
 			go NewFLVRecorder().Start(streamPath)
 		}
@@ -110,6 +168,57 @@ func (conf *RecordConfig) OnEvent(event any) {
 		}
 	}
 }
+
+// 打开录像目录，目录文件不存在时扫描已有录像补全
+func (conf *RecordConfig) openCatalog() {
+	if conf.Catalog == "" || conf.catalog != nil {
+		return
+	}
+	catalog, exist, err := OpenCatalog(conf.Catalog)
+	if err != nil {
+		plugin.Logger.Error("open catalog", zap.String("path", conf.Catalog), zap.Error(err))
+		return
+	}
+	conf.catalog = catalog
+	if !exist {
+		go func() {
+			for _, t := range recordTypes {
+				if _, err := conf.RebuildCatalog(t); err != nil {
+					plugin.Logger.Error("rebuild catalog", zap.String("type", t), zap.Error(err))
+				}
+			}
+		}()
+	}
+}
+
+// 自动录像的录像器ID，每个流每种类型只有一个；接口开始的录像使用各自的ID，可以同时有多个
+func recorderID(streamPath, t string) string {
+	return streamPath + "/" + t
+}
+
+// 根据类型创建录像器
+func newRecorder(t, streamPath string) IRecorder {
+	switch t {
+	case "flv":
+		return NewFLVRecorder()
+	case "mp4":
+		return NewMP4Recorder()
+	case "fmp4":
+		return NewFMP4Recorder()
+	case "hls":
+		return GetHLSRecorder(streamPath)
+	case "raw":
+		return NewRawRecorder()
+	case "raw_audio":
+		return NewRawAudioRecorder()
+	}
+	return nil
+}
+
+func (conf *RecordConfig) NeedPreRecord(streamPath string) bool {
+	return conf.PreRecord > 0 && (conf.preRecordReg == nil || conf.preRecordReg.MatchString(streamPath))
+}
+
 func (conf *RecordConfig) getRecorderConfigByType(t string) (recorder *Record) {
 	switch t {
 	case "flv":
@@ -144,51 +253,3 @@ func getFLVDuration(file io.ReadSeeker) uint32 {
 	}
 	return 0
 }
-
-// // 子线程定时检查意外断开的录像重新录制
-// func (r *Record) StartRetryRecord() {
-// 	if r.Retry == 0 {
-// 		return
-// 	}
-// 	log.Debugf("%v录像自动重试开启。。", r.Path, zap.Any("retry", r.Retry), zap.Any("retryInterval", r.RetryInterval))
-// 	go func() {
-// 		var interval = r.RetryInterval
-// 		if interval <= 0 {
-// 			interval = 1 * time.Second
-// 		}
-// 		for {
-// 			var removes = []*Recorder{}
-// 			RecordPluginConfig.recordings.Range(func(key, value any) bool {
-// 				ir, ok := value.(IRecorder)
-// 				if ok {
-// 					var recorder = ir.GetRecorder()
-// 					if recorder.IsRecoding {
-// 						recorder.RetryCount = 0
-// 						// removes = append(removes, recorder)
-// 					} else {
-// 						//重试
-// 						if r.Retry < 0 || recorder.RetryCount < r.Retry {
-// 							recorder.RetryCount++
-// 							log.Debug("录像重试。。", zap.Any("ID", recorder.ID), zap.Any("retryCount", recorder.RetryCount))
-// 							recorder.start(recorder.Spesific.(IRecorder), recorder.StreamPath, recorder.SubType)
-// 						} else {
-// 							log.Debug("超重试次数,停止录像", zap.Any("ID", recorder.ID), zap.Any("retryCount", recorder.RetryCount))
-// 							removes = append(removes, recorder)
-// 							recorder.Stop(zap.String("resion", "重试超最大次数"))
-// 							recorder.Close()
-// 						}
-// 					}
-// 				}
-
-// 				return true
-// 			})
-// 			if len(removes) > 0 {
-// 				for _, rem := range removes {
-// 					RecordPluginConfig.recordings.Delete(rem.ID)
-// 					delete(r.recording, rem.StreamPath)
-// 				}
-// 			}
-// 			time.Sleep(interval)
-// 		}
-// 	}()
-// }
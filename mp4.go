@@ -1,8 +1,10 @@
 package record
 
 import (
+	"encoding/json"
 	"net"
 
+	gocodec "github.com/yapingcat/gomedia/go-codec"
 	"github.com/yapingcat/gomedia/go-mp4"
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
@@ -15,6 +17,22 @@ type MP4Recorder struct {
 	*mp4.Movmuxer `json:"-" yaml:"-"`
 	videoId       uint32
 	audioId       uint32
+	journal       FileWr //恢复用的日志文件
+	journalName   string
+	written       *countWriter
+	pendingVideo  *mp4JournalSample //Movmuxer缓存中尚未写入的视频帧
+}
+
+// 统计写入文件的字节数，Movmuxer在收到下一帧时才写入上一帧视频，且会去掉重复的sps/pps，样本大小只能按实际写入计算
+type countWriter struct {
+	FileWr
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (n int, err error) {
+	n, err = w.FileWr.Write(p)
+	w.n += int64(n)
+	return
 }
 
 func NewMP4Recorder() *MP4Recorder {
@@ -24,7 +42,6 @@ func NewMP4Recorder() *MP4Recorder {
 }
 
 func (r *MP4Recorder) Start(streamPath string) (err error) {
-	r.ID = streamPath + "/mp4"
 	return r.start(r, streamPath, SUBTYPE_RAW)
 }
 
@@ -37,10 +54,94 @@ func (r *MP4Recorder) Close() (err error) {
 			// _, err = r.file.Write(r.cache.buf)
 			r.Info("mp4 write trailer", zap.Error(err))
 		}
+		trailerErr := err
 		err = r.File.Close()
+		r.closeJournal(trailerErr == nil && err == nil)
+		r.endSegment()
 	}
 	return
 }
+
+// 创建日志文件，记录恢复moov所需的编码参数，之后每写入一个样本追加一行
+func (r *MP4Recorder) openJournal() {
+	if r.segment == nil {
+		return
+	}
+	header := mp4JournalHeader{
+		StreamPath: r.segment.StreamPath,
+		StartTime:  r.segment.StartTime,
+	}
+	if r.videoId != 0 {
+		header.VideoCodec = videoCodecName(r.Video.CodecID)
+		header.VideoExtra = r.Video.SequenceHead[5:]
+	}
+	if r.audioId != 0 {
+		header.AudioCodec = audioCodecName(r.Audio.CodecID)
+		if r.Audio.CodecID == codec.CodecID_AAC {
+			header.AudioExtra = r.Audio.SequenceHead[2:]
+		}
+	}
+	data, _ := json.Marshal(header)
+	r.journalName = r.segment.Path + mp4JournalExt
+	file, err := r.storage.CreateFile(r.journalName, false)
+	if err == nil {
+		_, err = file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		r.Error("mp4 create journal", zap.String("path", r.journalName), zap.Error(err))
+		if file != nil {
+			file.Close()
+		}
+		return
+	}
+	r.journal = file
+}
+
+// 关闭日志文件，moov已写入时删除
+func (r *MP4Recorder) closeJournal(finished bool) {
+	if r.journal == nil {
+		return
+	}
+	r.journal.Close()
+	r.journal = nil
+	if finished {
+		r.storage.Remove(r.journalName)
+	}
+}
+
+// 按写入mdat的顺序记录样本大小和时间戳
+func (r *MP4Recorder) writeJournal(sample *mp4JournalSample) {
+	if r.journal == nil {
+		return
+	}
+	if _, err := r.journal.Write([]byte(sample.String())); err != nil {
+		r.Error("mp4 write journal", zap.Error(err))
+		r.closeJournal(false)
+	}
+}
+
+// Movmuxer固定去掉每帧前7字节的ADTS头，带CRC的头为9字节，先去掉CRC，保证mdat中是完整的aac帧，日志中的样本大小与写入的一致
+func stripADTSCRC(data []byte) []byte {
+	if len(data) < 9 || data[1]&1 == 1 {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	gocodec.SplitAACFrame(data, func(aac []byte) {
+		if len(aac) < 9 || aac[1]&1 == 1 {
+			out = append(out, aac...)
+			return
+		}
+		n := len(aac) - 2
+		header := [7]byte(aac[:7])
+		header[1] |= 1 //protection_absent
+		header[3] = header[3]&0xfc | byte(n>>11)&0x03
+		header[4] = byte(n >> 3)
+		header[5] = header[5]&0x1f | byte(n&7)<<5
+		out = append(append(out, header[:]...), aac[9:]...)
+	})
+	return out
+}
+
 func (r *MP4Recorder) setTracks() {
 	if r.Audio != nil {
 		switch r.Audio.CodecID {
@@ -66,12 +167,17 @@ func (r *MP4Recorder) OnEvent(event any) {
 	r.Recorder.OnEvent(event)
 	switch v := event.(type) {
 	case FileWr:
-		r.Movmuxer, err = mp4.CreateMp4Muxer(v)
+		r.written = &countWriter{FileWr: v}
+		r.pendingVideo = nil
+		r.videoId, r.audioId = 0, 0
+		r.Movmuxer, err = mp4.CreateMp4Muxer(r.written)
 		if err != nil {
 			r.Error("mp4 create muxer", zap.Error(err))
-		} else {
-			r.setTracks()
+			r.fail(err)
+			return
 		}
+		r.setTracks()
+		r.openJournal()
 	case AudioFrame:
 		if r.audioId != 0 {
 			var audioData []byte
@@ -80,11 +186,31 @@ func (r *MP4Recorder) OnEvent(event any) {
 			} else {
 				audioData = util.ConcatBuffers(append(net.Buffers{v.ADTS.Value}, v.AUList.ToBuffers()...))
 			}
-			r.Write(r.audioId, audioData, uint64(v.AbsTime+(v.PTS-v.DTS)/90), uint64(v.AbsTime))
+			pts, dts := uint64(v.AbsTime+(v.PTS-v.DTS)/90), uint64(v.AbsTime)
+			if r.Audio.CodecID == codec.CodecID_AAC {
+				audioData = stripADTSCRC(audioData)
+				gocodec.SplitAACFrame(audioData, func(aac []byte) {
+					r.writeJournal(&mp4JournalSample{Size: int64(len(aac) - 7), PTS: pts, DTS: dts})
+				})
+			} else {
+				r.writeJournal(&mp4JournalSample{Size: int64(len(audioData)), PTS: pts, DTS: dts})
+			}
+			err = r.Write(r.audioId, audioData, pts, dts)
 		}
 	case VideoFrame:
 		if r.videoId != 0 {
-			r.Write(r.videoId, util.ConcatBuffers(v.GetAnnexB()), uint64(v.AbsTime+(v.PTS-v.DTS)/90), uint64(v.AbsTime))
+			pts, dts := uint64(v.AbsTime+(v.PTS-v.DTS)/90), uint64(v.AbsTime)
+			written := r.written.n
+			err = r.Write(r.videoId, util.ConcatBuffers(v.GetAnnexB()), pts, dts)
+			if r.pendingVideo != nil && r.written.n > written {
+				r.pendingVideo.Size = r.written.n - written
+				r.writeJournal(r.pendingVideo)
+			}
+			r.pendingVideo = &mp4JournalSample{Video: true, PTS: pts, DTS: dts, Key: v.IFrame}
 		}
 	}
+	if err != nil {
+		r.Error("mp4 write", zap.Error(err))
+		r.fail(err)
+	}
 }
@@ -0,0 +1,682 @@
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gocodec "github.com/yapingcat/gomedia/go-codec"
+	"github.com/yapingcat/gomedia/go-mp4"
+	"go.uber.org/zap"
+)
+
+// mp4录像的日志文件扩展名，录制过程中记录恢复moov所需的信息，正常关闭后删除
+const mp4JournalExt = ".journal"
+
+// 日志文件第一行，记录编码参数
+type mp4JournalHeader struct {
+	StreamPath string
+	StartTime  time.Time
+	VideoCodec string `json:",omitempty"`
+	VideoExtra []byte `json:",omitempty"` //avcC/hvcC
+	AudioCodec string `json:",omitempty"`
+	AudioExtra []byte `json:",omitempty"` //AudioSpecificConfig
+}
+
+// 日志中的一个样本，对应mdat中的一段数据
+type mp4JournalSample struct {
+	Video bool
+	Size  int64
+	PTS   uint64
+	DTS   uint64
+	Key   bool
+}
+
+func (s *mp4JournalSample) String() string {
+	var t, key = "a", 0
+	if s.Video {
+		t = "v"
+	}
+	if s.Key {
+		key = 1
+	}
+	return fmt.Sprintf("%s,%d,%d,%d,%d\n", t, s.Size, s.PTS, s.DTS, key)
+}
+
+func parseMP4JournalSample(line string) (s mp4JournalSample, err error) {
+	fields := strings.Split(line, ",")
+	if len(fields) != 5 {
+		return s, errors.New("invalid journal line")
+	}
+	s.Video = fields[0] == "v"
+	if s.Size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return
+	}
+	if s.PTS, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+		return
+	}
+	if s.DTS, err = strconv.ParseUint(fields[3], 10, 64); err != nil {
+		return
+	}
+	s.Key = fields[4] == "1"
+	return
+}
+
+// 恢复结果
+type MP4RecoverResult struct {
+	Path         string
+	Journal      bool   //是否使用了日志文件
+	VideoSamples int    //恢复的视频帧数
+	AudioSamples int    //恢复的音频帧数
+	Duration     uint32 //时长 毫秒
+	Truncated    int64  //mdat末尾丢弃的字节数
+	Skipped      int64  //没有日志文件时跳过的无法识别的数据，一般是交错写入的音频
+}
+
+var (
+	ErrMP4Complete  = errors.New("mp4 already has moov")
+	ErrMP4NoJournal = errors.New("mp4 has no journal, recovering from mdat guesses the timing and drops audio, use force to recover anyway")
+)
+
+// 查找mdat数据的位置，mdat大小未写入时数据一直到文件末尾
+func findMdat(file io.ReadSeeker, fileSize int64) (start, end int64, err error) {
+	return findMP4Box(file, fileSize, "mdat")
+}
+
+// 查找顶层box数据的位置，大小未写入或超出文件的box（崩溃时的mdat）一直到文件末尾，之后不再有其他box
+func findMP4Box(file io.ReadSeeker, fileSize int64, typ string) (start, end int64, err error) {
+	var offset int64
+	header := make([]byte, 16)
+	for offset+8 <= fileSize {
+		if _, err = file.Seek(offset, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(file, header[:8]); err != nil {
+			return
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		headerSize := int64(8)
+		if size == 1 {
+			if _, err = io.ReadFull(file, header[8:]); err != nil {
+				return
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			headerSize = 16
+		}
+		if string(header[4:8]) == typ {
+			start, end = offset+headerSize, offset+size
+			if size <= headerSize || end > fileSize {
+				end = fileSize
+			}
+			return
+		}
+		if size < headerSize || offset+size > fileSize {
+			break
+		}
+		offset += size
+	}
+	return 0, 0, errors.New(typ + " not found")
+}
+
+// 读取日志文件
+func (r *Record) readMP4Journal(name string) (header *mp4JournalHeader, samples []mp4JournalSample, err error) {
+	var f io.ReadSeekCloser
+	if f, err = r.storage.OpenFile(name + mp4JournalExt); err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return nil, nil, errors.New("empty journal")
+	}
+	header = &mp4JournalHeader{}
+	if err = json.Unmarshal(scanner.Bytes(), header); err != nil {
+		return
+	}
+	for scanner.Scan() {
+		sample, err := parseMP4JournalSample(scanner.Text())
+		if err != nil {
+			break //崩溃时最后一行可能不完整
+		}
+		samples = append(samples, sample)
+	}
+	return
+}
+
+// 日志按写入mdat的顺序记录，依次计算每个样本在mdat中的位置
+type mp4SampleLocation struct {
+	mp4JournalSample
+	Offset int64
+}
+
+func locateMP4Samples(samples []mp4JournalSample, start, end int64) (located []mp4SampleLocation) {
+	offset := start
+	for _, s := range samples {
+		if offset+s.Size > end {
+			break
+		}
+		located = append(located, mp4SampleLocation{s, offset})
+		offset += s.Size
+	}
+	return
+}
+
+// 没有日志文件时，mdat中单个NALU的长度上限，超过时视为无效数据
+const maxMP4NALUSize = 8 << 20
+
+// NALU头是否有效，h264检查nal_ref_idc与类型是否匹配，h265检查layer id和temporal id
+func validNALUHeader(h265 bool, h []byte) bool {
+	if h[0]&0x80 != 0 {
+		return false
+	}
+	if h265 {
+		t := (h[0] >> 1) & 0x3f
+		return h[0]&1 == 0 && h[1]>>3 == 0 && h[1]&7 != 0 && (t <= 9 || t >= 16 && t <= 21 || t >= 32 && t <= 40)
+	}
+	t, ref := h[0]&0x1f, h[0]>>5
+	switch {
+	case t == 5 || t == 7 || t == 8:
+		return ref != 0
+	case t == 6 || t >= 9 && t <= 12:
+		return ref == 0
+	}
+	return t >= 1 && t <= 4
+}
+
+// NALU的类型，h为NALU头及之后的一个字节
+// 分帧规则与Movmuxer一致：已有VCL时遇到aud/sps/pps/sei或新的一帧的第一个slice即为下一帧
+func mp4NALUInfo(h265 bool, h []byte) (vcl, key, newAU, paramSet bool) {
+	if h265 {
+		t := (h[0] >> 1) & 0x3f
+		vcl, key, paramSet = t < 32, t >= 16 && t <= 21, t >= 32 && t <= 34
+		newAU = (t >= 32 && t <= 35) || t == 39 || (vcl && len(h) > 2 && h[2]&0x80 != 0)
+	} else {
+		t := h[0] & 0x1f
+		vcl, key, paramSet = t >= 1 && t <= 5, t == 5, t == 7 || t == 8
+		newAU = (t >= 6 && t <= 9) || (vcl && h[1]&0x80 != 0)
+	}
+	return
+}
+
+// 按开头的多个NALU判断视频编码，只看第一个NALU时h265的参数集也可能被当作h264
+func detectMP4VideoCodec(file io.ReadSeeker, start, end int64) (h265 bool, err error) {
+	if _, err = file.Seek(start, io.SeekStart); err != nil {
+		return
+	}
+	reader := bufio.NewReader(io.LimitReader(file, end-start))
+	var h264Valid, h265Valid int
+	for i, offset := 0, start; i < 32; i++ {
+		b, _ := reader.Peek(6)
+		if len(b) < 6 {
+			break
+		}
+		naluLen := int64(binary.BigEndian.Uint32(b))
+		if naluLen < 2 || naluLen > maxMP4NALUSize || offset+4+naluLen > end {
+			break
+		}
+		if validNALUHeader(false, b[4:]) {
+			h264Valid++
+		}
+		if validNALUHeader(true, b[4:]) {
+			h265Valid++
+		}
+		if _, err = reader.Discard(int(4 + naluLen)); err != nil {
+			break
+		}
+		offset += 4 + naluLen
+	}
+	return h265Valid > h264Valid, nil
+}
+
+// 没有日志文件时遍历mdat的结果
+type mp4VideoWalk struct {
+	samples   []mp4SampleLocation
+	paramSets bool  //第一个视频帧之前是否有参数集
+	skipped   int64 //无法识别而跳过的数据，一般是交错写入的音频
+}
+
+// 没有日志文件时，按AVCC格式遍历mdat中的视频NALU
+// 交错写入的音频没有记录长度，遇到无效的数据时逐字节向后查找下一帧的开始，音频数据被跳过
+func walkMP4VideoSamples(file io.ReadSeeker, start, end int64, frameDuration uint64, h265 bool) (w mp4VideoWalk, err error) {
+	if _, err = file.Seek(start, io.SeekStart); err != nil {
+		return
+	}
+	const bufSize = 1 << 20
+	reader := bufio.NewReaderSize(io.LimitReader(file, end-start), bufSize)
+	var current *mp4SampleLocation
+	var hasVCL, gap bool
+	flush := func() {
+		if current != nil && hasVCL {
+			w.samples = append(w.samples, *current)
+		}
+		current, hasVCL = nil, false
+	}
+	// 偏移处是否是一个完整的NALU
+	valid := func(b []byte, offset int64) bool {
+		naluLen := int64(binary.BigEndian.Uint32(b))
+		return naluLen >= 2 && naluLen <= maxMP4NALUSize && offset+4+naluLen <= end && validNALUHeader(h265, b[4:])
+	}
+	for offset := start; offset+6 <= end; {
+		b, _ := reader.Peek(7)
+		if len(b) < 6 {
+			break
+		}
+		naluLen := int64(binary.BigEndian.Uint32(b))
+		ok := valid(b, offset)
+		vcl, key, newAU, paramSet := mp4NALUInfo(h265, b[4:])
+		if ok && gap {
+			// 跳过的数据中可能碰巧出现有效的NALU头，必须是一帧的开始，并且是slice或者后面紧接着有效的NALU
+			next := offset + 4 + naluLen
+			ok = newAU && (vcl || next == end)
+			if !ok && newAU && next+6 <= end && 4+naluLen+7 <= bufSize {
+				if nb, _ := reader.Peek(int(4 + naluLen + 7)); len(nb) >= int(4+naluLen+6) {
+					ok = valid(nb[4+naluLen:], next)
+				}
+			}
+		}
+		if !ok {
+			flush()
+			gap = true
+			w.skipped++
+			if _, err = reader.Discard(1); err != nil {
+				break
+			}
+			offset++
+			continue
+		}
+		gap = false
+		if current == nil || hasVCL && newAU {
+			flush()
+			ts := uint64(len(w.samples)) * frameDuration
+			current = &mp4SampleLocation{Offset: offset}
+			current.Video = true
+			current.PTS, current.DTS = ts, ts
+		}
+		if paramSet && len(w.samples) == 0 && !hasVCL {
+			w.paramSets = true
+		}
+		hasVCL = hasVCL || vcl
+		current.Key = current.Key || key
+		current.Size += 4 + naluLen
+		if _, err = reader.Discard(int(4 + naluLen)); err != nil {
+			break
+		}
+		offset += 4 + naluLen
+	}
+	flush()
+	return w, nil
+}
+
+// 同一个流已写完的mp4中的视频编码和参数集（AnnexB格式），没有日志文件时用于恢复
+func (r *Record) knownParamSets(name, streamPath string) (h265 bool, paramSets []byte, ok bool) {
+	var candidates []string
+	segs := RecordPluginConfig.catalog.Query(CatalogQuery{Type: r.typ, StreamPath: streamPath})
+	for i := len(segs) - 1; i >= 0; i-- {
+		if !segs[i].Interrupted && segs[i].Path != name {
+			candidates = append(candidates, segs[i].Path)
+		}
+	}
+	if len(candidates) == 0 {
+		// 录像目录中没有记录时使用同一目录下最近的文件
+		dir := path.Dir(name)
+		infos, _ := r.storage.ReadDir(dir)
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].ModTime().After(infos[j].ModTime())
+		})
+		unfinished := make(map[string]bool)
+		for _, info := range infos {
+			if strings.HasSuffix(info.Name(), mp4JournalExt) {
+				unfinished[strings.TrimSuffix(info.Name(), mp4JournalExt)] = true
+			}
+		}
+		for _, info := range infos {
+			if p := path.Join(dir, info.Name()); !info.IsDir() && path.Ext(p) == r.Ext && p != name && !unfinished[info.Name()] {
+				candidates = append(candidates, p)
+			}
+		}
+	}
+	for i, p := range candidates {
+		if i >= 3 {
+			break
+		}
+		if h265, paramSets, ok = readMP4ParamSets(r.storage, p); ok {
+			return
+		}
+	}
+	return
+}
+
+// 读取mp4中第一个视频帧的参数集
+func readMP4ParamSets(s Storage, name string) (h265 bool, paramSets []byte, ok bool) {
+	file, err := s.OpenFile(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	demuxer := mp4.CreateMp4Demuxer(file)
+	tracks, err := demuxer.ReadHead()
+	if err != nil {
+		return
+	}
+	var cid mp4.MP4_CODEC_TYPE
+	for _, track := range tracks {
+		if track.Cid == mp4.MP4_CODEC_H264 || track.Cid == mp4.MP4_CODEC_H265 {
+			cid = track.Cid
+		}
+	}
+	if cid == 0 {
+		return
+	}
+	h265 = cid == mp4.MP4_CODEC_H265
+	for i := 0; i < 64; i++ {
+		pkt, err := demuxer.ReadPacket()
+		if err != nil {
+			return
+		}
+		if pkt.Cid != cid {
+			continue
+		}
+		// 关键帧之前demuxer会加上moov中的参数集
+		gocodec.SplitFrame(pkt.Data, func(nalu []byte) bool {
+			if len(nalu) < 2 {
+				return true
+			}
+			if _, _, _, paramSet := mp4NALUInfo(h265, nalu); paramSet {
+				paramSets = append(append(paramSets, 0, 0, 0, 1), nalu...)
+			}
+			return true
+		})
+		return h265, paramSets, len(paramSets) > 0
+	}
+	return
+}
+
+// 读取一个样本，视频数据转换为AnnexB格式，无效数据返回错误
+func readMP4Sample(file io.ReadSeeker, s *mp4SampleLocation) (data []byte, err error) {
+	if _, err = file.Seek(s.Offset, io.SeekStart); err != nil {
+		return
+	}
+	data = make([]byte, s.Size)
+	if _, err = io.ReadFull(file, data); err != nil {
+		return
+	}
+	if s.Video {
+		for i := 0; i < len(data); {
+			if i+4 > len(data) {
+				return nil, errors.New("invalid nalu")
+			}
+			naluLen := int(binary.BigEndian.Uint32(data[i:]))
+			if naluLen == 0 || i+4+naluLen > len(data) {
+				return nil, errors.New("invalid nalu length")
+			}
+			gocodec.CovertAVCCToAnnexB(data[i:])
+			i += 4 + naluLen
+		}
+	}
+	return
+}
+
+// 恢复没有写入moov的mp4录像，name为相对于存储根目录的路径
+// 有日志文件时按日志中的编码参数、样本大小和时间戳重建。没有日志文件时只有force为true才遍历mdat恢复视频（按25帧每秒，丢弃音频），
+// 参数集不在mdat中时使用同一个流其他录像的参数集。已有moov的文件已经写完，不做修改
+func (r *Record) RecoverMP4(name string, force bool) (result *MP4RecoverResult, err error) {
+	name = slashPath(name)
+	result = &MP4RecoverResult{Path: name}
+	info, err := r.storage.Stat(name)
+	if err != nil {
+		return
+	}
+	src, size, err := r.openRecoverSource(name)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	start, end, err := findMdat(src, size)
+	if err != nil {
+		return
+	}
+	if _, _, e := findMP4Box(src, size, "moov"); e == nil {
+		// 写完moov后删除日志前退出时会遗留日志文件
+		r.storage.Remove(name + mp4JournalExt)
+		return result, ErrMP4Complete
+	}
+
+	var samples []mp4SampleLocation
+	var paramSets []byte
+	header, journal, journalErr := r.readMP4Journal(name)
+	if journalErr != nil && !force {
+		return result, fmt.Errorf("%w: %v", ErrMP4NoJournal, journalErr)
+	}
+	if journalErr == nil {
+		result.Journal = true
+		samples = locateMP4Samples(journal, start, end)
+	} else {
+		header = &mp4JournalHeader{StreamPath: r.streamPathOf(name), VideoCodec: "h264"}
+		h265, known, ok := r.knownParamSets(name, header.StreamPath)
+		if !ok {
+			if h265, err = detectMP4VideoCodec(src, start, end); err != nil {
+				return
+			}
+		}
+		if h265 {
+			header.VideoCodec = "h265"
+		}
+		//没有时间戳信息，按25帧每秒生成
+		var walk mp4VideoWalk
+		if walk, err = walkMP4VideoSamples(src, start, end, 40, h265); err != nil {
+			return
+		}
+		samples, result.Skipped = walk.samples, walk.skipped
+		if !walk.paramSets {
+			paramSets = known
+		}
+	}
+	if len(samples) == 0 {
+		return result, errors.New("no sample recovered")
+	}
+
+	// 本地存储写入临时文件后重命名，对象存储在关闭时才上传，直接覆盖
+	_, local := r.storage.(*LocalStorage)
+	dstName := name
+	if local {
+		dstName = name + ".recover"
+	}
+	dst, err := r.storage.CreateFile(dstName, false)
+	if err != nil {
+		return
+	}
+	muxer, err := mp4.CreateMp4Muxer(dst)
+	if err != nil {
+		r.abortFile(dst, dstName)
+		return
+	}
+	var videoId, audioId uint32
+	switch header.VideoCodec {
+	case "h264":
+		videoId = muxer.AddVideoTrack(mp4.MP4_CODEC_H264, mp4.WithExtraData(header.VideoExtra))
+	case "h265":
+		videoId = muxer.AddVideoTrack(mp4.MP4_CODEC_H265, mp4.WithExtraData(header.VideoExtra))
+	}
+	switch header.AudioCodec {
+	case "aac":
+		audioId = muxer.AddAudioTrack(mp4.MP4_CODEC_AAC, mp4.WithExtraData(header.AudioExtra))
+	case "pcma":
+		audioId = muxer.AddAudioTrack(mp4.MP4_CODEC_G711A)
+	case "pcmu":
+		audioId = muxer.AddAudioTrack(mp4.MP4_CODEC_G711U)
+	}
+	var lastDTS uint64
+	var recovered int64
+	for i := range samples {
+		s := &samples[i]
+		data, err := readMP4Sample(src, s)
+		if err != nil {
+			break
+		}
+		if s.Video {
+			if videoId == 0 {
+				continue
+			}
+			if paramSets != nil {
+				// mdat中没有参数集，加在第一帧之前，Movmuxer从中生成avcC/hvcC
+				data = append(paramSets, data...)
+				paramSets = nil
+			}
+			err = muxer.Write(videoId, data, s.PTS, s.DTS)
+			result.VideoSamples++
+		} else {
+			if audioId == 0 {
+				continue
+			}
+			if header.AudioCodec == "aac" {
+				var adts *gocodec.ADTS_Frame_Header
+				if adts, err = gocodec.ConvertASCToADTS(header.AudioExtra, len(data)+7); err != nil {
+					break
+				}
+				data = append(adts.Encode(), data...)
+			}
+			err = muxer.Write(audioId, data, s.PTS, s.DTS)
+			result.AudioSamples++
+		}
+		if err != nil {
+			break
+		}
+		if s.DTS > lastDTS {
+			lastDTS = s.DTS
+		}
+		recovered = s.Offset + s.Size
+	}
+	if err = muxer.WriteTrailer(); err != nil {
+		r.abortFile(dst, dstName)
+		return
+	}
+	if err = dst.Close(); err != nil {
+		if local {
+			r.storage.Remove(dstName)
+		}
+		return
+	}
+	result.Truncated = end - recovered
+	if len(journal) > 0 {
+		result.Duration = uint32(lastDTS - journal[0].DTS)
+	} else {
+		result.Duration = uint32(lastDTS)
+	}
+	src.Close()
+	if local {
+		storage := r.storage.(*LocalStorage)
+		if err = os.Rename(storage.LocalPath(dstName), storage.LocalPath(name)); err != nil {
+			return
+		}
+	}
+	r.storage.Remove(name + mp4JournalExt)
+	if !result.Journal {
+		header.StartTime = info.ModTime().Add(-time.Duration(result.Duration) * time.Millisecond)
+	}
+	if info, err = r.storage.Stat(name); err != nil {
+		return
+	}
+	RecordPluginConfig.catalog.Add(&SegmentInfo{
+		StreamPath:  header.StreamPath,
+		Type:        r.typ,
+		Path:        name,
+		StartTime:   header.StartTime,
+		EndTime:     header.StartTime.Add(time.Duration(result.Duration) * time.Millisecond),
+		Size:        info.Size(),
+		Duration:    result.Duration,
+		VideoCodec:  header.VideoCodec,
+		AudioCodec:  header.AudioCodec,
+		Interrupted: true,
+		Label:       r.parseLabel(name),
+	})
+	plugin.Logger.Info("mp4 recovered", zap.Any("result", result))
+	return
+}
+
+// 打开待恢复的文件，非本地存储时先下载到本地临时文件，之后按样本读取时不再逐个发送Range请求
+func (r *Record) openRecoverSource(name string) (src io.ReadSeekCloser, size int64, err error) {
+	if local, ok := r.storage.(*LocalStorage); ok {
+		var file *os.File
+		if file, err = os.Open(local.LocalPath(name)); err != nil {
+			return
+		}
+		var info os.FileInfo
+		if info, err = file.Stat(); err != nil {
+			file.Close()
+			return
+		}
+		return file, info.Size(), nil
+	}
+	var in io.ReadSeekCloser
+	if in, err = r.storage.OpenFile(name); err != nil {
+		return
+	}
+	defer in.Close()
+	var file *os.File
+	if file, err = os.CreateTemp("", "record-recover-*"+path.Ext(name)); err != nil {
+		return
+	}
+	if size, err = io.Copy(file, in); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return &tempFile{file}, size, nil
+}
+
+// 关闭时删除的临时文件
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// 放弃写入的文件，对象存储的文件不再上传
+func (r *Record) abortFile(file FileWr, name string) {
+	if f, ok := file.(*s3File); ok {
+		f.File.Close()
+		os.Remove(f.Name())
+		return
+	}
+	file.Close()
+	r.storage.Remove(name)
+}
+
+// 恢复存储中所有遗留日志文件的mp4录像，正在录制的文件除外
+func (r *Record) RecoverInterruptedMP4() (results []*MP4RecoverResult) {
+	var names []string
+	r.walk("", func(name string, info os.FileInfo) {
+		if strings.HasSuffix(name, mp4JournalExt) {
+			names = append(names, strings.TrimSuffix(name, mp4JournalExt))
+		}
+	})
+	for _, name := range names {
+		if isRecordingFile(name) {
+			continue
+		}
+		result, err := r.RecoverMP4(name, false)
+		if err != nil {
+			plugin.Logger.Error("recover mp4", zap.String("path", name), zap.Error(err))
+			continue
+		}
+		results = append(results, result)
+	}
+	return
+}
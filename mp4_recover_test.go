@@ -0,0 +1,292 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gocodec "github.com/yapingcat/gomedia/go-codec"
+	"github.com/yapingcat/gomedia/go-mp4"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/log"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x47, 0xfe, 0xc8}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+	testASC = []byte{0x12, 0x10}
+)
+
+func testVideoNALU(i int) []byte {
+	if i%10 == 0 {
+		return []byte{0x65, 0x88, 0x84, byte(i), 1, 2, 3}
+	}
+	return []byte{0x41, 0x9a, byte(i), 7, 8}
+}
+
+func testAudioPayload(i int) []byte {
+	return []byte{0x21, 0x10, byte(i), 0x5a, 0xa5, 0x3c, 0xc3}
+}
+
+// 开始录制mp4，paramSets为false时关键帧前不带sps/pps，mdat中没有参数集
+func startTestMP4(t *testing.T, storage Storage, name string, paramSets bool) *MP4Recorder {
+	r := NewMP4Recorder()
+	r.Logger = &log.Logger{Logger: zap.NewNop()}
+	r.typ = "mp4"
+	r.storage = storage
+	r.Video = &track.Video{CodecID: codec.CodecID_H264}
+	avcC := append([]byte{1, testSPS[1], testSPS[2], testSPS[3], 0xff, 0xe1, 0, byte(len(testSPS))}, testSPS...)
+	avcC = append(append(avcC, 1, 0, byte(len(testPPS))), testPPS...)
+	r.Video.SequenceHead = append([]byte{0x17, 0, 0, 0, 0}, avcC...)
+	if paramSets {
+		r.Video.ParamaterSets = [][]byte{testSPS, testPPS}
+	}
+	r.Audio = &track.Audio{CodecID: codec.CodecID_AAC}
+	r.Audio.SequenceHead = append([]byte{0xaf, 0}, testASC...)
+	r.segment = &SegmentInfo{StreamPath: "live/a", Type: "mp4", Path: name, StartTime: time.Now()}
+	file, err := storage.CreateFile(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.File = file
+	r.OnEvent(FileWr(file))
+	return r
+}
+
+// 写入n帧视频，每帧后写入一帧带CRC的ADTS音频
+func writeTestMP4Frames(r *MP4Recorder, n int) {
+	for i := 0; i < n; i++ {
+		ts := uint32(i * 40)
+		var nalu util.BLL
+		nalu.Push(&util.ListItem[util.Buffer]{Value: testVideoNALU(i)})
+		video := &AVFrame{IFrame: i%10 == 0}
+		video.AUList.PushValue(&nalu)
+		r.OnEvent(VideoFrame{AVFrame: video, Video: r.Video, AbsTime: ts})
+
+		payload := testAudioPayload(i)
+		adts, _ := gocodec.ConvertASCToADTS(testASC, 9+len(payload))
+		header := adts.Encode()
+		header[1] &^= 1 //protection_absent为0，头后面有2字节CRC
+		var au util.BLL
+		au.Push(&util.ListItem[util.Buffer]{Value: payload})
+		audio := &AVFrame{ADTS: &util.ListItem[util.Buffer]{Value: append(header, 0xab, 0xcd)}}
+		audio.AUList.PushValue(&au)
+		r.OnEvent(AudioFrame{AVFrame: audio, Audio: r.Audio, AbsTime: ts})
+	}
+}
+
+// 读取恢复后的mp4，返回视频帧和音频帧
+func demuxTestMP4(t *testing.T, name string) (video, audio [][]byte) {
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	demuxer := mp4.CreateMp4Demuxer(file)
+	if _, err = demuxer.ReadHead(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err != nil {
+			break
+		}
+		if pkt.Cid == mp4.MP4_CODEC_H264 {
+			video = append(video, pkt.Data)
+		} else {
+			audio = append(audio, pkt.Data)
+		}
+	}
+	return
+}
+
+// 录制时异常退出（没有写入moov、最后一个样本不完整），按日志恢复，没有日志时按其他录像的参数集恢复视频
+func TestRecoverTruncatedMP4(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	resume := RecordPluginConfig.Resume
+	RecordPluginConfig.Resume = ""
+	defer func() { RecordPluginConfig.Resume = resume }()
+	dir := t.TempDir()
+	storage := NewLocalStorage(dir)
+	const frames = 30
+
+	// 正常写完的录像，提供参数集
+	r := startTestMP4(t, storage, "live/a/1.mp4", true)
+	writeTestMP4Frames(r, frames)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r = startTestMP4(t, storage, "live/a/2.mp4", false)
+	writeTestMP4Frames(r, frames)
+	r.File.Close()
+	r.journal.Close()
+	name := filepath.Join(dir, "live/a/2.mp4")
+	info, _ := os.Stat(name)
+	if err := os.Truncate(name, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(name)
+	os.WriteFile(filepath.Join(dir, "live/a/3.mp4"), data, 0666)
+
+	rec := &Record{typ: "mp4", Ext: ".mp4", storage: storage}
+	result, err := rec.RecoverMP4("live/a/2.mp4", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 最后一帧视频还在Movmuxer的缓存中，最后一帧音频被截断
+	if !result.Journal || result.VideoSamples != frames-1 || result.AudioSamples != frames-1 || result.Truncated != int64(len(testAudioPayload(0))-3) {
+		t.Errorf("result %+v", result)
+	}
+	video, audio := demuxTestMP4(t, name)
+	if len(video) != frames-1 || len(audio) != frames-1 {
+		t.Fatalf("demuxed %d video %d audio", len(video), len(audio))
+	}
+	// 去掉了ADTS的CRC，音频帧完整
+	for i, a := range audio {
+		if !bytes.Equal(a[7:], testAudioPayload(i)) {
+			t.Fatalf("audio %d = %x", i, a)
+		}
+	}
+	if !bytes.Contains(video[0], testSPS) {
+		t.Errorf("first frame without sps: %x", video[0])
+	}
+	if _, err = os.Stat(name + mp4JournalExt); !os.IsNotExist(err) {
+		t.Errorf("journal not removed: %v", err)
+	}
+
+	// 已写完的录像不做修改，遗留的日志文件被删除
+	finished := filepath.Join(dir, "live/a/1.mp4")
+	data, _ = os.ReadFile(finished)
+	os.WriteFile(finished+mp4JournalExt, nil, 0666)
+	if _, err = rec.RecoverMP4("live/a/1.mp4", true); !errors.Is(err, ErrMP4Complete) {
+		t.Errorf("recover finished mp4: %v", err)
+	}
+	if after, _ := os.ReadFile(finished); !bytes.Equal(after, data) {
+		t.Error("finished mp4 modified")
+	}
+	if _, err = os.Stat(finished + mp4JournalExt); !os.IsNotExist(err) {
+		t.Errorf("stale journal not removed: %v", err)
+	}
+
+	// 没有日志文件时需要force
+	if _, err = rec.RecoverMP4("live/a/3.mp4", false); !errors.Is(err, ErrMP4NoJournal) {
+		t.Fatalf("recover without journal: %v", err)
+	}
+	// 没有日志文件，跳过交错的音频，参数集来自1.mp4
+	result, err = rec.RecoverMP4("live/a/3.mp4", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Journal || result.VideoSamples != frames-1 || result.AudioSamples != 0 || result.Skipped == 0 {
+		t.Errorf("result %+v", result)
+	}
+	video, _ = demuxTestMP4(t, filepath.Join(dir, "live/a/3.mp4"))
+	if len(video) != frames-1 || !bytes.Contains(video[0], testSPS) || !bytes.Contains(video[0], testPPS) {
+		t.Fatalf("demuxed %d video, first %x", len(video), video[0])
+	}
+	for i, v := range video {
+		if !bytes.HasSuffix(v, testVideoNALU(i)) {
+			t.Errorf("video %d = %x", i, v)
+		}
+	}
+}
+
+// 按多个NALU判断编码，h265的流不一定以参数集开头
+func TestDetectMP4VideoCodec(t *testing.T) {
+	avcc := func(nalus ...[]byte) []byte {
+		var b []byte
+		for _, nalu := range nalus {
+			b = binary.BigEndian.AppendUint32(b, uint32(len(nalu)))
+			b = append(b, nalu...)
+		}
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+		h265 bool
+	}{
+		{"h264", avcc([]byte{0x09, 0xf0}, testSPS, testPPS, []byte{0x65, 0x88, 0x84, 0}, []byte{0x41, 0x9a, 1}), false},
+		{"h264 slice", avcc([]byte{0x41, 0x9a, 1}, []byte{0x41, 0x9a, 2}), false},
+		{"h265", avcc([]byte{0x40, 0x01, 0x0c}, []byte{0x42, 0x01, 0x01}, []byte{0x44, 0x01, 0xc1}, []byte{0x26, 0x01, 0xaf}), true},
+		{"h265 aud", avcc([]byte{0x46, 0x01, 0x50}, []byte{0x4e, 0x01, 0x05}, []byte{0x26, 0x01, 0xaf}, []byte{0x02, 0x01, 0xd0}), true},
+	}
+	for _, tt := range tests {
+		h265, err := detectMP4VideoCodec(bytes.NewReader(tt.data), 0, int64(len(tt.data)))
+		if err != nil || h265 != tt.h265 {
+			t.Errorf("%s: h265 = %v %v, want %v", tt.name, h265, err, tt.h265)
+		}
+	}
+}
+
+// 对象存储：异常退出时文件和日志保留在本地缓存中，重启后上传并恢复，恢复时只下载一次
+func TestRecoverMP4OnS3(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	resume := RecordPluginConfig.Resume
+	RecordPluginConfig.Resume = ""
+	defer func() { RecordPluginConfig.Resume = resume }()
+	srv := newFakeS3(t)
+	storage := NewS3Storage(srv.URL, "", testS3Bucket, testS3AccessKey, testS3SecretKey, "record/mp4")
+	storage.Spool = t.TempDir()
+	const frames = 20
+	r := startTestMP4(t, storage, "live/a/1.mp4", true)
+	writeTestMP4Frames(r, frames)
+	// 异常退出，没有上传
+	r.File.(*s3File).File.Close()
+	r.journal.(*s3File).File.Close()
+	if len(srv.objects) != 0 {
+		t.Fatalf("uploaded before close: %d", len(srv.objects))
+	}
+	// 未上传的文件视为存在，新录像不会选用同名文件
+	if _, err := storage.Stat("live/a/1.mp4"); err != nil {
+		t.Fatalf("stat spooled file: %v", err)
+	}
+	names := storage.Spooled()
+	if len(names) != 2 {
+		t.Fatalf("spooled %v", names)
+	}
+	for _, name := range names {
+		if err := storage.UploadSpooled(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names = storage.Spooled(); len(names) != 0 {
+		t.Fatalf("spooled after upload %v", names)
+	}
+
+	srv.takeRequests()
+	rec := &Record{typ: "mp4", Ext: ".mp4", storage: storage}
+	result, err := rec.RecoverMP4("live/a/1.mp4", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Journal || result.VideoSamples != frames-1 || result.AudioSamples != frames {
+		t.Errorf("result %+v", result)
+	}
+	var gets int
+	for _, req := range srv.takeRequests() {
+		if req == "GET record/mp4/live/a/1.mp4" {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Errorf("%d GET requests for the recording", gets)
+	}
+	if _, ok := srv.objects["record/mp4/live/a/1.mp4"+mp4JournalExt]; ok {
+		t.Error("journal not removed")
+	}
+	recovered := filepath.Join(t.TempDir(), "1.mp4")
+	os.WriteFile(recovered, srv.objects["record/mp4/live/a/1.mp4"], 0666)
+	if video, audio := demuxTestMP4(t, recovered); len(video) != frames-1 || len(audio) != frames {
+		t.Errorf("demuxed %d video %d audio", len(video), len(audio))
+	}
+}
@@ -0,0 +1,217 @@
+package record
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+)
+
+// 预录缓存中的一帧，数据从引擎的内存池中拷贝出来
+type preFrame struct {
+	Video     bool
+	IFrame    bool
+	Timestamp time.Duration //流中的绝对时间戳
+	DeltaTime uint32
+	CTS       uint32 //PTS与DTS之差
+	AVCC      []byte
+	ADTS      []byte
+}
+
+// 还原为引擎的帧，AUList按AVCC格式拆分
+func (f *preFrame) avFrame() *AVFrame {
+	frame := &AVFrame{IFrame: f.IFrame, Timestamp: f.Timestamp}
+	frame.DeltaTime = f.DeltaTime
+	frame.AVCC.Push(&util.ListItem[util.Buffer]{Value: f.AVCC})
+	pushAU := func(data []byte) {
+		var au util.BLL
+		au.Push(&util.ListItem[util.Buffer]{Value: data})
+		frame.AUList.PushValue(&au)
+	}
+	if f.Video {
+		// 5字节头之后为4字节长度的NALU
+		for data := f.AVCC[5:]; len(data) > 4; {
+			size := int(binary.BigEndian.Uint32(data))
+			if size > len(data)-4 {
+				break
+			}
+			pushAU(data[4 : 4+size])
+			data = data[4+size:]
+		}
+	} else if codec.AudioCodecID(f.AVCC[0]>>4) == codec.CodecID_AAC {
+		pushAU(f.AVCC[2:])
+	} else {
+		pushAU(f.AVCC[1:])
+	}
+	if f.ADTS != nil {
+		frame.ADTS = &util.ListItem[util.Buffer]{Value: f.ADTS}
+	}
+	return frame
+}
+
+// 预录订阅者，在内存中缓存流最近的GOP，开始录像时先把缓存写入新文件
+type PreRecorder struct {
+	Subscriber
+	sync.Mutex
+	Duration time.Duration //缓存时长
+	frames   []*preFrame
+}
+
+var preRecorders sync.Map
+
+// 为流开启预录
+func StartPreRecord(streamPath string, duration time.Duration) (err error) {
+	p := &PreRecorder{Duration: duration}
+	p.ID = streamPath + "/prerecord"
+	if _, loaded := preRecorders.LoadOrStore(streamPath, p); loaded {
+		return ErrRecordExist
+	}
+	if err = plugin.Subscribe(streamPath, p); err != nil {
+		preRecorders.CompareAndDelete(streamPath, p)
+		return
+	}
+	go func() {
+		p.PlayBlock(SUBTYPE_RAW)
+		preRecorders.CompareAndDelete(streamPath, p)
+	}()
+	return
+}
+
+func (p *PreRecorder) OnEvent(event any) {
+	switch v := event.(type) {
+	case VideoFrame:
+		if avcc := v.AVCC.ToBytes(); len(avcc) > 5 {
+			p.push(&preFrame{
+				Video:     true,
+				IFrame:    v.IFrame,
+				Timestamp: v.Timestamp,
+				DeltaTime: v.DeltaTime,
+				CTS:       v.PTS - v.DTS,
+				AVCC:      avcc,
+			})
+		}
+	case AudioFrame:
+		frame := &preFrame{
+			IFrame:    p.VideoReader == nil, //纯音频流每帧都可以作为起点
+			Timestamp: v.Timestamp,
+			DeltaTime: v.DeltaTime,
+			CTS:       v.PTS - v.DTS,
+			AVCC:      v.AVCC.ToBytes(),
+		}
+		if v.ADTS != nil {
+			frame.ADTS = append([]byte(nil), v.ADTS.Value...)
+		}
+		if len(frame.AVCC) > 2 {
+			p.push(frame)
+		}
+	default:
+		p.Subscriber.OnEvent(event)
+	}
+}
+
+// 加入一帧，超出缓存时长时丢弃最早的GOP，缓存始终从关键帧开始
+func (p *PreRecorder) push(frame *preFrame) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.frames) == 0 && !frame.IFrame {
+		return
+	}
+	p.frames = append(p.frames, frame)
+	for {
+		next := -1
+		for i := 1; i < len(p.frames); i++ {
+			if p.frames[i].IFrame && (p.frames[i].Video || p.VideoReader == nil) {
+				next = i
+				break
+			}
+		}
+		if next < 0 || frame.Timestamp-p.frames[next].Timestamp < p.Duration {
+			return
+		}
+		p.frames = p.frames[next:]
+	}
+}
+
+// 取出最后一个GOP之前的缓存帧，新的订阅者从最后一个关键帧开始读取，next为该关键帧相对于第一帧的时间
+// all为true时取出全部缓存帧，用于共享订阅中从缓存之后继续录制
+func (p *PreRecorder) snapshot(all bool) (frames []*preFrame, next uint32) {
+	p.Lock()
+	defer p.Unlock()
+	if all {
+		return append(frames, p.frames...), 0
+	}
+	last := -1
+	for i := len(p.frames) - 1; i > 0; i-- {
+		if p.frames[i].IFrame && (p.frames[i].Video || p.VideoReader == nil) {
+			last = i
+			break
+		}
+	}
+	if last <= 0 {
+		return
+	}
+	frames = append(frames, p.frames[:last]...)
+	next = uint32((p.frames[last].Timestamp - frames[0].Timestamp).Milliseconds())
+	return
+}
+
+// 新录像开始时先写入预录缓存，之后的实时帧时间戳接在缓存之后
+func (r *Recorder) flushPreRecord() {
+	if r.append {
+		return
+	}
+	value, ok := preRecorders.Load(r.Stream.Path)
+	if !ok {
+		return
+	}
+	frames, next := value.(*PreRecorder).snapshot(r.shared != nil)
+	if len(frames) == 0 {
+		return
+	}
+	if r.shared != nil {
+		r.sink = sharedSink{started: true, prerecorded: true, base: frames[0].Timestamp}
+	}
+	for _, f := range frames {
+		absTime := uint32((f.Timestamp - frames[0].Timestamp).Milliseconds())
+		dts := absTime * 90
+		if f.Video {
+			r.sink.videoAfter = f.Timestamp
+			if r.VideoReader != nil {
+				r.Spesific.OnEvent(VideoFrame{AVFrame: f.avFrame(), Video: r.Video, AbsTime: absTime, PTS: dts + f.CTS, DTS: dts})
+			}
+		} else {
+			r.sink.audioAfter = f.Timestamp
+			if r.AudioReader != nil {
+				r.Spesific.OnEvent(AudioFrame{AVFrame: f.avFrame(), Audio: r.Audio, AbsTime: absTime, PTS: dts + f.CTS, DTS: dts})
+			}
+		}
+	}
+	if r.shared != nil {
+		r.Info("flush prerecord", zap.Int("frames", len(frames)))
+		return
+	}
+	startTs := time.Duration(next) * time.Millisecond
+	if r.VideoReader != nil {
+		r.VideoReader.StartTs = startTs
+	}
+	if r.AudioReader != nil {
+		r.AudioReader.StartTs = startTs
+	}
+	r.Info("flush prerecord", zap.Int("frames", len(frames)), zap.Uint32("duration", next))
+}
+
+// 停止录像，postRecord大于0时继续录制该时长后再停止
+func stopRecorder(recorder IRecorder, postRecord time.Duration) {
+	cancelRecordTask(recorder.GetRecorder().ID)
+	if postRecord <= 0 {
+		recorder.Stop(zap.String("reason", "api stop"))
+		return
+	}
+	time.AfterFunc(postRecord, func() {
+		recorder.Stop(zap.String("reason", "post record end"))
+	})
+}
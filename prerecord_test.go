@@ -0,0 +1,66 @@
+package record
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/util"
+)
+
+func testPreFrame(iframe bool, ms int) *preFrame {
+	return &preFrame{Video: true, IFrame: iframe, Timestamp: time.Duration(ms) * time.Millisecond, AVCC: []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 1, 0x65}}
+}
+
+// 缓存从关键帧开始，超出缓存时长时按GOP丢弃，至少保留缓存时长
+func TestPreRecordPush(t *testing.T) {
+	p := &PreRecorder{Duration: 2 * time.Second}
+	p.push(testPreFrame(false, 0))
+	if len(p.frames) != 0 {
+		t.Fatal("cache starts without key frame")
+	}
+	// 每秒一个GOP，每个GOP4帧
+	for ms := 1000; ms < 6000; ms += 250 {
+		p.push(testPreFrame(ms%1000 == 0, ms))
+	}
+	first, last := p.frames[0].Timestamp, p.frames[len(p.frames)-1].Timestamp
+	if !p.frames[0].IFrame || first != 3*time.Second || last-first < p.Duration {
+		t.Errorf("cache %v-%v, %d frames", first, last, len(p.frames))
+	}
+}
+
+// 新录像取出最后一个GOP之前的帧，实时帧从最后一个关键帧开始；共享订阅取出全部
+func TestPreRecordSnapshot(t *testing.T) {
+	p := &PreRecorder{Duration: 10 * time.Second}
+	for ms := 0; ms < 3000; ms += 250 {
+		p.push(testPreFrame(ms%1000 == 0, ms))
+	}
+	frames, next := p.snapshot(false)
+	if len(frames) != 8 || next != 2000 {
+		t.Errorf("snapshot %d frames, next %d", len(frames), next)
+	}
+	if frames, _ = p.snapshot(true); len(frames) != 12 {
+		t.Errorf("snapshot all %d frames", len(frames))
+	}
+	// 只有一个GOP时没有可以写入的缓存
+	p = &PreRecorder{Duration: 10 * time.Second}
+	p.push(testPreFrame(true, 0))
+	p.push(testPreFrame(false, 250))
+	if frames, _ = p.snapshot(false); len(frames) != 0 {
+		t.Errorf("snapshot of one gop %d frames", len(frames))
+	}
+}
+
+// 缓存的视频帧按AVCC拆分为NALU
+func TestPreFrameAVFrame(t *testing.T) {
+	f := &preFrame{Video: true, IFrame: true, AVCC: []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 2, 0x67, 1, 0, 0, 0, 1, 0x65}}
+	frame := f.avFrame()
+	var nalus [][]byte
+	frame.AUList.Range(func(au *util.BLL) bool {
+		nalus = append(nalus, au.ToBytes())
+		return true
+	})
+	if len(nalus) != 2 || !bytes.Equal(nalus[0], []byte{0x67, 1}) || !bytes.Equal(nalus[1], []byte{0x65}) {
+		t.Errorf("nalus %x", nalus)
+	}
+}
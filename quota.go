@@ -0,0 +1,211 @@
+package record
+
+import (
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+
+	"m7s.live/engine/v4/log"
+)
+
+// 按保留策略和磁盘配额持续清理录像，超过总大小上限或磁盘剩余空间不足时删除最早的录像
+func (r *Record) StartPeriodicClean() {
+	if r.MaxSize <= 0 && r.MinFreePercent <= 0 && len(r.Retention) == 0 || r.periodicCleaning {
+		return
+	}
+	r.periodicCleaning = true
+	var interval = r.QuotaInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		for {
+			r.checkRetention()
+			r.checkQuota()
+			if r.MinFreePercent > 0 {
+				RecordPluginConfig.checkFreeSpace()
+			}
+			time.Sleep(interval)
+		}
+	}()
+	log.Infof("配额清理任务:目录[%v]上限[%vMB]最小剩余空间[%v%%]", r.Path, r.MaxSize, r.MinFreePercent)
+}
+
+// 超过总大小上限时删除最早的录像，每种格式单独统计
+func (r *Record) checkQuota() {
+	if r.MaxSize <= 0 {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("配额清理录像出错！%v", err)
+		}
+	}()
+	segs := r.quotaSegments()
+	var need = -r.MaxSize * 1024 * 1024
+	for _, seg := range segs {
+		need += seg.Size
+	}
+	if need <= 0 {
+		return
+	}
+	candidates := make([]quotaSegment, len(segs))
+	for i, seg := range segs {
+		candidates[i] = quotaSegment{r, seg}
+	}
+	sortQuotaSegments(candidates)
+	removed := removeQuotaSegments(candidates, func(seg *SegmentInfo) bool {
+		need -= seg.Size
+		return need <= 0
+	})
+	syncQuotaPlaylists(removed)
+}
+
+// 配额清理的候选文件及其所属的格式
+type quotaSegment struct {
+	record *Record
+	*SegmentInfo
+}
+
+// 先删除最早一天的录像，同一天内按流和开始时间，日期按各格式配置的时区划分
+func sortQuotaSegments(segs []quotaSegment) {
+	sort.SliceStable(segs, func(i, j int) bool {
+		di, dj := segs[i].StartTime.In(segs[i].record.loc()).Format("20060102"), segs[j].StartTime.In(segs[j].record.loc()).Format("20060102")
+		if di != dj {
+			return di < dj
+		}
+		if segs[i].StreamPath != segs[j].StreamPath {
+			return segs[i].StreamPath < segs[j].StreamPath
+		}
+		return segs[i].StartTime.Before(segs[j].StartTime)
+	})
+}
+
+// 按顺序删除录像直到done返回true，跳过正在录制的文件，返回已删除的文件
+func removeQuotaSegments(segs []quotaSegment, done func(*SegmentInfo) bool) (removed []quotaSegment) {
+	for _, seg := range segs {
+		if isRecordingFile(seg.Path) {
+			continue
+		}
+		if err := seg.record.removeFile(seg.Path); err != nil {
+			log.Errorf("文件删除出错：%v,%v", seg.Path, err)
+			continue
+		}
+		log.Infof("超出配额，文件已删除：%v", seg.Path)
+		removed = append(removed, seg)
+		if done(seg.SegmentInfo) {
+			break
+		}
+	}
+	return
+}
+
+// 删除分片后同步hls的m3u8
+func syncQuotaPlaylists(removed []quotaSegment) {
+	type stream struct {
+		*Record
+		path string
+	}
+	var streams = make(map[stream]bool)
+	for _, seg := range removed {
+		if s := (stream{seg.record, seg.StreamPath}); !streams[s] {
+			streams[s] = true
+			s.syncHlsPlaylists(s.path)
+		}
+	}
+}
+
+// 配置了最小剩余空间的各个格式的本地存储目录，按所在磁盘分组
+func (conf *RecordConfig) freeSpaceVolumes() map[string][]*Record {
+	volumes := make(map[string][]*Record)
+	for _, typ := range recordTypes {
+		r := conf.getRecorderConfigByType(typ)
+		if r.MinFreePercent <= 0 {
+			continue
+		}
+		local, ok := r.storage.(*LocalStorage)
+		if !ok {
+			continue
+		}
+		volume, err := volumeID(local.Root)
+		if err != nil {
+			log.Errorf("获取磁盘出错：%v", err)
+			continue
+		}
+		volumes[volume] = append(volumes[volume], r)
+	}
+	return volumes
+}
+
+var freeSpaceLock sync.Mutex
+
+// 磁盘剩余空间不足时删除最早的录像，同一磁盘上的所有格式一起统计，每删除一个文件后重新获取剩余空间
+// 各格式的清理任务都会调用，串行执行，剩余空间足够时直接返回
+func (conf *RecordConfig) checkFreeSpace() {
+	freeSpaceLock.Lock()
+	defer freeSpaceLock.Unlock()
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("磁盘空间清理录像出错！%v", err)
+		}
+	}()
+	for _, records := range conf.freeSpaceVolumes() {
+		var percent float64
+		for _, r := range records {
+			percent = max(percent, r.MinFreePercent)
+		}
+		root := records[0].storage.(*LocalStorage).Root
+		enough := func() bool {
+			free, size, err := diskUsage(root)
+			if err != nil {
+				log.Errorf("获取磁盘空间出错：%v", err)
+				return true
+			}
+			return float64(free) >= float64(size)*percent/100
+		}
+		if enough() {
+			continue
+		}
+		var segs []quotaSegment
+		for _, r := range records {
+			for _, seg := range r.quotaSegments() {
+				segs = append(segs, quotaSegment{r, seg})
+			}
+		}
+		sortQuotaSegments(segs)
+		syncQuotaPlaylists(removeQuotaSegments(segs, func(*SegmentInfo) bool {
+			return enough()
+		}))
+	}
+}
+
+// 是否为录像文件，hls为ts或fmp4分片
+func (r *Record) isSegmentFile(name string) bool {
+	if r.typ == "hls" {
+		return isHlsSegment(name)
+	}
+	return r.matchExt(name)
+}
+
+// 配额统计的录像文件，优先使用录像目录，否则遍历存储
+func (r *Record) quotaSegments() (segs []*SegmentInfo) {
+	if catalog := RecordPluginConfig.catalog; catalog != nil {
+		for _, seg := range catalog.Query(CatalogQuery{Type: r.typ}) {
+			copied := *seg
+			segs = append(segs, &copied)
+		}
+		return
+	}
+	r.walk("", func(name string, info fs.FileInfo) {
+		if !r.isSegmentFile(name) {
+			return
+		}
+		seg := &SegmentInfo{Type: r.typ, Path: name, StreamPath: r.streamPathOf(name), Size: info.Size(), StartTime: info.ModTime(), EndTime: info.ModTime()}
+		if _, start, ok := r.parsePath(name); ok && !start.IsZero() {
+			seg.StartTime = start
+		}
+		segs = append(segs, seg)
+	})
+	return
+}
@@ -0,0 +1,56 @@
+package record
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 按配置的时区划分日期，同一天内按流和开始时间
+func TestSortQuotaSegments(t *testing.T) {
+	r := &Record{location: time.FixedZone("UTC+8", 8*3600)}
+	at := func(s string) time.Time {
+		v, _ := time.Parse(time.RFC3339, s)
+		return v
+	}
+	segs := []quotaSegment{
+		{r, &SegmentInfo{Path: "b/2", StreamPath: "b", StartTime: at("2024-01-01T17:00:00Z")}}, //UTC+8的1月2日
+		{r, &SegmentInfo{Path: "b/1", StreamPath: "b", StartTime: at("2024-01-01T15:00:00Z")}},
+		{r, &SegmentInfo{Path: "a/1", StreamPath: "a", StartTime: at("2024-01-01T16:30:00Z")}},
+		{r, &SegmentInfo{Path: "a/0", StreamPath: "a", StartTime: at("2024-01-01T10:00:00Z")}},
+	}
+	sortQuotaSegments(segs)
+	want := []string{"a/0", "b/1", "a/1", "b/2"}
+	for i, seg := range segs {
+		if seg.Path != want[i] {
+			t.Errorf("segment %d = %s, want %s", i, seg.Path, want[i])
+		}
+	}
+}
+
+// 超过总大小上限时从最早的录像开始删除，直到不超过上限，跳过正在录制的文件
+func TestCheckQuota(t *testing.T) {
+	dir := t.TempDir()
+	r := &Record{typ: "flv", Ext: ".flv", MaxSize: 1, storage: NewLocalStorage(dir)}
+	files := []string{"live/a/1704067200.flv", "live/a/1704070800.flv", "live/b/1704067300.flv", "live/b/1704160800.flv"}
+	for _, name := range files {
+		writeTestFile(t, dir, name, make([]byte, 400<<10))
+	}
+	// 最早的文件正在录制
+	re := &fanoutTestRecorder{}
+	re.segment = &SegmentInfo{Path: files[0]}
+	RecordPluginConfig.recordings.Store("quota-test", re)
+	defer RecordPluginConfig.recordings.Delete("quota-test")
+	r.checkQuota()
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	// 1.6MB超出0.6MB，删除同一天中a的第二个文件和b的第一个文件
+	for i, want := range []bool{true, false, false, true} {
+		if exists(files[i]) != want {
+			t.Errorf("%s exists %v, want %v", files[i], !want, want)
+		}
+	}
+}
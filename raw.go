@@ -1,6 +1,7 @@
 package record
 
 import (
+	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
 	"m7s.live/engine/v4/codec"
 	"m7s.live/engine/v4/track"
@@ -24,10 +25,6 @@ func NewRawAudioRecorder() (r *RawRecorder) {
 }
 
 func (r *RawRecorder) Start(streamPath string) error {
-	r.ID = streamPath + "/raw"
-	if r.IsAudio {
-		r.ID += "_audio"
-	}
 	return r.start(r, streamPath, SUBTYPE_RAW)
 }
 
@@ -66,10 +63,16 @@ func (r *RawRecorder) OnEvent(event any) {
 		r.AddTrack(v)
 	case AudioFrame:
 		r.Recorder.OnEvent(event)
-		v.WriteRawTo(r)
+		if _, err := v.WriteRawTo(r); err != nil {
+			r.Error("raw write", zap.Error(err))
+			r.fail(err)
+		}
 	case VideoFrame:
 		r.Recorder.OnEvent(event)
-		v.WriteAnnexBTo(r)
+		if _, err := v.WriteAnnexBTo(r); err != nil {
+			r.Error("raw write", zap.Error(err))
+			r.fail(err)
+		}
 	default:
 		r.IO.OnEvent(v)
 	}
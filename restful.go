@@ -1,12 +1,16 @@
 package record
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
+	"sync/atomic"
 	"time"
 
-	. "m7s.live/engine/v4"
 	"m7s.live/engine/v4/util"
 )
 
@@ -20,19 +24,34 @@ type ApiRes struct {
 func (conf *RecordConfig) API_list(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	t := query.Get("type")
+	// 配置了录像目录时从目录查询录像片段，不再遍历录像文件；没有配置时保持原来的文件列表
+	if conf.catalog != nil {
+		if conf.getRecorderConfigByType(t) == nil {
+			t = ""
+		}
+		util.ReturnFetchValue(func() []*SegmentInfo {
+			return conf.catalog.Query(CatalogQuery{
+				Type:       t,
+				StreamPath: query.Get("streamPath"),
+				StartTime:  toTime(query.Get("st")),
+				EndTime:    toTime(query.Get("et")),
+			})
+		}, w, r)
+		return
+	}
 	var files []*VideoFileInfo
 	var err error
 	recorder := conf.getRecorderConfigByType(t)
 	if recorder == nil {
-		for _, t = range []string{"flv", "mp4", "fmp4", "hls", "raw", "raw_audio"} {
+		for _, t = range recordTypes {
 			recorder = conf.getRecorderConfigByType(t)
 			var fs []*VideoFileInfo
-			if fs, err = recorder.Tree(recorder.Path, 0); err == nil {
+			if fs, err = recorder.Tree("", 0); err == nil {
 				files = append(files, fs...)
 			}
 		}
 	} else {
-		files, err = recorder.Tree(recorder.Path, 0)
+		files, err = recorder.Tree("", 0)
 	}
 
 	if err == nil {
@@ -64,27 +83,13 @@ func (conf *RecordConfig) API_start(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	t := query.Get("type")
+	if t == "" {
+		t = "flv"
+	}
 	//var id string
 	var err error
-	var irecorder IRecorder
-	switch t {
-	case "":
-		t = "flv"
-		fallthrough
-	case "flv":
-		irecorder = NewFLVRecorder()
-	case "mp4":
-		irecorder = NewMP4Recorder()
-	case "fmp4":
-		irecorder = NewFMP4Recorder()
-	case "hls":
-		// irecorder = GetHLSRecorder(streamPath)
-		irecorder = NewHLSRecorder()
-	case "raw":
-		irecorder = NewRawRecorder()
-	case "raw_audio":
-		irecorder = NewRawAudioRecorder()
-	default:
+	irecorder := newAPIRecorder(t)
+	if irecorder == nil {
 		http.Error(w, "type not supported", http.StatusBadRequest)
 		return
 	}
@@ -94,6 +99,12 @@ func (conf *RecordConfig) API_start(w http.ResponseWriter, r *http.Request) {
 	}
 	recorder.FileName = fileName
 	recorder.append = query.Get("append") != ""
+	recorder.Label = query.Get("label")
+	if !labelReg.MatchString(recorder.Label) {
+		http.Error(w, "invalid label", http.StatusBadRequest)
+		return
+	}
+	recorder.ID = newRecordID(streamPath, t)
 	// plugin.Logger.Debug("visit record/api/start begin", zap.Any("url", r.URL))
 	err = irecorder.Start(streamPath)
 	// plugin.Logger.Debug("visit record/api/start end", zap.Any("url", r.URL))
@@ -102,7 +113,25 @@ func (conf *RecordConfig) API_start(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	//fmt.Fprintf(w, id)
+	addRecordTask(t, irecorder)
+	w.Write([]byte(recorder.ID))
+}
+
+var labelReg = regexp.MustCompile(`^[\p{L}\p{N}_-]*$`)
+var recordIDSeq atomic.Uint32
+
+// 接口开始的录像ID，同一个流同一种类型可以同时有多个录像
+// 毫秒时间戳区分重启前后的录像，单调递增的序号保证同一进程内不重复
+func newRecordID(streamPath, t string) string {
+	return recorderID(streamPath, t) + "/" + strconv.FormatInt(time.Now().UnixMilli(), 36) + "-" + strconv.FormatUint(uint64(recordIDSeq.Add(1)), 36)
+}
+
+// 根据类型创建接口使用的录像器，hls不复用自动录像的录像器
+func newAPIRecorder(t string) IRecorder {
+	if t == "hls" {
+		return NewHLSRecorder()
+	}
+	return newRecorder(t, "")
 }
 
 func (conf *RecordConfig) API_list_recording(w http.ResponseWriter, r *http.Request) {
@@ -111,18 +140,103 @@ func (conf *RecordConfig) API_list_recording(w http.ResponseWriter, r *http.Requ
 			recordings = append(recordings, value)
 			return true
 		})
+		// 等待重试的录像
+		for _, task := range waitingRecordTasks() {
+			recordings = append(recordings, task)
+		}
 		return
 	}, w, r)
 }
 
 func (conf *RecordConfig) API_stop(w http.ResponseWriter, r *http.Request) {
-	if recorder, ok := conf.recordings.Load(r.URL.Query().Get("id")); ok {
-		recorder.(ISubscriber).Stop()
-		// var rcd = recorder.(IRecorder).GetRecorder()
-		// RecordPluginConfig.recordings.Delete(rcd.ID)
-		// delete(rcd.recording, rcd.StreamPath)
+	query := r.URL.Query()
+	if recorder, ok := conf.recordings.Load(query.Get("id")); ok {
+		postRecord := conf.PostRecord
+		if v := query.Get("postRecord"); v != "" {
+			postRecord, _ = time.ParseDuration(v)
+		}
+		stopRecorder(recorder.(IRecorder), postRecord)
+		// wait不为空时等待当前文件写完再返回
+		if v := query.Get("wait"); v != "" {
+			wait, _ := time.ParseDuration(v)
+			ctx, cancel := context.WithTimeout(r.Context(), postRecord+wait)
+			defer cancel()
+			if err := recorder.(IRecorder).GetRecorder().Wait(ctx); err != nil {
+				http.Error(w, err.Error(), http.StatusGatewayTimeout)
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+		return
+	}
+	if _, ok := recordTasks.Load(query.Get("id")); ok {
+		cancelRecordTask(query.Get("id"))
 		w.Write([]byte("ok"))
 		return
 	}
 	http.Error(w, "no such recorder", http.StatusBadRequest)
 }
+
+// 重新扫描录像文件重建录像目录，type为空时重建全部类型
+func (conf *RecordConfig) API_catalog_rebuild(w http.ResponseWriter, r *http.Request) {
+	types := recordTypes
+	if t := r.URL.Query().Get("type"); t != "" {
+		types = []string{t}
+	}
+	var total int
+	for _, t := range types {
+		count, err := conf.RebuildCatalog(t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		total += count
+	}
+	fmt.Fprintf(w, "%d", total)
+}
+
+// 恢复中断的mp4录像（没有moov），path为相对于mp4录像目录的文件路径，为空时恢复所有遗留日志文件的录像。
+// 没有日志文件时需要force才按mdat恢复
+func (conf *RecordConfig) API_recover_mp4(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		util.ReturnFetchValue(conf.Mp4.RecoverInterruptedMP4, w, r)
+		return
+	}
+	if isRecordingFile(slashPath(name)) {
+		http.Error(w, "file is recording", http.StatusBadRequest)
+		return
+	}
+	result, err := conf.Mp4.RecoverMP4(name, r.URL.Query().Get("force") != "")
+	if errors.Is(err, ErrMP4Complete) || errors.Is(err, ErrMP4NoJournal) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	util.ReturnFetchValue(func() *MP4RecoverResult { return result }, w, r)
+}
+
+// 按磁盘上的ts分片修复每天的m3u8，streamPath为空时修复全部流，rebuild不为空时不使用原有m3u8的内容重新生成
+func (conf *RecordConfig) API_repair_hls(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	results, err := conf.Hls.RepairHlsPlaylists(query.Get("streamPath"), query.Get("rebuild") != "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	util.ReturnFetchValue(func() []*HLSRepairResult { return results }, w, r)
+}
+
+// 发送一个测试事件，用于检查webhook接收端
+func (conf *RecordConfig) API_webhook_test(w http.ResponseWriter, r *http.Request) {
+	if conf.webhook == nil {
+		http.Error(w, "webhook not enabled", http.StatusBadRequest)
+		return
+	}
+	e := newRecordEvent(RecordEventTest)
+	e.StreamPath = r.URL.Query().Get("streamPath")
+	conf.webhook.Send(e)
+	w.Write([]byte(e.ID))
+}
@@ -0,0 +1,38 @@
+package record
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 同一毫秒内开始的多个录像ID也不重复
+func TestNewRecordIDUnique(t *testing.T) {
+	ids := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		id := newRecordID("live/test", "hls")
+		if ids[id] {
+			t.Fatalf("duplicate id %s", id)
+		}
+		ids[id] = true
+	}
+}
+
+// 配置了录像目录时不指定catalog参数也从目录查询
+func TestAPIListCatalog(t *testing.T) {
+	c, _, err := OpenCatalog(filepath.Join(t.TempDir(), "catalog.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.Add(&SegmentInfo{Type: "flv", StreamPath: "live/a", Path: "live/a/1.flv", StartTime: now, EndTime: now.Add(time.Minute)})
+	c.Add(&SegmentInfo{Type: "flv", StreamPath: "live/b", Path: "live/b/1.flv", StartTime: now, EndTime: now.Add(time.Minute)})
+	conf := &RecordConfig{catalog: c}
+	w := httptest.NewRecorder()
+	conf.API_list(w, httptest.NewRequest("GET", "/record/api/list?type=flv&streamPath=live/a", nil))
+	if body := w.Body.String(); !strings.Contains(body, "live/a/1.flv") || strings.Contains(body, "live/b/1.flv") {
+		t.Fatalf("list %d %s", w.Code, body)
+	}
+}
@@ -0,0 +1,169 @@
+package record
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 保存在文件中的录像状态，重启后恢复
+type recordState struct {
+	Tasks []*RecordTask  //通过接口开始的录像
+	Files []*SegmentInfo //正在写入的文件
+}
+
+// 正在写入的文件，按类型和路径区分，保存开始写入时的副本，录像器之后修改的信息不影响状态文件
+var openSegments = make(map[string]*SegmentInfo)
+
+// 文件开始或结束写入后延迟写入状态文件，分片频繁切换时合并为一次
+const recordStateDelay = time.Second
+
+var recordStateTimer *time.Timer
+
+// 记录文件开始或结束写入
+func trackSegment(seg *SegmentInfo, open bool) {
+	recordTaskLock.Lock()
+	defer recordTaskLock.Unlock()
+	if open {
+		s := *seg
+		openSegments[catalogKey(seg.Type, seg.Path)] = &s
+	} else {
+		delete(openSegments, catalogKey(seg.Type, seg.Path))
+	}
+	if recordStateTimer == nil && RecordPluginConfig.Resume != "" {
+		recordStateTimer = time.AfterFunc(recordStateDelay, func() {
+			recordTaskLock.Lock()
+			defer recordTaskLock.Unlock()
+			saveRecordState()
+		})
+	}
+}
+
+// 文件未被其他录像器写入时登记为正在写入，检查和登记在同一个锁内。录像器开始写入时由trackSegment替换为完整的信息
+func reserveSegment(seg *SegmentInfo) bool {
+	recordTaskLock.Lock()
+	defer recordTaskLock.Unlock()
+	key := catalogKey(seg.Type, seg.Path)
+	if _, ok := openSegments[key]; ok {
+		return false
+	}
+	s := *seg
+	openSegments[key] = &s
+	return true
+}
+
+// 文件是否正在被录像器写入
+func isOpenSegment(typ, name string) bool {
+	recordTaskLock.Lock()
+	defer recordTaskLock.Unlock()
+	_, ok := openSegments[catalogKey(typ, name)]
+	return ok
+}
+
+// 写入录像状态文件，需持有锁。录像任务变化时立即写入，同时写入延迟中的文件变化
+func saveRecordState() {
+	if recordStateTimer != nil {
+		recordStateTimer.Stop()
+		recordStateTimer = nil
+	}
+	filePath := RecordPluginConfig.Resume
+	if filePath == "" {
+		return
+	}
+	var state recordState
+	recordTasks.Range(func(key, value any) bool {
+		state.Tasks = append(state.Tasks, value.(*RecordTask))
+		return true
+	})
+	for _, seg := range openSegments {
+		state.Files = append(state.Files, seg)
+	}
+	data, err := json.Marshal(&state)
+	if err == nil {
+		tempPath := filePath + ".tmp"
+		if err = os.WriteFile(tempPath, data, 0666); err == nil {
+			err = os.Rename(tempPath, filePath)
+		}
+	}
+	if err != nil {
+		plugin.Logger.Error("save record state", zap.String("path", filePath), zap.Error(err))
+	}
+}
+
+// 启动时加载录像状态，标记上次异常退出时未关闭的文件，通过接口开始的录像在流发布时重新开始
+func (conf *RecordConfig) loadRecordState() {
+	if conf.Resume == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.Resume), 0777); err != nil {
+		plugin.Logger.Error("load record state", zap.String("path", conf.Resume), zap.Error(err))
+		return
+	}
+	var state recordState
+	if data, err := os.ReadFile(conf.Resume); err == nil {
+		if err = json.Unmarshal(data, &state); err != nil {
+			plugin.Logger.Error("load record state", zap.String("path", conf.Resume), zap.Error(err))
+		}
+	}
+	var hlsStreams = make(map[string]bool)
+	for _, seg := range state.Files {
+		conf.markInterrupted(seg)
+		if seg.Type == "hls" {
+			hlsStreams[seg.StreamPath] = true
+		}
+	}
+	//异常退出时最后一个hls分片没有写入每天的m3u8，按ts文件补入，需要读取分片，不阻塞配置事件
+	if len(hlsStreams) > 0 {
+		go func() {
+			for streamPath := range hlsStreams {
+				if _, err := conf.Hls.RepairHlsPlaylists(streamPath, false); err != nil {
+					plugin.Logger.Error("repair hls playlist", zap.String("streamPath", streamPath), zap.Error(err))
+				}
+			}
+		}()
+	}
+	recordTaskLock.Lock()
+	defer recordTaskLock.Unlock()
+	for _, task := range state.Tasks {
+		r := conf.getRecorderConfigByType(task.Type)
+		if r == nil {
+			continue
+		}
+		task.init(r)
+		task.State = RecordTaskWaiting
+		task.RetryCount = 0
+		task.NextRetry = time.Time{}
+		recordTasks.Store(task.ID, task)
+		plugin.Logger.Info("resume record", zap.String("id", task.ID))
+	}
+	saveRecordState()
+}
+
+// 把异常退出时未关闭的文件写入录像目录，标记为中断
+func (conf *RecordConfig) markInterrupted(seg *SegmentInfo) {
+	r := conf.getRecorderConfigByType(seg.Type)
+	if r == nil {
+		return
+	}
+	info, err := r.storage.Stat(seg.Path)
+	if err != nil {
+		return
+	}
+	seg.Size = info.Size()
+	seg.EndTime = info.ModTime()
+	seg.Interrupted = true
+	seg.Duration = uint32(seg.EndTime.Sub(seg.StartTime).Milliseconds())
+	if r.GetDurationFn != nil {
+		if file, err := r.storage.OpenFile(seg.Path); err == nil {
+			if duration := r.GetDurationFn(file); duration > 0 {
+				seg.Duration = duration
+			}
+			file.Close()
+		}
+	}
+	conf.catalog.Add(seg)
+	plugin.Logger.Warn("record file interrupted", zap.String("type", seg.Type), zap.String("path", seg.Path))
+}
@@ -0,0 +1,86 @@
+package record
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/log"
+)
+
+// 文件开始和结束写入时延迟合并写入状态文件，保存开始写入时的信息
+func TestTrackSegmentDebounce(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	resume := RecordPluginConfig.Resume
+	a := &SegmentInfo{Type: "flv", Path: "live/a/1.flv"}
+	b := &SegmentInfo{Type: "flv", Path: "live/b/1.flv"}
+	RecordPluginConfig.Resume = filepath.Join(t.TempDir(), "recordings.json")
+	defer func() {
+		trackSegment(a, false)
+		recordTaskLock.Lock()
+		saveRecordState()
+		recordTaskLock.Unlock()
+		RecordPluginConfig.Resume = resume
+	}()
+
+	trackSegment(a, true)
+	trackSegment(b, true)
+	a.Size = 100
+	trackSegment(b, false)
+	if _, err := os.Stat(RecordPluginConfig.Resume); !os.IsNotExist(err) {
+		t.Fatalf("state written before delay: %v", err)
+	}
+	var state recordState
+	waitFor(t, func() bool {
+		data, err := os.ReadFile(RecordPluginConfig.Resume)
+		return err == nil && json.Unmarshal(data, &state) == nil
+	})
+	if len(state.Files) != 1 || state.Files[0].Path != a.Path || state.Files[0].Size != 0 {
+		t.Errorf("files %+v", state.Files)
+	}
+}
+
+// 启动时加载状态文件：接口开始的录像等待流发布后重新开始，异常退出时未关闭的文件标记为中断写入录像目录
+func TestLoadRecordState(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	resume := RecordPluginConfig.Resume
+	RecordPluginConfig.Resume = ""
+	defer func() { RecordPluginConfig.Resume = resume }()
+	dir := t.TempDir()
+	c, _, err := OpenCatalog(filepath.Join(dir, "catalog.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &RecordConfig{Resume: filepath.Join(dir, "state", "recordings.json"), catalog: c}
+	conf.Flv.typ, conf.Flv.Ext = "flv", ".flv"
+	conf.Flv.storage = NewLocalStorage(dir)
+	conf.Flv.Retry = 3
+	writeTestFile(t, dir, "live/a/1.flv", make([]byte, 100))
+	start := time.Now().Add(-time.Minute)
+	state := recordState{
+		Tasks: []*RecordTask{{ID: "live/a/flv/resume-test", Type: "flv", StreamPath: "live/a", RetryCount: 2, State: RecordTaskStarting}},
+		Files: []*SegmentInfo{
+			{Type: "flv", StreamPath: "live/a", Path: "live/a/1.flv", StartTime: start},
+			{Type: "flv", StreamPath: "live/a", Path: "live/a/gone.flv", StartTime: start},
+		},
+	}
+	data, _ := json.Marshal(&state)
+	writeTestFile(t, dir, "state/recordings.json", data)
+	conf.loadRecordState()
+	defer recordTasks.Delete("live/a/flv/resume-test")
+
+	value, ok := recordTasks.Load("live/a/flv/resume-test")
+	if !ok {
+		t.Fatal("task not resumed")
+	}
+	if task := value.(*RecordTask); task.State != RecordTaskWaiting || task.RetryCount != 0 || task.retry != 3 || task.interval != time.Second {
+		t.Errorf("task %+v", task)
+	}
+	segs := c.Query(CatalogQuery{Type: "flv"})
+	if len(segs) != 1 || segs[0].Path != "live/a/1.flv" || !segs[0].Interrupted || segs[0].Size != 100 || segs[0].Duration == 0 {
+		t.Errorf("catalog %+v", segs)
+	}
+}
@@ -0,0 +1,146 @@
+package record
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"m7s.live/engine/v4/log"
+)
+
+// 按流设置的录像保留策略，条件为0表示不限制
+type RetentionRule struct {
+	Filter    string        //StreamPath正则表达式
+	MaxAge    time.Duration //最长保留时间
+	MaxSize   int64         //单个流录像总大小上限(MB)
+	MaxCount  int           //单个流最多保留的录像文件数
+	filterReg *regexp.Regexp
+}
+
+func (r *Record) initRetention() {
+	for i := range r.Retention {
+		rule := &r.Retention[i]
+		rule.filterReg = nil
+		if rule.Filter != "" {
+			var err error
+			if rule.filterReg, err = regexp.Compile(rule.Filter); err != nil {
+				log.Errorf("保留策略[%v]配置错误：%v", rule.Filter, err)
+			}
+		}
+	}
+}
+
+// 流匹配的第一条保留策略
+func (r *Record) retentionRule(streamPath string) *RetentionRule {
+	for i := range r.Retention {
+		rule := &r.Retention[i]
+		if rule.Filter == "" || rule.filterReg != nil && rule.filterReg.MatchString(streamPath) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// 文件所属的流，按路径模板解析，点播m3u8在vod目录下
+func (r *Record) streamPathOf(name string) string {
+	dir := path.Dir(name)
+	if r.typ == "hls" {
+		if path.Base(dir) == "vod" {
+			return path.Dir(dir)
+		}
+	}
+	if r.typ == "hls" && isHlsInit(name) {
+		// 初始化段与第一个使用它的分片同名
+		name = strings.TrimSuffix(name, hlsInitExt) + ".m4s"
+	}
+	if streamPath, _, ok := r.parsePath(name); ok && streamPath != "" {
+		return streamPath
+	}
+	if r.typ == "hls" && isHlsSegment(name) {
+		return path.Dir(path.Dir(dir))
+	}
+	return dir
+}
+
+// 按保留策略清理各个流的录像
+func (r *Record) checkRetention() {
+	if len(r.Retention) == 0 {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("按保留策略清理录像出错！%v", err)
+		}
+	}()
+	streams := make(map[string][]*SegmentInfo)
+	for _, seg := range r.quotaSegments() {
+		streams[seg.StreamPath] = append(streams[seg.StreamPath], seg)
+	}
+	for streamPath, segs := range streams {
+		if rule := r.retentionRule(streamPath); rule != nil {
+			r.applyRetention(streamPath, rule, segs)
+		}
+	}
+}
+
+func (r *Record) applyRetention(streamPath string, rule *RetentionRule, segs []*SegmentInfo) {
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].StartTime.Before(segs[j].StartTime)
+	})
+	var total int64
+	for _, seg := range segs {
+		total += seg.Size
+	}
+	var before time.Time
+	if rule.MaxAge > 0 {
+		before = time.Now().Add(-rule.MaxAge)
+	}
+	count := len(segs)
+	remain := segs[:0]
+	for _, seg := range segs {
+		expired := !before.IsZero() && seg.EndTime.Before(before) ||
+			rule.MaxCount > 0 && count > rule.MaxCount ||
+			rule.MaxSize > 0 && total > rule.MaxSize*1024*1024
+		if !expired || isRecordingFile(seg.Path) {
+			remain = append(remain, seg)
+			continue
+		}
+		if err := r.removeFile(seg.Path); err != nil {
+			log.Errorf("文件删除出错：%v,%v", seg.Path, err)
+			remain = append(remain, seg)
+			continue
+		}
+		log.Infof("超出保留策略，文件已删除：%v", seg.Path)
+		count--
+		total -= seg.Size
+	}
+	if r.typ == "hls" {
+		r.cleanHlsPlaylists(streamPath, remain, before)
+	}
+}
+
+// 删除过期的点播m3u8，同步每天的m3u8
+func (r *Record) cleanHlsPlaylists(streamPath string, remain []*SegmentInfo, before time.Time) {
+	vod := path.Join(streamPath, "vod")
+	if infos, err := r.storage.ReadDir(vod); err == nil {
+		for _, info := range infos {
+			if len(remain) == 0 || !before.IsZero() && info.ModTime().Before(before) {
+				r.removeSidecar(path.Join(vod, info.Name()))
+			}
+		}
+	}
+	r.syncHlsPlaylists(streamPath)
+}
+
+// 删除录像文件以外的附属文件（m3u8、日志文件等）
+func (r *Record) removeSidecar(name string) {
+	if err := r.storage.Remove(name); err == nil {
+		log.Infof("文件已删除：%v", name)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		log.Errorf("文件删除出错：%v,%v", name, err)
+	}
+}
@@ -0,0 +1,220 @@
+package record
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 录像任务状态
+const (
+	RecordTaskRecording = "recording" //录制中
+	RecordTaskWaiting   = "waiting"   //等待重试
+	RecordTaskStarting  = "starting"  //重试中
+)
+
+// 通过接口开始的录像任务，意外停止后按原参数重新开始
+type RecordTask struct {
+	ID         string
+	Type       string
+	StreamPath string
+	FileName   string `json:",omitempty"`
+	Label      string `json:",omitempty"`
+	Fragment   time.Duration
+	Append     bool
+	RetryCount int32     //连续重试次数，恢复录制后清零
+	State      string    //recording|waiting|starting
+	LastError  string    `json:",omitempty"`
+	NextRetry  time.Time `json:",omitempty"`
+	retry      int32
+	interval   time.Duration
+	recorder   IRecorder
+	timer      *time.Timer
+}
+
+var recordTasks sync.Map
+var recordTaskLock sync.Mutex
+
+// 记录接口开始的录像参数，用于重试和重启后恢复
+func addRecordTask(t string, recorder IRecorder) {
+	r := recorder.GetRecorder()
+	task := &RecordTask{
+		ID:         r.ID,
+		Type:       t,
+		StreamPath: r.StreamPath,
+		FileName:   r.FileName,
+		Label:      r.Label,
+		Fragment:   r.Fragment,
+		Append:     r.append,
+	}
+	task.init(&r.Record)
+	recordTaskLock.Lock()
+	defer recordTaskLock.Unlock()
+	if old, loaded := recordTasks.Swap(task.ID, task); loaded {
+		old.(*RecordTask).stopTimer()
+	}
+	task.started(recorder)
+	saveRecordState()
+}
+
+// 按类型配置设置重试参数
+func (t *RecordTask) init(r *Record) {
+	t.retry = r.Retry
+	t.interval = r.RetryInterval
+	if t.interval < time.Second {
+		t.interval = time.Second
+	}
+}
+
+// 主动停止录像，不再重试
+func cancelRecordTask(id string) {
+	recordTaskLock.Lock()
+	defer recordTaskLock.Unlock()
+	if task, ok := recordTasks.LoadAndDelete(id); ok {
+		task.(*RecordTask).stopTimer()
+		saveRecordState()
+	}
+}
+
+// 等待重试的任务，录制中的任务通过录像器展示
+func waitingRecordTasks() (tasks []*RecordTask) {
+	recordTaskLock.Lock()
+	defer recordTaskLock.Unlock()
+	recordTasks.Range(func(key, value any) bool {
+		if task := value.(*RecordTask); task.State != RecordTaskRecording {
+			tasks = append(tasks, task)
+		}
+		return true
+	})
+	return
+}
+
+// 流重新发布时立即重试
+func retryOnPublish(streamPath string) {
+	recordTaskLock.Lock()
+	defer recordTaskLock.Unlock()
+	recordTasks.Range(func(key, value any) bool {
+		if task := value.(*RecordTask); task.StreamPath == streamPath && task.State == RecordTaskWaiting {
+			task.stopTimer()
+			go task.start()
+		}
+		return true
+	})
+}
+
+// 录像停止时如果不是主动停止则安排重试
+func (r *Recorder) onStopped() {
+	recordTaskLock.Lock()
+	defer recordTaskLock.Unlock()
+	value, ok := recordTasks.Load(r.ID)
+	if !ok {
+		return
+	}
+	task := value.(*RecordTask)
+	if task.recorder == nil || task.recorder.GetRecorder() != r {
+		return
+	}
+	task.recorder = nil
+	if shuttingDown.Load() {
+		// 保留在状态文件中，重启后恢复
+		return
+	}
+	if r.written {
+		// 已经恢复录制（写入了有时长的文件），重新计数。只创建了文件就失败的不算
+		task.RetryCount = 0
+	}
+	if r.err != nil {
+		task.LastError = r.err.Error()
+	}
+	task.scheduleRetry()
+}
+
+func (t *RecordTask) stopTimer() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+// 超过重试次数时放弃，否则在间隔后重新开始，需持有锁
+func (t *RecordTask) scheduleRetry() {
+	if t.retry >= 0 && t.RetryCount >= t.retry {
+		recordTasks.CompareAndDelete(t.ID, t)
+		saveRecordState()
+		if t.retry > 0 {
+			plugin.Logger.Warn("record retry exceeded", zap.String("id", t.ID), zap.Int32("retryCount", t.RetryCount), zap.String("error", t.LastError))
+		}
+		return
+	}
+	t.State = RecordTaskWaiting
+	t.NextRetry = time.Now().Add(t.interval)
+	t.timer = time.AfterFunc(t.interval, t.start)
+}
+
+// 按原参数新建录像器重新开始录制
+func (t *RecordTask) start() {
+	recordTaskLock.Lock()
+	if value, ok := recordTasks.Load(t.ID); !ok || value != t || t.State != RecordTaskWaiting || shuttingDown.Load() {
+		recordTaskLock.Unlock()
+		return
+	}
+	t.stopTimer()
+	t.RetryCount++
+	t.State = RecordTaskStarting
+	t.NextRetry = time.Time{}
+	recordTaskLock.Unlock()
+
+	recorder := t.newRecorder()
+	plugin.Logger.Info("record retry", zap.String("id", t.ID), zap.Int32("retryCount", t.RetryCount))
+	err := recorder.Start(t.StreamPath)
+
+	recordTaskLock.Lock()
+	defer recordTaskLock.Unlock()
+	if value, ok := recordTasks.Load(t.ID); !ok || value != t {
+		// 重试过程中被主动停止
+		if err == nil {
+			recorder.Stop(zap.String("reason", "api stop"))
+		}
+		return
+	}
+	if err != nil {
+		t.LastError = err.Error()
+		t.scheduleRetry()
+		return
+	}
+	t.started(recorder)
+}
+
+// 录像器已开始，可能在记录之前就已经停止了，停止中的会在停止后调用onStopped，需持有锁
+func (t *RecordTask) started(recorder IRecorder) {
+	t.recorder = recorder
+	t.State = RecordTaskRecording
+	if recorder.GetRecorder().State.Load().Done() {
+		t.recorder = nil
+		t.scheduleRetry()
+	}
+}
+
+func (t *RecordTask) newRecorder() IRecorder {
+	recorder := newAPIRecorder(t.Type)
+	r := recorder.GetRecorder()
+	r.ID = t.ID
+	r.Label = t.Label
+	r.Fragment = t.Fragment
+	r.FileName = t.FileName
+	r.append = t.Append
+	r.RetryCount = t.RetryCount
+	if !r.fragmented() && t.FileName != "" {
+		switch t.Type {
+		case "flv", "raw", "raw_audio":
+			// 接着之前的文件继续写
+			r.append = true
+		case "mp4", "fmp4":
+			// 不能追加，另起一个文件，避免覆盖之前的录像
+			r.FileName += "_" + strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	}
+	return recorder
+}
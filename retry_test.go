@@ -0,0 +1,39 @@
+package record
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/log"
+)
+
+// 只创建了文件就停止的录像不算恢复录制，写入了有时长的文件才重新计数
+func TestOnStoppedRetryCount(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	resume := RecordPluginConfig.Resume
+	RecordPluginConfig.Resume = ""
+	defer func() { RecordPluginConfig.Resume = resume }()
+	for _, written := range []bool{false, true} {
+		re := &fanoutTestRecorder{}
+		r := &re.Recorder
+		r.ID = "retry-test"
+		r.File = os.Stdout
+		r.written = written
+		task := &RecordTask{ID: r.ID, RetryCount: 2, retry: 5, interval: time.Hour, recorder: re}
+		recordTasks.Store(task.ID, task)
+		r.onStopped()
+		recordTaskLock.Lock()
+		task.stopTimer()
+		recordTaskLock.Unlock()
+		recordTasks.Delete(task.ID)
+		want := int32(2)
+		if written {
+			want = 0
+		}
+		if task.RetryCount != want || task.State != RecordTaskWaiting {
+			t.Errorf("written %v: retry count %d state %s", written, task.RetryCount, task.State)
+		}
+	}
+}
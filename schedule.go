@@ -0,0 +1,199 @@
+package record
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 定时录像规则，在时间窗口内录制匹配的流
+type RecordSchedule struct {
+	Type      string //录像类型 flv|mp4|fmp4|hls|raw|raw_audio
+	Filter    string //StreamPath正则表达式，为空则匹配全部
+	Weekdays  []int  //每周哪几天录制，0为星期日，为空则每天
+	Start     string //开始时间 HH:mm，为空表示0点
+	End       string //结束时间 HH:mm，为空表示24点，小于开始时间表示跨过零点
+	filterReg *regexp.Regexp
+	start     int            //开始分钟
+	end       int            //结束分钟
+	location  *time.Location //该类型录像配置的时区，时间窗口和星期按此时区计算
+}
+
+func parseClock(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	hour, minute, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hour)
+	m, err2 := strconv.Atoi(minute)
+	if !ok || err1 != nil || err2 != nil || h < 0 || h > 24 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func (s *RecordSchedule) init() (err error) {
+	r := RecordPluginConfig.getRecorderConfigByType(s.Type)
+	if r == nil {
+		return fmt.Errorf("type %v not supported", s.Type)
+	}
+	s.location = r.loc()
+	if s.Filter != "" {
+		if s.filterReg, err = regexp.Compile(s.Filter); err != nil {
+			return
+		}
+	}
+	if s.start, err = parseClock(s.Start, 0); err != nil {
+		return
+	}
+	s.end, err = parseClock(s.End, 24*60)
+	return
+}
+
+func (s *RecordSchedule) match(streamPath string) bool {
+	return s.filterReg == nil || s.filterReg.MatchString(streamPath)
+}
+
+func (s *RecordSchedule) onDay(day time.Weekday) bool {
+	if len(s.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range s.Weekdays {
+		if time.Weekday(d%7) == day {
+			return true
+		}
+	}
+	return false
+}
+
+// 该时间是否在录制窗口内，按录像配置的时区（timezone）计算，与主机时区无关
+func (s *RecordSchedule) Active(t time.Time) bool {
+	if s.location != nil {
+		t = t.In(s.location)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if s.start <= s.end {
+		return s.onDay(t.Weekday()) && minute >= s.start && minute < s.end
+	}
+	// 跨过零点，零点之后属于前一天的窗口
+	return s.onDay(t.Weekday()) && minute >= s.start || s.onDay(t.AddDate(0, 0, -1).Weekday()) && minute < s.end
+}
+
+// 定时录像调度，记录正在发布的流和由调度启动的录像
+type recordScheduler struct {
+	sync.Mutex
+	rules     []*RecordSchedule
+	streams   map[string]struct{}
+	scheduled map[string]IRecorder //由调度启动的录像，窗口结束时停止，启动中为nil
+	running   bool
+}
+
+var scheduler = &recordScheduler{
+	streams:   make(map[string]struct{}),
+	scheduled: make(map[string]IRecorder),
+}
+
+// 加载定时录像规则，有规则时启动调度
+func (conf *RecordConfig) initSchedule() {
+	var rules []*RecordSchedule
+	for i := range conf.Schedule {
+		rule := conf.Schedule[i]
+		if err := rule.init(); err != nil {
+			plugin.Logger.Error("record schedule", zap.Int("index", i), zap.Error(err))
+			continue
+		}
+		rules = append(rules, &rule)
+	}
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	scheduler.rules = rules
+	if len(rules) > 0 && !scheduler.running {
+		scheduler.running = true
+		go scheduler.run()
+	}
+}
+
+// 每分钟开始时检查一次窗口边界
+func (s *recordScheduler) run() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		s.Lock()
+		for streamPath := range s.streams {
+			s.check(streamPath, time.Now())
+		}
+		s.Unlock()
+	}
+}
+
+func (s *recordScheduler) onPublish(streamPath string) {
+	s.Lock()
+	defer s.Unlock()
+	s.streams[streamPath] = struct{}{}
+	s.check(streamPath, time.Now())
+}
+
+func (s *recordScheduler) onClose(streamPath string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.streams, streamPath)
+	for _, t := range recordTypes {
+		delete(s.scheduled, recorderID(streamPath, t))
+	}
+}
+
+// 按规则启动或停止流的各类型录像
+func (s *recordScheduler) check(streamPath string, now time.Time) {
+	active := make(map[string]bool)
+	for _, rule := range s.rules {
+		if rule.match(streamPath) {
+			active[rule.Type] = active[rule.Type] || rule.Active(now)
+		}
+	}
+	for t, on := range active {
+		id := recorderID(streamPath, t)
+		_, recording := RecordPluginConfig.recordings.Load(id)
+		if on && !recording {
+			// 启动中的录像为nil，不重复启动
+			if recorder, ok := s.scheduled[id]; ok && recorder == nil {
+				continue
+			}
+			s.scheduled[id] = nil
+			go s.start(id, t, streamPath)
+		} else if !on {
+			if recorder, ok := s.scheduled[id]; ok {
+				delete(s.scheduled, id)
+				if recording && recorder != nil {
+					recorder.Stop(zap.String("reason", "schedule window end"))
+					plugin.Logger.Info("schedule stop record", zap.String("id", id))
+				}
+			}
+		}
+	}
+}
+
+func (s *recordScheduler) start(id, t, streamPath string) {
+	recorder := newRecorder(t, streamPath)
+	err := recorder.Start(streamPath)
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.scheduled[id]; !ok {
+		// 启动过程中窗口已结束或流已关闭
+		if err == nil {
+			recorder.Stop(zap.String("reason", "schedule window end"))
+		}
+		return
+	}
+	if err != nil {
+		delete(s.scheduled, id)
+		plugin.Logger.Error("schedule start record", zap.String("id", id), zap.Error(err))
+		return
+	}
+	s.scheduled[id] = recorder
+	plugin.Logger.Info("schedule start record", zap.String("id", id))
+}
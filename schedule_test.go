@@ -0,0 +1,63 @@
+package record
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+		ok   bool
+	}{
+		{"", 7, true},
+		{"08:30", 8*60 + 30, true},
+		{"24:00", 24 * 60, true},
+		{"24:01", 0, false},
+		{"8", 0, false},
+		{"08:60", 0, false},
+		{"-1:00", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseClock(tt.s, 7)
+		if (err == nil) != tt.ok || tt.ok && got != tt.want {
+			t.Errorf("parseClock(%q) = %d %v", tt.s, got, err)
+		}
+	}
+}
+
+// 时间窗口按配置的时区计算，跨过零点的窗口零点之后属于前一天
+func TestScheduleActive(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	at := func(day, hour, minute int) time.Time {
+		// 2024年1月1日为星期一
+		return time.Date(2024, 1, day, hour, minute, 0, 0, loc)
+	}
+	day := &RecordSchedule{start: 8 * 60, end: 18 * 60, location: loc}
+	night := &RecordSchedule{Weekdays: []int{5}, start: 22 * 60, end: 6 * 60, location: loc}
+	tests := []struct {
+		name string
+		rule *RecordSchedule
+		t    time.Time
+		want bool
+	}{
+		{"day start", day, at(1, 8, 0), true},
+		{"day end", day, at(1, 18, 0), false},
+		{"before day", day, at(1, 7, 59), false},
+		{"other zone", day, at(1, 8, 0).UTC(), true},
+		{"friday night", night, at(5, 23, 0), true},
+		{"saturday morning", night, at(6, 5, 59), true},
+		{"saturday end", night, at(6, 6, 0), false},
+		{"saturday night", night, at(6, 23, 0), false},
+		{"friday morning", night, at(5, 1, 0), false},
+		// UTC的星期五15点是UTC+8的星期五23点
+		{"friday night in utc", night, time.Date(2024, 1, 5, 15, 0, 0, 0, time.UTC), true},
+		{"friday morning in utc", night, time.Date(2024, 1, 4, 23, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Active(tt.t); got != tt.want {
+			t.Errorf("%s: active %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrShuttingDown = errors.New("record shutting down")
+
+// 引擎关闭中，不再开始或重试录像
+var shuttingDown atomic.Bool
+
+// 第一次关闭完成后关闭shutdownDone，shutdownResult为其结果
+var (
+	shutdownDone   = make(chan struct{})
+	shutdownResult *ShutdownResult
+)
+
+// 关闭时各录像文件的写完情况
+type ShutdownResult struct {
+	Finalized   []string //已写完的文件
+	Unfinalized []string //超时未写完的文件，重启后标记为中断
+}
+
+// 等待引擎关闭后停止所有录像，阻塞到写完或超过ShutdownTimeout，返回写完情况。
+// m7s v4引擎没有插件退出的回调，plugin.Done()只是通知，engine.Run在ctx取消后直接返回，不等待任何插件，
+// 插件自己无法阻塞引擎退出。插件在后台调用一次，尽量写完；需要保证写完时，嵌入m7s的程序在Run返回后、进程退出前调用，
+// 与后台的调用共用同一次关闭的结果
+func (conf *RecordConfig) WaitShutdown() *ShutdownResult {
+	<-plugin.Done()
+	timeout := conf.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return conf.Shutdown(ctx)
+}
+
+// 同时停止所有录像，写完当前文件（mp4写入moov、fmp4写入剩余分片、hls写入最后一个分片的时长），ctx结束时不再等待。
+// 通过接口开始的录像保留在状态文件中，重启后恢复。引擎不会等待插件退出，嵌入m7s的程序需要在进程退出前调用，阻塞到录像写完
+// 多次调用时只有第一次执行关闭，之后的调用等待其完成并返回相同的结果，ctx先结束时返回空结果
+func (conf *RecordConfig) Shutdown(ctx context.Context) *ShutdownResult {
+	if shuttingDown.Swap(true) {
+		select {
+		case <-shutdownDone:
+			return shutdownResult
+		case <-ctx.Done():
+			return &ShutdownResult{}
+		}
+	}
+	recordTaskLock.Lock()
+	recordTasks.Range(func(key, value any) bool {
+		value.(*RecordTask).stopTimer()
+		return true
+	})
+	files := make([]*SegmentInfo, 0, len(openSegments))
+	for _, seg := range openSegments {
+		files = append(files, seg)
+	}
+	recordTaskLock.Unlock()
+
+	var recorders []*Recorder
+	conf.recordings.Range(func(key, value any) bool {
+		r := value.(IRecorder).GetRecorder()
+		r.Stop(zap.String("reason", "shutdown"))
+		recorders = append(recorders, r)
+		return true
+	})
+	for _, r := range recorders {
+		if r.stopped == nil {
+			continue
+		}
+		if err := r.Wait(ctx); err != nil {
+			plugin.Logger.Warn("shutdown wait record", zap.String("id", r.ID), zap.Error(err))
+		}
+	}
+
+	result := &ShutdownResult{}
+	for _, seg := range files {
+		if isOpenSegment(seg.Type, seg.Path) {
+			result.Unfinalized = append(result.Unfinalized, seg.Path)
+		} else {
+			result.Finalized = append(result.Finalized, seg.Path)
+		}
+	}
+	// 写入延迟中的文件变化，重启后不把已写完的文件标记为中断
+	recordTaskLock.Lock()
+	saveRecordState()
+	recordTaskLock.Unlock()
+	sort.Strings(result.Finalized)
+	sort.Strings(result.Unfinalized)
+	plugin.Logger.Info("record shutdown", zap.Strings("finalized", result.Finalized), zap.Strings("unfinalized", result.Unfinalized))
+	shutdownResult = result
+	close(shutdownDone)
+	return result
+}
@@ -0,0 +1,112 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// 录像器状态
+type RecorderState int32
+
+const (
+	RecorderStarting  RecorderState = iota //开始中
+	RecorderRecording                      //录制中
+	RecorderCutting                        //切片中
+	RecorderStopping                       //停止中，正在写完当前文件
+	RecorderStopped                        //已停止
+	RecorderFailed                         //出错停止
+)
+
+var recorderStateNames = [...]string{"starting", "recording", "cutting", "stopping", "stopped", "failed"}
+
+func (s RecorderState) String() string {
+	if s >= 0 && int(s) < len(recorderStateNames) {
+		return recorderStateNames[s]
+	}
+	return "unknown"
+}
+
+// 是否已停止，当前文件已写完
+func (s RecorderState) Done() bool {
+	return s == RecorderStopped || s == RecorderFailed
+}
+
+// 录像器状态，可在多个协程中读写，JSON中为状态名称
+type recorderStatus struct {
+	v atomic.Int32
+}
+
+func (s *recorderStatus) Load() RecorderState {
+	return RecorderState(s.v.Load())
+}
+
+func (s *recorderStatus) set(state RecorderState) {
+	s.v.Store(int32(state))
+}
+
+// 从from状态切换到to状态，当前不是from时返回false
+func (s *recorderStatus) change(from, to RecorderState) bool {
+	return s.v.CompareAndSwap(int32(from), int32(to))
+}
+
+func (s *recorderStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Load().String())
+}
+
+// 是否正在录制
+func (r *Recorder) IsRecording() bool {
+	state := r.State.Load()
+	return state == RecorderRecording || state == RecorderCutting
+}
+
+// 停止录像，当前文件由录像协程写完后才移出录像列表，可通过Wait等待
+func (r *Recorder) Stop(reason ...zap.Field) {
+	for {
+		state := r.State.Load()
+		if state == RecorderStopping || state.Done() || r.State.change(state, RecorderStopping) {
+			break
+		}
+	}
+	r.Subscriber.Stop(reason...)
+}
+
+// 等待录像停止并写完当前文件
+func (r *Recorder) Wait(ctx context.Context) error {
+	select {
+	case <-r.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 写完当前文件后移出录像列表
+func (r *Recorder) finish(re IRecorder) {
+	r.Stop(zap.String("reason", "record finish"))
+	func() {
+		// 等待共享订阅正在写入的帧写完，之后的帧不再写入
+		r.writeLock.Lock()
+		defer r.writeLock.Unlock()
+		defer func() {
+			if err := recover(); err != nil {
+				r.Error("close file panic", zap.Any("err", err))
+			}
+		}()
+		if err := re.Close(); err != nil {
+			r.Error("close file", zap.Error(err))
+		}
+	}()
+	RecordPluginConfig.recordings.CompareAndDelete(r.ID, re)
+	if r.err != nil {
+		r.State.set(RecorderFailed)
+	} else {
+		r.State.set(RecorderStopped)
+	}
+	r.notify(RecordEventStop, nil, r.err)
+	r.onStopped()
+	close(r.stopped)
+	r.Debug("record stopped", zap.String("state", r.State.Load().String()))
+}
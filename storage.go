@@ -0,0 +1,165 @@
+package record
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 录像存储接口，录制、清理、列表、点播都通过该接口访问文件，name为相对于存储根目录的路径
+type Storage interface {
+	http.Handler
+	CreateFile(name string, append bool) (FileWr, error) //创建文件，append为true时打开已有文件并定位到末尾，否则清空
+	OpenFile(name string) (io.ReadSeekCloser, error)     //只读打开文件
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	Remove(name string) error
+}
+
+// 存储配置
+type StorageConfig struct {
+	Type      string //存储类型，local:本地磁盘(默认)，s3:S3兼容的对象存储
+	Endpoint  string //s3服务地址，如http://127.0.0.1:9000
+	Region    string //s3区域，默认us-east-1
+	Bucket    string //s3桶名
+	AccessKey string
+	SecretKey string
+	Prefix    string //对象key前缀，默认使用Record.Path
+	Spool     string //s3文件上传前的本地缓存目录，默认为系统临时目录下的m7s-record-s3，异常退出后重启时上传其中遗留的文件
+}
+
+// 根据配置创建存储，root为本地存储的根目录
+func (c *StorageConfig) NewStorage(root string) Storage {
+	switch c.Type {
+	case "s3":
+		var prefix = c.Prefix
+		if prefix == "" {
+			prefix = root
+		}
+		s := NewS3Storage(c.Endpoint, c.Region, c.Bucket, c.AccessKey, c.SecretKey, prefix)
+		if c.Spool != "" {
+			s.Spool = c.Spool
+		}
+		return s
+	default:
+		return NewLocalStorage(root)
+	}
+}
+
+// 本地磁盘存储
+type LocalStorage struct {
+	Root string
+	fs   http.Handler
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	os.MkdirAll(root, 0777)
+	return &LocalStorage{
+		Root: root,
+		fs:   http.FileServer(http.Dir(root)),
+	}
+}
+
+// 文件在本地磁盘上的路径
+func (s *LocalStorage) LocalPath(name string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(name))
+}
+
+func (s *LocalStorage) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.fs.ServeHTTP(w, req)
+}
+
+func (s *LocalStorage) CreateFile(name string, append bool) (file FileWr, err error) {
+	filePath := s.LocalPath(name)
+	if err = os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
+		return
+	}
+	flag := os.O_CREATE | os.O_RDWR
+	if !append {
+		flag |= os.O_TRUNC
+	}
+	var f *os.File
+	if f, err = os.OpenFile(filePath, flag, 0777); err != nil {
+		return
+	}
+	if append {
+		if _, err = f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return
+		}
+	}
+	return f, nil
+}
+
+func (s *LocalStorage) OpenFile(name string) (io.ReadSeekCloser, error) {
+	return os.Open(s.LocalPath(name))
+}
+
+func (s *LocalStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(s.LocalPath(name))
+}
+
+func (s *LocalStorage) ReadDir(name string) (infos []fs.FileInfo, err error) {
+	var entries []os.DirEntry
+	if entries, err = os.ReadDir(s.LocalPath(name)); err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return
+}
+
+func (s *LocalStorage) Remove(name string) error {
+	return os.Remove(s.LocalPath(name))
+}
+
+// 写入整个文件，已存在则覆盖
+func writeFile(s Storage, name string, data []byte) (err error) {
+	var f FileWr
+	if f, err = s.CreateFile(name, false); err != nil {
+		return
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+}
+
+// 整体替换文件内容，本地存储先写临时文件再重命名，对象存储单次上传本身是原子的
+func writeFileAtomic(s Storage, name string, data []byte) (err error) {
+	local, ok := s.(*LocalStorage)
+	if !ok {
+		return writeFile(s, name, data)
+	}
+	tempName := name + ".tmp"
+	if err = writeFile(s, tempName, data); err != nil {
+		s.Remove(tempName)
+		return
+	}
+	if err = os.Rename(local.LocalPath(tempName), local.LocalPath(name)); err != nil {
+		s.Remove(tempName)
+	}
+	return
+}
+
+// 读取整个文件
+func readFile(s Storage, name string) (data []byte, err error) {
+	var f io.ReadSeekCloser
+	if f, err = s.OpenFile(name); err != nil {
+		return
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// 统一使用/作为路径分隔符
+func slashPath(name string) string {
+	return strings.TrimPrefix(strings.ReplaceAll(name, "\\", "/"), "/")
+}
@@ -0,0 +1,488 @@
+package record
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3兼容的对象存储（AWS S3、MinIO等），使用path-style访问和V4签名
+type S3Storage struct {
+	Endpoint  *url.URL
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
+	Spool     string //上传前写入的本地目录，异常退出时未上传的文件在重启后上传
+	client    *http.Client
+}
+
+func NewS3Storage(endpoint, region, bucket, accessKey, secretKey, prefix string) *S3Storage {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		u = &url.URL{Scheme: "http", Host: endpoint}
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Storage{
+		Endpoint:  u,
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Prefix:    strings.Trim(slashPath(prefix), "/"),
+		Spool:     filepath.Join(os.TempDir(), "m7s-record-s3"),
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+func (s *S3Storage) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.Prefix, slashPath(name)), "/")
+}
+
+// 对象在本地的缓存路径，按桶和key区分，异常退出后可以找到
+func (s *S3Storage) spoolPath(key string) string {
+	return filepath.Join(s.Spool, s.Bucket, filepath.FromSlash(key))
+}
+
+// 对象上传前先写入本地缓存文件，关闭时上传，上传失败时保留到重启后再上传
+type s3File struct {
+	*os.File
+	storage *S3Storage
+	key     string
+}
+
+func (f *s3File) Close() (err error) {
+	var size int64
+	if size, err = f.Seek(0, io.SeekEnd); err == nil {
+		if _, err = f.Seek(0, io.SeekStart); err == nil {
+			err = f.storage.putObject(f.key, f.File, size)
+		}
+	}
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		os.Remove(f.Name())
+	}
+	return
+}
+
+// 按需使用Range请求读取对象
+type s3Reader struct {
+	storage *S3Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (n int, err error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		var res *http.Response
+		if res, err = r.storage.do(http.MethodGet, r.key, nil, http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.offset)}}, nil, 0); err != nil {
+			return
+		}
+		r.body = res.Body
+	}
+	n, err = r.body.Read(p)
+	r.offset += int64(n)
+	return
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.offset, errors.New("s3: negative position")
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi *s3FileInfo) Name() string       { return fi.name }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return fi.isDir }
+func (fi *s3FileInfo) Sys() any           { return nil }
+func (fi *s3FileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return fs.ModeDir | 0777
+	}
+	return 0666
+}
+
+func (s *S3Storage) CreateFile(name string, append bool) (FileWr, error) {
+	key := s.key(name)
+	spoolPath := s.spoolPath(key)
+	if err := os.MkdirAll(filepath.Dir(spoolPath), 0777); err != nil {
+		return nil, err
+	}
+	tempFile, err := os.OpenFile(spoolPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	f := &s3File{File: tempFile, storage: s, key: key}
+	if append {
+		var res *http.Response
+		if res, err = s.do(http.MethodGet, f.key, nil, nil, nil, 0); err == nil {
+			_, err = io.Copy(tempFile, res.Body)
+			res.Body.Close()
+		} else if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// 本地缓存中遗留的文件，返回相对于存储根目录的路径，需在开始录像前调用
+func (s *S3Storage) Spooled() (names []string) {
+	root := filepath.Join(s.Spool, s.Bucket)
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		key, _ := filepath.Rel(root, p)
+		key = slashPath(key)
+		if s.Prefix == "" {
+			names = append(names, key)
+		} else if name, ok := strings.CutPrefix(key, s.Prefix+"/"); ok {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return
+}
+
+// 上传本地缓存中遗留的文件，成功后删除
+func (s *S3Storage) UploadSpooled(name string) (err error) {
+	key := s.key(name)
+	var file *os.File
+	if file, err = os.Open(s.spoolPath(key)); err != nil {
+		return
+	}
+	var info fs.FileInfo
+	if info, err = file.Stat(); err == nil {
+		err = s.putObject(key, file, info.Size())
+	}
+	file.Close()
+	if err == nil {
+		err = os.Remove(file.Name())
+	}
+	return
+}
+
+func (s *S3Storage) OpenFile(name string) (io.ReadSeekCloser, error) {
+	info, err := s.headObject(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Reader{storage: s, key: s.key(name), size: info.size}, nil
+}
+
+func (s *S3Storage) Stat(name string) (fs.FileInfo, error) {
+	if name = slashPath(name); name != "" {
+		// 还未上传的文件（正在写入或异常退出后等待上传）也视为存在，新录像不会选用同名文件覆盖本地缓存
+		if info, err := os.Stat(s.spoolPath(s.key(name))); err == nil && !info.IsDir() {
+			return info, nil
+		}
+		if info, err := s.headObject(name); !errors.Is(err, fs.ErrNotExist) {
+			return info, err
+		}
+	}
+	// 对象不存在时，存在该前缀的对象则视为目录
+	result, err := s.listObjects(name, "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" && len(result.Contents) == 0 && len(result.CommonPrefixes) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return &s3FileInfo{name: path.Base(name), isDir: true}, nil
+}
+
+func (s *S3Storage) ReadDir(name string) (infos []fs.FileInfo, err error) {
+	var token string
+	for {
+		var result *s3ListResult
+		if result, err = s.listObjects(slashPath(name), token, 1000); err != nil {
+			return
+		}
+		for _, p := range result.CommonPrefixes {
+			infos = append(infos, &s3FileInfo{name: path.Base(p.Prefix), isDir: true})
+		}
+		for _, c := range result.Contents {
+			infos = append(infos, &s3FileInfo{name: path.Base(c.Key), size: c.Size, modTime: c.LastModified})
+		}
+		if !result.IsTruncated {
+			return
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// 对象存储没有真正的目录，删除目录时对应的对象不存在，直接忽略
+func (s *S3Storage) Remove(name string) error {
+	if name = slashPath(name); name == "" {
+		return nil
+	}
+	res, err := s.do(http.MethodDelete, s.key(name), nil, nil, nil, 0)
+	if err == nil {
+		res.Body.Close()
+	}
+	return err
+}
+
+func (s *S3Storage) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	header := http.Header{}
+	for _, h := range []string{"Range", "If-None-Match", "If-Modified-Since"} {
+		if v := req.Header.Get(h); v != "" {
+			header.Set(h, v)
+		}
+	}
+	res, err := s.do(http.MethodGet, s.key(req.URL.Path), nil, header, nil, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, req)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	defer res.Body.Close()
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified", "ETag"} {
+		if v := res.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+func (s *S3Storage) headObject(name string) (*s3FileInfo, error) {
+	res, err := s.do(http.MethodHead, s.key(name), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	info := &s3FileInfo{name: path.Base(slashPath(name)), size: res.ContentLength}
+	info.modTime, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+func (s *S3Storage) putObject(key string, body io.Reader, size int64) error {
+	res, err := s.do(http.MethodPut, key, nil, nil, io.NopCloser(body), size)
+	if err == nil {
+		res.Body.Close()
+	}
+	return err
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+func (s *S3Storage) listObjects(dir, token string, maxKeys int) (result *s3ListResult, err error) {
+	prefix := s.key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	query := url.Values{
+		"list-type": {"2"},
+		"delimiter": {"/"},
+		"prefix":    {prefix},
+		"max-keys":  {fmt.Sprint(maxKeys)},
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	var res *http.Response
+	if res, err = s.do(http.MethodGet, "", query, nil, nil, 0); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	result = &s3ListResult{}
+	err = xml.NewDecoder(res.Body).Decode(result)
+	return
+}
+
+// 发送签名请求，状态码不是2xx时返回错误，404返回fs.ErrNotExist
+func (s *S3Storage) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (res *http.Response, err error) {
+	u := *s.Endpoint
+	u.Path = "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+	var req *http.Request
+	if req, err = http.NewRequest(method, u.String(), body); err != nil {
+		return
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, u.RawPath, u.RawQuery)
+	if res, err = s.client.Do(req); err != nil {
+		return
+	}
+	if res.StatusCode >= 300 && res.StatusCode != http.StatusNotModified {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			return nil, &fs.PathError{Op: method, Path: key, Err: fs.ErrNotExist}
+		}
+		return nil, fmt.Errorf("s3 %s %s: %s %s", method, key, res.Status, msg)
+	}
+	return
+}
+
+// AWS Signature Version 4
+func (s *S3Storage) sign(req *http.Request, canonicalURI, canonicalQuery string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + s3UnsignedPayload + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// 按RFC3986编码，encodeSlash为false时保留/
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+// 上次异常退出时遗留在本地缓存中的s3文件，需在开始录像前列出，避免上传正在写入的文件
+func (conf *RecordConfig) spooledFiles() map[*Record][]string {
+	spooled := make(map[*Record][]string)
+	for _, t := range recordTypes {
+		r := conf.getRecorderConfigByType(t)
+		if s, ok := r.storage.(*S3Storage); ok {
+			if names := s.Spooled(); len(names) > 0 {
+				spooled[r] = names
+			}
+		}
+	}
+	return spooled
+}
+
+// 上传遗留的文件，mp4的日志文件上传后可以用于恢复
+func uploadSpooled(spooled map[*Record][]string) {
+	for r, names := range spooled {
+		s := r.storage.(*S3Storage)
+		for _, name := range names {
+			if err := s.UploadSpooled(name); err != nil {
+				plugin.Logger.Error("upload spooled file", zap.String("type", r.typ), zap.String("path", name), zap.Error(err))
+			} else {
+				plugin.Logger.Info("upload spooled file", zap.String("type", r.typ), zap.String("path", name))
+			}
+		}
+	}
+}
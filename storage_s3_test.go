@@ -0,0 +1,247 @@
+package record
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testS3Bucket    = "bkt"
+	testS3AccessKey = "ak"
+	testS3SecretKey = "sk"
+)
+
+// 内存中的S3服务，校验V4签名，支持put、带Range的get、head、delete和分页的list
+type fakeS3 struct {
+	sync.Mutex
+	*httptest.Server
+	objects  map[string][]byte
+	requests []string //方法和对象key
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	s := &fakeS3{objects: make(map[string][]byte)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+var s3AuthReg = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([^,]+), Signature=([0-9a-f]{64})$`)
+
+// 按请求内容重新计算签名
+func (s *fakeS3) verify(r *http.Request) bool {
+	m := s3AuthReg.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil || m[1] != testS3AccessKey {
+		return false
+	}
+	date, region, signedHeaders := m[2], m[3], m[4]
+	var headers string
+	for _, h := range strings.Split(signedHeaders, ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		headers += h + ":" + strings.TrimSpace(v) + "\n"
+	}
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, strings.ReplaceAll(url.QueryEscape(k)+"="+url.QueryEscape(query.Get(k)), "+", "%20"))
+	}
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), strings.Join(pairs, "&"), headers, signedHeaders, r.Header.Get("X-Amz-Content-Sha256")}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/s3/aws4_request"
+	key := hmacSHA256([]byte("AWS4"+testS3SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	stringToSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)) == m[5]
+}
+
+func (s *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.verify(r) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testS3Bucket+"/")
+	s.requests = append(s.requests, r.Method+" "+key)
+	if !ok {
+		if r.Method == http.MethodGet && r.URL.Path == "/"+testS3Bucket {
+			s.list(w, r.URL.Query())
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[key], _ = io.ReadAll(r.Body)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodHead, http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		if rg := r.Header.Get("Range"); rg != "" {
+			var off int
+			if _, err := fmt.Sscanf(rg, "bytes=%d-", &off); err != nil || off >= len(data) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, len(data)-1, len(data)))
+			data = data[off:]
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}
+}
+
+// ListObjectsV2，delimiter固定为/，continuation-token为上一页最后的key
+func (s *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix, token := query.Get("prefix"), query.Get("continuation-token")
+	maxKeys, _ := strconv.Atoi(query.Get("max-keys"))
+	var names []string
+	seen := make(map[string]bool)
+	for key := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], "/"); i >= 0 {
+			key = key[:len(prefix)+i+1]
+		}
+		if !seen[key] && key > token {
+			seen[key] = true
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	truncated := maxKeys > 0 && len(names) > maxKeys
+	if truncated {
+		names = names[:maxKeys]
+	}
+	fmt.Fprint(w, "<ListBucketResult>")
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			fmt.Fprintf(w, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", name)
+		} else {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2024-01-01T00:00:00.000Z</LastModified></Contents>", name, len(s.objects[name]))
+		}
+	}
+	if truncated {
+		fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", names[len(names)-1])
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func (s *fakeS3) takeRequests() []string {
+	s.Lock()
+	defer s.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+func TestS3Storage(t *testing.T) {
+	srv := newFakeS3(t)
+	s := NewS3Storage(srv.URL, "", testS3Bucket, testS3AccessKey, testS3SecretKey, "record/flv")
+	put := func(name, content string, append bool) {
+		t.Helper()
+		f, err := s.CreateFile(name, append)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("live/test/a b.flv", "hello world", false)
+	put("live/test/a b.flv", "!", true)
+	if got := string(srv.objects["record/flv/live/test/a b.flv"]); got != "hello world!" {
+		t.Fatalf("object %q", got)
+	}
+
+	// 按偏移读取时使用Range请求
+	srv.takeRequests()
+	r, err := s.OpenFile("live/test/a b.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Seek(-6, io.SeekEnd)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "world!" {
+		t.Fatalf("ranged read %q", b)
+	}
+	if requests := srv.takeRequests(); len(requests) != 2 || requests[0] != "HEAD record/flv/live/test/a b.flv" || requests[1] != "GET record/flv/live/test/a b.flv" {
+		t.Errorf("requests %v", requests)
+	}
+
+	// 超过一页时按continuation-token继续列出
+	for i := 0; i < 1500; i++ {
+		srv.objects[fmt.Sprintf("record/flv/live/many/%04d.flv", i)] = []byte{1}
+	}
+	infos, err := s.ReadDir("live/many")
+	if err != nil || len(infos) != 1500 || infos[1499].Name() != "1499.flv" || infos[0].Size() != 1 {
+		t.Fatalf("list %d %v", len(infos), err)
+	}
+	infos, err = s.ReadDir("live")
+	if err != nil || len(infos) != 2 || !infos[0].IsDir() || infos[0].Name() != "many" {
+		t.Fatalf("list dirs %v %v", infos, err)
+	}
+	if info, err := s.Stat("live/test"); err != nil || !info.IsDir() {
+		t.Fatalf("stat dir %v %v", info, err)
+	}
+	if info, err := s.Stat("live/test/a b.flv"); err != nil || info.IsDir() || info.Size() != 12 {
+		t.Fatalf("stat file %v %v", info, err)
+	}
+
+	// 删除只发送DELETE，目录没有对应的对象
+	srv.takeRequests()
+	if err = s.Remove("live/test/a b.flv"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Remove("live/test"); err != nil {
+		t.Fatal(err)
+	}
+	if requests := srv.takeRequests(); len(requests) != 2 || requests[0] != "DELETE record/flv/live/test/a b.flv" || requests[1] != "DELETE record/flv/live/test" {
+		t.Errorf("requests %v", requests)
+	}
+	if _, ok := srv.objects["record/flv/live/test/a b.flv"]; ok {
+		t.Error("object not deleted")
+	}
+
+	// 签名错误时返回错误
+	bad := NewS3Storage(srv.URL, "", testS3Bucket, testS3AccessKey, "wrong", "")
+	if _, err = bad.ReadDir(""); err == nil {
+		t.Error("wrong secret key accepted")
+	}
+}
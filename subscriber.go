@@ -1,9 +1,12 @@
 package record
 
 import (
+	"fmt"
 	"io"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -21,21 +24,34 @@ type IRecorder interface {
 type Recorder struct {
 	Subscriber     `json:"-" yaml:"-"`
 	SkipTS         uint32
-	LastCutTime    time.Time //最后切片时间
-	IsRecording    bool      //是否正在录制
+	LastCutTime    time.Time      //最后切片时间
+	State          recorderStatus //录像器状态
 	Record         `json:"-" yaml:"-"`
 	File           FileWr `json:"-" yaml:"-"`
 	FileName       string // 自定义文件名，分段录像无效
+	Label          string // 录像标签，分段录像的文件名以标签结尾
 	append         bool   // 是否追加模式
 	LastDir        string `json:"-" yaml:"-"` //记录最后录像目录路径
 	lastDirChanged func(dir string)
-	// RetryCount     int32 //重试次数
-	StartTime time.Time //开始录像时间
+	RetryCount     int32     //重试次数
+	StartTime      time.Time //开始录像时间
 	// StopTime   time.Time //停止录像时间
 	StreamPath      string `json:"-" yaml:"-"`
 	SubType         byte
 	RID             string
-	BeforeStartFunc func() `json:"-" yaml:"-"` //在开始前执行
+	BeforeStartFunc func()        `json:"-" yaml:"-"` //在开始前执行
+	segment         *SegmentInfo  //当前录像文件信息
+	segmentStartTS  uint32        //当前录像文件的起始时间戳
+	lastTS          uint32        //最后写入帧的时间戳
+	seq             int           //本次录像的文件序号
+	written         bool          //本次录像有文件写入了帧（时长不为0），重试时据此判断是否已恢复录制
+	nextCut         time.Time     //对齐模式下的下一个切片时刻
+	err             error         //导致录像停止的错误
+	stopped         chan struct{} //停止并写完当前文件后关闭
+	shared          *sharedSubscriber
+	sink            sharedSink
+	fileLock        sync.RWMutex //保护segment和hls每天的m3u8路径，其他协程通过isRecordingFile读取
+	writeLock       sync.Mutex   //共享订阅的协程写入帧和录像协程关闭文件互斥，关闭后不再写入
 }
 
 // 最后录像目录路径
@@ -59,41 +75,150 @@ func (r *Recorder) CreateFile() (FileWr, error) {
 	return r.createFile()
 }
 
-func (r *Recorder) Close() error {
+func (r *Recorder) Close() (err error) {
 	if r.File != nil {
-		return r.File.Close()
+		err = r.File.Close()
+		r.endSegment()
 	}
-	return nil
+	return
 }
 
 func (r *Recorder) createFile() (f FileWr, err error) {
+	r.seq++
 	filePath := r.getFileName(r.Stream.Path) + r.Ext
+	if !r.append {
+		// 不覆盖已有的文件和其他录像器正在写入的文件
+		filePath = r.uniqueFilePath(filePath)
+	}
 	f, err = r.CreateFileFn(filePath, r.append)
 	if err == nil {
 		r.Info("create file", zap.String("path", filePath))
+		r.beginSegment(filePath)
 	} else {
+		if !r.append {
+			r.releaseFilePath(filePath)
+		}
 		r.Error("create file", zap.String("path", filePath), zap.Error(err))
 	}
 	return
 }
 
+// 新录像文件的信息
+func (r *Recorder) newSegment(filePath string) *SegmentInfo {
+	seg := &SegmentInfo{
+		StreamPath: r.Stream.Path,
+		Type:       r.typ,
+		Path:       slashPath(filePath),
+		StartTime:  time.Now(),
+		Label:      r.Label,
+	}
+	if r.Video != nil {
+		seg.VideoCodec = videoCodecName(r.Video.CodecID)
+	}
+	if r.Audio != nil {
+		seg.AudioCodec = audioCodecName(r.Audio.CodecID)
+	}
+	return seg
+}
+
+// 开始记录新的录像文件信息
+func (r *Recorder) beginSegment(filePath string) {
+	seg := r.newSegment(filePath)
+	r.fileLock.Lock()
+	r.segment = seg
+	r.fileLock.Unlock()
+	r.segmentStartTS = r.lastTS
+	trackSegment(seg, true)
+}
+
+// 当前录像文件已关闭，补全信息后写入录像目录
+func (r *Recorder) endSegment() {
+	r.saveSegment(r.takeSegment())
+}
+
+// 结束当前录像文件的记录，返回其信息
+func (r *Recorder) takeSegment() (seg *SegmentInfo) {
+	if seg = r.segment; seg != nil {
+		r.fileLock.Lock()
+		r.segment = nil
+		r.fileLock.Unlock()
+		trackSegment(seg, false)
+		seg.EndTime = time.Now()
+		if r.lastTS > r.segmentStartTS {
+			seg.Duration = r.lastTS - r.segmentStartTS
+			r.written = true
+		}
+	}
+	return
+}
+
+// 文件写完后记录大小并写入录像目录
+func (r *Recorder) saveSegment(seg *SegmentInfo) {
+	if seg == nil {
+		return
+	}
+	if info, err := r.storage.Stat(seg.Path); err == nil {
+		seg.Size = info.Size()
+	}
+	RecordPluginConfig.catalog.Add(seg)
+	r.notify(RecordEventSegment, seg, nil)
+}
+
+// 是否切分为多个文件，按时长或大小
+func (r *Record) fragmented() bool {
+	return r.Fragment > 0 || r.MaxFileSize > 0
+}
+
+// 当前文件已写入的大小
+func (r *Recorder) fileSize() int64 {
+	if r.File == nil {
+		return 0
+	}
+	n, err := r.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
 // 获取记录文件路径
 func (r *Recorder) getFileName(streamPath string) (filename string) {
-	filename = streamPath
-	if r.Fragment == 0 {
+	if !r.fragmented() {
 		if r.FileName != "" {
-			filename = filepath.Join(filename, r.FileName)
+			return filepath.Join(streamPath, r.FileName)
+		}
+		if r.template == nil {
+			if r.Label != "" {
+				return streamPath + "_" + r.Label
+			}
+			return streamPath
 		}
-	} else {
-		filename = filepath.Join(filename, strconv.FormatInt(time.Now().Unix(), 10))
 	}
-	return
+	return r.pathTemplate().render(r, streamPath, time.Now())
+}
+
+// 文件已存在或被其他录像器占用时加上序号区分。选中的文件名同时登记为正在写入，检查和登记在同一个锁内，
+// 同一秒切片的多个录像器不会选中同一个文件；创建文件失败时需要releaseFilePath
+func (r *Recorder) uniqueFilePath(filePath string) string {
+	ext := filepath.Ext(filePath)
+	name := strings.TrimSuffix(filePath, ext)
+	for i := 1; ; i++ {
+		if _, err := r.storage.Stat(filePath); err != nil && reserveSegment(r.newSegment(filePath)) {
+			return filePath
+		}
+		filePath = name + uniqueSep + strconv.Itoa(i) + ext
+	}
+}
+
+// 取消uniqueFilePath登记的文件名
+func (r *Recorder) releaseFilePath(filePath string) {
+	trackSegment(&SegmentInfo{Type: r.typ, Path: slashPath(filePath)}, false)
 }
 
 // 按年月日生成目录（yyyy-MM/dd）
 func (r *Recorder) getLastDir(streamPath string) string {
 	var dir = streamPath
-	var now = time.Now()
+	var now = time.Now().In(r.loc())
 	dir = filepath.Join(dir, now.Format("2006-01/02"))
 	r.SetLastDir(dir)
 	return r.LastDir
@@ -114,15 +239,21 @@ func (r *Recorder) getLastDir(streamPath string) string {
 // 	return
 // }
 
-// 定时检测是否需要结束录像
+// 定时检测是否需要结束录像，长时间没有切片时停止
 func (r *Recorder) pollingCheck() {
-	for r.IsRecording {
-		if r.IsCutNotChange() {
-			r.Stop(zap.String("reason", "cut time not change"))
-			r.stopRecord()
-			r.Logger.Debug("IsCutNotChange true", zap.Any("RID", r.RID), zap.Any("startTime", r.StartTime), zap.Any("cutTime", r.LastCutTime), zap.Any("Fragment", r.Record.Fragment))
+	ticker := time.NewTicker(r.Fragment)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopped:
+			return
+		case <-ticker.C:
+			if r.IsCutNotChange() {
+				r.Logger.Debug("IsCutNotChange true", zap.Any("RID", r.RID), zap.Any("startTime", r.StartTime), zap.Any("cutTime", r.LastCutTime), zap.Any("Fragment", r.Record.Fragment))
+				r.Stop(zap.String("reason", "cut time not change"))
+				return
+			}
 		}
-		time.Sleep(r.Record.Fragment)
 	}
 }
 
@@ -132,105 +263,132 @@ func (r *Recorder) IsCutNotChange() bool {
 }
 
 func (r *Recorder) start(re IRecorder, streamPath string, subType byte) (err error) {
-
+	if shuttingDown.Load() {
+		return ErrShuttingDown
+	}
+	// 未指定ID时（自动录像）每个流每种类型只有一个，接口开始的录像有各自的ID
+	if r.ID == "" {
+		r.ID = recorderID(streamPath, r.typ)
+	}
+	if _, isExist := RecordPluginConfig.recordings.LoadOrStore(r.ID, re); isExist {
+		return ErrRecordExist
+	}
+	r.State.set(RecorderStarting)
+	r.seq = 0
+	r.nextCut = time.Time{}
+	r.stopped = make(chan struct{})
+	r.err = nil
 	defer func() {
-		err := recover() //内置函数，可以捕捉到函数异常
-		if err != nil {
+		if e := recover(); e != nil {
 			//这里是打印错误，还可以进行报警处理，例如微信，邮箱通知
-			plugin.Logger.Error("开始录像出错", zap.Any("path", streamPath), zap.Any("err", err))
+			plugin.Logger.Error("开始录像出错", zap.Any("path", streamPath), zap.Any("err", e))
+			err = fmt.Errorf("start record panic: %v", e)
+		}
+		if err != nil {
+			RecordPluginConfig.recordings.CompareAndDelete(r.ID, re)
+			r.State.set(RecorderFailed)
+			close(r.stopped)
 		}
 	}()
 
-	if _, isExist := RecordPluginConfig.recordings.Load(r.ID); isExist {
-		return ErrRecordExist
+	r.StreamPath = streamPath
+	if err = r.subscribe(re, streamPath); err != nil {
+		r.notify(RecordEventError, nil, err)
+		return
 	}
-
-	err = plugin.Subscribe(streamPath, re)
-	if err == nil {
-		r.IsRecording = true
-		RecordPluginConfig.recordings.Store(r.ID, re)
-		if r.BeforeStartFunc != nil {
-			r.BeforeStartFunc()
-		}
-		r.RID = r.ID
-		r.StreamPath = streamPath
-		r.SubType = subType
-		// r.recording[streamPath] = re
-		r.Closer = re
-		r.Sugar().Debugf("%v开始录制。。", r.ID)
-		go func() {
-			defer func() {
-				err := recover() //内置函数，可以捕捉到函数异常
-				if err != nil {
-					//这里是打印错误，还可以进行报警处理，例如微信，邮箱通知
-					plugin.Logger.Error("开始录像出错（协程）", zap.Any("path", streamPath), zap.Any("err", err))
-				}
-			}()
-
-			r.StartTime = time.Now()
-			r.PlayBlock(subType)
-			r.Sugar().Debugf("%v阻塞播放结束", r.ID)
-
-			r.stopRecord() //其他地方调stop用会崩溃
-		}()
-
+	if r.BeforeStartFunc != nil {
+		r.BeforeStartFunc()
+	}
+	r.RID = r.ID
+	r.SubType = subType
+	r.State.change(RecorderStarting, RecorderRecording)
+	r.Sugar().Debugf("%v开始录制。。", r.ID)
+	go r.run(re, subType)
+	if r.Fragment > 0 {
 		go r.pollingCheck()
 	}
-
 	return
 }
 
-func (r *Recorder) stopRecord() {
-	if !r.IsRecording {
-		return
+// 录像协程，读取帧直到停止，之后写完当前文件
+func (r *Recorder) run(re IRecorder, subType byte) {
+	defer r.finish(re)
+	defer func() {
+		if e := recover(); e != nil {
+			//这里是打印错误，还可以进行报警处理，例如微信，邮箱通知
+			plugin.Logger.Error("开始录像出错（协程）", zap.Any("path", r.StreamPath), zap.Any("err", e))
+			r.err = fmt.Errorf("record panic: %v", e)
+		}
+	}()
+	r.StartTime = time.Now()
+	r.notify(RecordEventStart, nil, nil)
+	if r.shared != nil {
+		r.shared.play(re)
+	} else {
+		r.PlayBlock(subType)
 	}
-	r.IsRecording = false
-	// r.Stop(zap.String("reason", "record stoped"))
-	RecordPluginConfig.recordings.Delete(r.ID)
-	// delete(r.recording, r.StreamPath)
-	// if r.Closer != nil {
-	// 	r.Closer.Close()
-	// }
+	r.Sugar().Debugf("%v阻塞播放结束", r.ID)
+}
 
-	// r.StopTime = time.Now()
-	r.Sugar().Debugf("%v已停止录制。", r.ID)
+// 订阅流，开启共享订阅时除追加模式外都接入流的共享订阅
+func (r *Recorder) subscribe(re IRecorder, streamPath string) error {
+	r.shared = nil
+	if !RecordPluginConfig.SharedSubscribe || r.append {
+		return plugin.Subscribe(streamPath, re)
+	}
+	s, err := getSharedSubscriber(streamPath)
+	if err == nil {
+		s.attach(re)
+	}
+	return err
 }
 
-func (r *Recorder) cut(absTime uint32) {
-	if ts := absTime - r.SkipTS; time.Duration(ts)*time.Millisecond >= r.Fragment {
+func (r *Recorder) cut(absTime uint32, keyFrame bool) {
+	if r.needCut(absTime, keyFrame) {
 		// r.Debug("切片", zap.Any("ID", r.ID))
-		r.SkipTS = absTime
-		r.LastCutTime = time.Now()
-		r.Close()
-		if file, err := r.Spesific.(IRecorder).CreateFile(); err == nil {
-			r.File = file
-			r.Spesific.OnEvent(file)
-		} else {
-			r.Stop(zap.Any("resion", "切片出错"), zap.Error(err))
-		}
+		r.rotate(absTime, keyFrame)
 		// } else {
 		// 	r.Debug("切片条件不符", zap.Any("ts", ts), zap.Any("r.Fragment", r.Fragment))
 	}
 }
 
+// 关闭当前文件，从absTime这一帧开始写入新文件
+func (r *Recorder) rotate(absTime uint32, keyFrame bool) {
+	r.SkipTS = absTime
+	r.State.change(RecorderRecording, RecorderCutting)
+	r.Spesific.(IRecorder).Close()
+	r.File = nil
+	if file, err := r.Spesific.(IRecorder).CreateFile(); err == nil {
+		r.File = file
+		r.onCut(keyFrame)
+		r.Spesific.OnEvent(file)
+		r.State.change(RecorderCutting, RecorderRecording)
+	} else {
+		r.fail(err)
+	}
+}
+
 func (r *Recorder) OnEvent(event any) {
 	switch v := event.(type) {
 	case IRecorder:
 		if file, err := r.Spesific.(IRecorder).CreateFile(); err == nil {
 			r.File = file
 			r.Spesific.OnEvent(file)
+			r.flushPreRecord()
 		} else {
-			r.Stop(zap.Error(err))
+			r.fail(err)
 		}
 	case AudioFrame:
 		// 纯音频流的情况下需要切割文件
-		if r.Fragment > 0 && r.VideoReader == nil {
-			r.cut(v.AbsTime)
+		if r.fragmented() && r.VideoReader == nil {
+			r.cut(v.AbsTime, true)
 		}
+		r.lastTS = v.AbsTime
 	case VideoFrame:
-		if r.Fragment > 0 && v.IFrame {
-			r.cut(v.AbsTime)
+		if r.fragmented() && (v.IFrame || r.Align && r.AlignHardCut > 0) {
+			r.cut(v.AbsTime, v.IFrame)
 		}
+		r.lastTS = v.AbsTime
 	default:
 		r.Subscriber.OnEvent(event)
 	}
@@ -0,0 +1,67 @@
+package record
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "m7s.live/engine/v4"
+)
+
+// 同时切片的多个录像器选择文件名时不会选中同一个文件，也不会选中已存在的文件
+func TestUniqueFilePathConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewLocalStorage(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "live"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "live/test.flv"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	const n = 20
+	names := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := &Recorder{}
+			r.typ = "flv"
+			r.storage = storage
+			r.Stream = &Stream{Path: "live/test"}
+			names[i] = r.uniqueFilePath("live/test.flv")
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name == "live/test.flv" || seen[name] {
+			t.Errorf("duplicate file name %s", name)
+		}
+		seen[name] = true
+		if !isOpenSegment("flv", name) {
+			t.Errorf("%s not reserved", name)
+		}
+		(&Recorder{Record: Record{typ: "flv"}}).releaseFilePath(name)
+		if isOpenSegment("flv", name) {
+			t.Errorf("%s not released", name)
+		}
+	}
+}
+
+// 不分片且没有模板时，默认文件名带上标签
+func TestGetFileNameLabel(t *testing.T) {
+	r := &Recorder{}
+	if name := r.getFileName("live/test"); name != "live/test" {
+		t.Errorf("file name %s", name)
+	}
+	r.Label = "cam"
+	if name := r.getFileName("live/test"); name != "live/test_cam" {
+		t.Errorf("labeled file name %s", name)
+	}
+	r.FileName = "custom"
+	if name := r.getFileName("live/test"); name != filepath.Join("live/test", "custom") {
+		t.Errorf("custom file name %s", name)
+	}
+}
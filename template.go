@@ -0,0 +1,258 @@
+package record
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 路径模板中的占位符，如{streamPath}/{yyyy}-{MM}/{dd}/{HH}{mm}{ss}_{label}
+// {streamPath} 流路径，{streamPath0}、{streamPath1}... 流路径按/分隔的第N段，{streamName} 流路径的最后一段
+// {yyyy} {MM} {dd} {HH} {mm} {ss} 文件开始时间，{unix} Unix时间戳（秒）
+// {type} 录像格式，{label} 录像标签，{seq} 本次录像的文件序号（从1开始）
+var placeholderReg = regexp.MustCompile(`\{(\w+)\}`)
+
+var placeholderPatterns = map[string]string{
+	"streamPath": `.+?`,
+	"streamName": `[^/]+`,
+	"yyyy":       `\d{4}`,
+	"MM":         `\d{2}`,
+	"dd":         `\d{2}`,
+	"HH":         `\d{2}`,
+	"mm":         `\d{2}`,
+	"ss":         `\d{2}`,
+	"unix":       `\d+`,
+	"type":       `[^/]+?`,
+	"label":      `[\p{L}\p{N}_-]+?`,
+	"seq":        `\d+`,
+}
+
+// 避免重名时文件名后的序号分隔符，不能出现在标签中，与以数字结尾的标签区分
+const uniqueSep = "~"
+
+// 默认的路径布局，hls分片按年月日分目录，带标签的录像分片和每天的m3u8以标签结尾
+const (
+	defaultPathTemplate    = "{streamPath}/{unix}_{label}"
+	defaultHlsPathTemplate = "{streamPath}/{yyyy}-{MM}/{dd}/{unix}_{label}"
+)
+
+// 录像文件路径模板（不含扩展名），同时用于从文件路径中解析流路径和开始时间
+type pathTemplate struct {
+	text   string
+	reg    *regexp.Regexp
+	groups []string //各个分组对应的占位符
+}
+
+func newPathTemplate(text string) (*pathTemplate, error) {
+	t := &pathTemplate{text: strings.Trim(slashPath(text), "/")}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	captured := make(map[string]bool)
+	last := 0
+	for _, m := range placeholderReg.FindAllStringSubmatchIndex(t.text, -1) {
+		name := t.text[m[2]:m[3]]
+		p, ok := placeholderPatterns[name]
+		if !ok {
+			if !isStreamPathPart(name) {
+				return nil, fmt.Errorf("unknown placeholder {%s} in path template", name)
+			}
+			p = `[^/]+`
+		}
+		literal := t.text[last:m[0]]
+		last = m[1]
+		// 标签为空时连同前面的分隔符一起省略
+		var sep string
+		if name == "label" && (strings.HasSuffix(literal, "_") || strings.HasSuffix(literal, "-")) {
+			literal, sep = literal[:len(literal)-1], literal[len(literal)-1:]
+		}
+		pattern.WriteString(regexp.QuoteMeta(literal))
+		if sep != "" {
+			pattern.WriteString("(?:" + regexp.QuoteMeta(sep))
+		}
+		if captured[name] {
+			pattern.WriteString("(?:" + p + ")")
+		} else {
+			captured[name] = true
+			t.groups = append(t.groups, name)
+			pattern.WriteString("(" + p + ")")
+		}
+		if sep != "" {
+			pattern.WriteString(")?")
+		}
+	}
+	pattern.WriteString(regexp.QuoteMeta(t.text[last:]))
+	// 文件名可能带有避免重名的序号和扩展名
+	pattern.WriteString(`(?:` + regexp.QuoteMeta(uniqueSep) + `\d+)?(?:\.[^./]+)?$`)
+	var err error
+	if t.reg, err = regexp.Compile(pattern.String()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// {streamPathN}
+func isStreamPathPart(name string) bool {
+	n, err := strconv.Atoi(strings.TrimPrefix(name, "streamPath"))
+	return strings.HasPrefix(name, "streamPath") && err == nil && n >= 0
+}
+
+// 生成文件路径，不含扩展名
+func (t *pathTemplate) render(r *Recorder, streamPath string, now time.Time) string {
+	now = now.In(r.loc())
+	parts := strings.Split(streamPath, "/")
+	result := placeholderReg.ReplaceAllStringFunc(t.text, func(s string) string {
+		switch name := s[1 : len(s)-1]; name {
+		case "streamPath":
+			return streamPath
+		case "streamName":
+			return parts[len(parts)-1]
+		case "yyyy":
+			return now.Format("2006")
+		case "MM":
+			return now.Format("01")
+		case "dd":
+			return now.Format("02")
+		case "HH":
+			return now.Format("15")
+		case "mm":
+			return now.Format("04")
+		case "ss":
+			return now.Format("05")
+		case "unix":
+			return strconv.FormatInt(now.Unix(), 10)
+		case "type":
+			return r.typ
+		case "label":
+			if r.Label == "" {
+				return "\x00"
+			}
+			return r.Label
+		case "seq":
+			return strconv.Itoa(r.seq)
+		default:
+			if n, err := strconv.Atoi(strings.TrimPrefix(name, "streamPath")); err == nil && n < len(parts) {
+				return parts[n]
+			}
+			return ""
+		}
+	})
+	// 去掉空标签及其前面的分隔符
+	result = strings.NewReplacer("_\x00", "", "-\x00", "", "\x00", "").Replace(result)
+	return filepath.FromSlash(result)
+}
+
+// 文件路径中各个占位符的值，不匹配模板时返回nil
+func (t *pathTemplate) values(name string) map[string]string {
+	m := t.reg.FindStringSubmatch(slashPath(name))
+	if m == nil {
+		return nil
+	}
+	values := make(map[string]string, len(t.groups))
+	for i, group := range t.groups {
+		values[group] = m[i+1]
+	}
+	return values
+}
+
+// 从文件路径（相对于存储根目录）中解析流路径和开始时间，不匹配模板时返回false
+func (t *pathTemplate) parse(name string, loc *time.Location) (streamPath string, start time.Time, ok bool) {
+	values := t.values(name)
+	if values == nil {
+		return
+	}
+	streamPath = values["streamPath"]
+	if streamPath == "" {
+		var parts []string
+		for i := 0; ; i++ {
+			part, ok := values["streamPath"+strconv.Itoa(i)]
+			if !ok {
+				break
+			}
+			parts = append(parts, part)
+		}
+		// 没有{streamPath}时由各段和最后一段拼出流路径
+		if name, ok := values["streamName"]; ok && (len(parts) == 0 || parts[len(parts)-1] != name) {
+			parts = append(parts, name)
+		}
+		streamPath = strings.Join(parts, "/")
+	}
+	if unix, err := strconv.ParseInt(values["unix"], 10, 64); err == nil {
+		start = time.Unix(unix, 0)
+	} else if year, err := strconv.Atoi(values["yyyy"]); err == nil {
+		num := func(key string, def int) int {
+			if v, err := strconv.Atoi(values[key]); err == nil {
+				return v
+			}
+			return def
+		}
+		start = time.Date(year, time.Month(num("MM", 1)), num("dd", 1), num("HH", 0), num("mm", 0), num("ss", 0), 0, loc)
+	}
+	return streamPath, start, true
+}
+
+// 初始化路径模板和时区
+func (r *Record) initTemplate() (err error) {
+	r.location = time.Local
+	if r.TimeZone != "" {
+		if r.location, err = time.LoadLocation(r.TimeZone); err != nil {
+			r.location = time.Local
+			return
+		}
+	}
+	r.template = nil
+	if r.PathTemplate != "" {
+		r.template, err = newPathTemplate(r.PathTemplate)
+	}
+	return
+}
+
+// 模板中时间所用的时区
+func (r *Record) loc() *time.Location {
+	if r.location == nil {
+		return time.Local
+	}
+	return r.location
+}
+
+// 录像文件的路径模板，未配置时为默认布局
+func (r *Record) pathTemplate() *pathTemplate {
+	if r.template != nil {
+		return r.template
+	}
+	if r.typ == "hls" {
+		return hlsPathTemplate
+	}
+	return basePathTemplate
+}
+
+var basePathTemplate, _ = newPathTemplate(defaultPathTemplate)
+var hlsPathTemplate, _ = newPathTemplate(defaultHlsPathTemplate)
+
+// 从录像文件路径中解析流路径和开始时间，依次尝试配置的模板和默认布局，修改模板后之前的录像仍可解析
+func (r *Record) parsePath(name string) (streamPath string, start time.Time, ok bool) {
+	if r.template != nil {
+		if streamPath, start, ok = r.template.parse(name, r.loc()); ok {
+			return
+		}
+	}
+	if r.typ == "hls" {
+		return hlsPathTemplate.parse(name, r.loc())
+	}
+	return basePathTemplate.parse(name, r.loc())
+}
+
+// 从录像文件路径中解析录像标签，没有标签或不匹配模板时为空
+func (r *Record) parseLabel(name string) string {
+	if r.template != nil {
+		if values := r.template.values(name); values != nil {
+			return values["label"]
+		}
+	}
+	if r.typ == "hls" {
+		return hlsPathTemplate.values(name)["label"]
+	}
+	return basePathTemplate.values(name)["label"]
+}
@@ -0,0 +1,60 @@
+package record
+
+import (
+	"testing"
+	"time"
+)
+
+// 按模板生成的路径（包括避免重名的序号）都能解析回流路径、开始时间和标签
+func TestPathTemplateRoundTrip(t *testing.T) {
+	now := time.Date(2024, 5, 6, 1, 2, 3, 0, time.UTC)
+	tests := []struct {
+		name     string
+		typ      string
+		template string
+		timeZone string
+		label    string
+		want     string
+	}{
+		{"default", "flv", "", "", "cam", "live/test/1714957323_cam"},
+		{"default numeric label", "flv", "", "", "5", "live/test/1714957323_5"},
+		{"default empty label", "flv", "", "", "", "live/test/1714957323"},
+		{"hls default in time zone", "hls", "", "Asia/Shanghai", "", "live/test/2024-05/06/1714957323"},
+		{"hls default labeled", "hls", "", "UTC", "event-1", "live/test/2024-05/06/1714957323_event-1"},
+		{"stream parts in time zone", "flv", "{streamPath0}/{yyyy}{MM}{dd}/{streamName}_{HH}{mm}{ss}_{seq}_{label}", "Asia/Shanghai", "cam", "live/20240506/test_090203_3_cam"},
+		{"stream parts empty label", "flv", "{streamPath0}/{yyyy}{MM}{dd}/{streamName}_{HH}{mm}{ss}_{seq}_{label}", "Asia/Shanghai", "", "live/20240506/test_090203_3"},
+		{"stream path parts", "mp4", "{streamPath0}/{streamPath1}/{type}/{yyyy}-{MM}-{dd}T{HH}{mm}{ss}-{label}", "UTC", "2", "live/test/mp4/2024-05-06T010203-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Recorder{}
+			r.typ, r.Label, r.seq = tt.typ, tt.label, 3
+			r.PathTemplate, r.TimeZone = tt.template, tt.timeZone
+			if err := r.initTemplate(); err != nil {
+				t.Fatal(err)
+			}
+			rendered := slashPath(r.pathTemplate().render(r, "live/test", now))
+			if rendered != tt.want {
+				t.Fatalf("render %s, want %s", rendered, tt.want)
+			}
+			for _, name := range []string{rendered + ".flv", rendered + uniqueSep + "2.flv"} {
+				streamPath, start, ok := r.parsePath(name)
+				if !ok || streamPath != "live/test" || !start.Equal(now) {
+					t.Errorf("parse %s: %s %v %v", name, streamPath, start, ok)
+				}
+				if label := r.parseLabel(name); label != tt.label {
+					t.Errorf("parse label %s: %q, want %q", name, label, tt.label)
+				}
+			}
+		})
+	}
+}
+
+func TestPathTemplateUnknownPlaceholder(t *testing.T) {
+	if _, err := newPathTemplate("{streamPath}/{bad}"); err == nil {
+		t.Error("unknown placeholder accepted")
+	}
+	if _, err := newPathTemplate("{streamPath}/{streamPath2}_{unix}"); err != nil {
+		t.Error(err)
+	}
+}
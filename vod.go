@@ -18,8 +18,12 @@ func (conf *RecordConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case ".flv":
 		conf.Flv.ServeHTTP(w, r)
 	case ".mp4":
-		conf.Mp4.ServeHTTP(w, r)
-	case ".m3u8", ".ts":
+		if isHlsInit(r.URL.Path) {
+			conf.Hls.ServeHTTP(w, r)
+		} else {
+			conf.Mp4.ServeHTTP(w, r)
+		}
+	case ".m3u8", ".ts", ".m4s":
 		conf.Hls.ServeHTTP(w, r)
 	case ".h264", ".h265":
 		conf.Raw.ServeHTTP(w, r)
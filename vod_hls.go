@@ -78,23 +78,22 @@ func GetCurrentDirectory() string {
 }
 
 // 超找时间段交集最大的m3u8
-func findM3u8Info(dir string, st, et time.Time) *M3u8FileInfo {
+func findM3u8Info(s Storage, dir string, st, et time.Time) *M3u8FileInfo {
 
 	// dir = path.Join(GetCurrentDirectory(), dir)
 	// log.Infof("record路径：%v", dir)
-	entries, err := os.ReadDir(dir)
+	entries, err := s.ReadDir(dir)
 	if err != nil {
 		panic(err)
 	}
 
 	var m3u8Info *M3u8FileInfo
 	var maxIntersection int64 = 0
-	for _, entry := range entries {
-		info, err := entry.Info()
-		if err == nil && path.Ext(info.Name()) == ".m3u8" {
+	for _, info := range entries {
+		if path.Ext(info.Name()) == ".m3u8" {
 
 			relPath := path.Join(dir, info.Name())
-			var info, err = NewM3u8Info(relPath)
+			var info, err = ReadM3u8Info(s, relPath)
 			if err == nil {
 
 				var curIntersection int64 = 0
@@ -142,7 +141,9 @@ func findM3u8Info(dir string, st, et time.Time) *M3u8FileInfo {
 }
 
 // 找出目录下在时间段内的ts文件
-func findTsInfos(dir string, st, et time.Time) (tsFiles []*TsInfo) {
+// 只读取label对应的每天的m3u8，label为空时为不带标签的录像，m3u8文件名的日期按录像配置的时区解析
+func (r *Record) findTsInfos(dir, label string, st, et time.Time) (tsFiles []*TsInfo) {
+	s := r.storage
 
 	// var date1 = time.Date(st.Year(),st.Month(),st.Day(),0,0,0,0,time.Local)
 	// var date2 = time.Date(et.Year(),et.Month(),et.Day(),0,0,0,0,time.Local)
@@ -156,13 +157,12 @@ func findTsInfos(dir string, st, et time.Time) (tsFiles []*TsInfo) {
 	// }
 
 	// for _, dateDir := range dateDirs {
-	entries, err := os.ReadDir(dir)
+	entries, err := s.ReadDir(dir)
 	if err == nil {
-		for _, entry := range entries {
-			info, err := entry.Info()
-			if err == nil && path.Ext(info.Name()) == ".m3u8" {
+		for _, info := range entries {
+			if !info.IsDir() && path.Ext(info.Name()) == ".m3u8" {
 				var timeStr = strings.ReplaceAll(path.Base(info.Name()), ".m3u8", "") //获取时间戳
-				if len(timeStr) >= 8 {
+				if m := dayPlaylistReg.FindStringSubmatch(timeStr); m != nil && m[1] == label {
 					y, err := strconv.Atoi(timeStr[0:4])
 					if err != nil {
 						continue
@@ -175,16 +175,20 @@ func findTsInfos(dir string, st, et time.Time) (tsFiles []*TsInfo) {
 					if err != nil {
 						continue
 					}
-					var fileCreateTime = time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.Local)
+					var fileCreateTime = time.Date(y, time.Month(m), d, 0, 0, 0, 0, r.loc())
 					//var fileModTime = info.ModTime() //windows不准，获取到缓存的修改时间
-					var fileModTime = fileCreateTime.Add(24 * time.Hour)
+					var fileModTime = fileCreateTime.AddDate(0, 0, 1)
 					log.LocaleLogger.Debug("m3u8信息", zap.Any("dir", dir), zap.Any("file", info.Name()), zap.Any("creatTime", fileCreateTime), zap.Time("modTime", fileModTime))
 					if st.Before(fileModTime) && et.After(fileCreateTime) {
 						relPath := path.Join(dir, info.Name())
-						var info, err = NewM3u8Info(relPath)
+						var info, err = ReadM3u8Info(s, relPath)
 						if err == nil {
 							//log.LocaleLogger.Debug("m3u8内容", zap.Any("startTime", info.StartTime), zap.Time("endTime", info.EndTime), zap.Int("tsFilesCount", len(info.TsFiles)))
 							for _, ts := range info.TsFiles {
+								//没有EXT-X-PROGRAM-DATE-TIME时按路径模板解析分片开始时间
+								if _, start, ok := r.parsePath(path.Join(dir, ts.FileName)); ok && !start.IsZero() && ts.ProgramDateTime.IsZero() {
+									ts.Time = start
+								}
 								if (st.Before(ts.Time) || st.Equal(ts.Time)) && et.After(ts.Time) {
 									tsFiles = append(tsFiles, ts)
 								}
@@ -202,42 +206,72 @@ func findTsInfos(dir string, st, et time.Time) (tsFiles []*TsInfo) {
 	return
 }
 
-// 生成点播
-func (p *RecordConfig) genVod(startTime, endTime, streamPath string) *M3u8FileInfo {
+// 从录像目录中找出在时间段内的ts文件，只取标签为label的录像
+func (p *RecordConfig) findCatalogTsInfos(streamPath, label string, st, et time.Time) (tsFiles []*TsInfo) {
+	var segs = p.catalog.Query(CatalogQuery{Type: "hls", StreamPath: streamPath, StartTime: st, EndTime: et})
+	for _, seg := range segs {
+		if seg.Label != label {
+			continue
+		}
+		var duration = time.Duration(seg.Duration) * time.Millisecond
+		if duration == 0 {
+			duration = seg.EndTime.Sub(seg.StartTime)
+		}
+		//分片路径不一定在流目录下，使用相对路径
+		fileName, err := filepath.Rel(streamPath, seg.Path)
+		if err != nil {
+			continue
+		}
+		var ts = &TsInfo{
+			FileName:        filepath.ToSlash(fileName),
+			Time:            seg.StartTime,
+			Len:             duration.Seconds(),
+			ProgramDateTime: seg.StartTime.In(p.Hls.loc()),
+			Discontinuity:   seg.Discontinuity,
+		}
+		if seg.InitPath != "" {
+			if initName, err := filepath.Rel(streamPath, seg.InitPath); err == nil {
+				ts.Map = filepath.ToSlash(initName)
+			}
+		}
+		tsFiles = append(tsFiles, ts)
+	}
+	return
+}
+
+// 生成点播，label为空时使用不带标签的hls录像
+func (p *RecordConfig) genVod(startTime, endTime, streamPath, label string) *M3u8FileInfo {
 	var st = toTime(startTime)
 	var et = toTime(endTime)
 
 	log.Infof("尝试生成HLS点播, st=%v,et=%v,path=%v", st, et, streamPath)
-	var findDir = path.Join(p.Hls.Path, streamPath)
-	// var m3u8Info = findM3u8Info(tsDir, st, et)
-	var tsInfos = findTsInfos(findDir, st, et)
+	var storage = p.Hls.GetStorage()
+	// var m3u8Info = findM3u8Info(storage, streamPath, st, et)
+	var tsInfos []*TsInfo
+	if p.catalog != nil {
+		tsInfos = p.findCatalogTsInfos(streamPath, label, st, et)
+	} else {
+		tsInfos = p.Hls.findTsInfos(streamPath, label, st, et)
+	}
 	newM3u8Info, err := MakeM3u8Info(tsInfos)
 	if err != nil {
 		panic(err)
 	}
 
 	newM3u8Info.JoinPath = "../"
-	var vodDir = path.Join(findDir, "vod")
-	if _, err := os.Stat(vodDir); os.IsNotExist(err) {
-		// 先创建文件夹
-		err = os.Mkdir(vodDir, 0777)
-		if err != nil {
-			panic(err)
-		}
-		// 再修改权限
-		err = os.Chmod(vodDir, 0777)
-		if err != nil {
-			panic(err)
-		}
-	}
 	var fileName = fmt.Sprintf("%v-%v.m3u8", newM3u8Info.StartTime.Unix(), newM3u8Info.EndTime.Unix())
-	var m3u8Path = path.Join(vodDir, fileName)
-	err = os.WriteFile(m3u8Path, []byte(newM3u8Info.ToFileContent()), 0666)
+	if label != "" {
+		fileName = fmt.Sprintf("%v-%v_%v.m3u8", newM3u8Info.StartTime.Unix(), newM3u8Info.EndTime.Unix(), label)
+	}
+	var vodFile = path.Join(streamPath, "vod", fileName)
+	err = writeFile(storage, vodFile, []byte(newM3u8Info.ToFileContent()))
 	if err != nil {
 		panic(err)
 	}
+	var m3u8Path = path.Join(p.Hls.Path, vodFile)
 	log.Infof("HLS点播文件已生成: %v,", m3u8Path)
 	newM3u8Info.Path = m3u8Path
+	newM3u8Info.VodPath = vodFile
 	// res.Url = fmt.Sprintf("http://%v/%v", r.Host, strings.ReplaceAll(filePath, "/hls", ""))
 	// res.StartTime = newInfo.StartTime
 	// res.EndTime = newInfo.EndTime
@@ -245,6 +279,11 @@ func (p *RecordConfig) genVod(startTime, endTime, streamPath string) *M3u8FileIn
 	return newM3u8Info
 }
 
+// 点播地址，由插件按扩展名交给hls的存储读取，与存储的根目录无关
+func vodUrl(host, vodPath string) string {
+	return fmt.Sprintf("http://%v/record/%v", host, vodPath)
+}
+
 // 生成HLS点播文件API接口
 func (p *RecordConfig) API_vod_hls(w http.ResponseWriter, r *http.Request) {
 
@@ -263,14 +302,18 @@ func (p *RecordConfig) API_vod_hls(w http.ResponseWriter, r *http.Request) {
 	var startTime = q.Get("st")
 	var endTime = q.Get("et")
 	var streamPath = q.Get("path")
+	var label = q.Get("label")
+	if !labelReg.MatchString(label) {
+		panic("invalid label")
+	}
 
-	var m3u8Info = p.genVod(startTime, endTime, streamPath)
+	var m3u8Info = p.genVod(startTime, endTime, streamPath, label)
 
 	if m3u8Info == nil {
 		panic("HLS点播失败！")
 	}
 
-	res.Url = fmt.Sprintf("http://%v/%v", r.Host, strings.ReplaceAll(m3u8Info.Path, "/hls", ""))
+	res.Url = vodUrl(r.Host, m3u8Info.VodPath)
 	res.StartTime = m3u8Info.StartTime
 	res.EndTime = m3u8Info.EndTime
 	res.IsSuc = true
@@ -0,0 +1,24 @@
+package record
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 每天的m3u8按录像配置的时区划分日期，与主机时区无关
+func TestFindTsInfosTimeZone(t *testing.T) {
+	dir := t.TempDir()
+	loc := time.FixedZone("UTC+8", 8*3600)
+	r := &Record{typ: "hls", Ext: ".m3u8", location: loc, storage: NewLocalStorage(dir)}
+	// UTC+8的1月2日0点30分，UTC的1月1日16点30分
+	start := time.Date(2024, 1, 2, 0, 30, 0, 0, loc)
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-TARGETDURATION:10\n#EXT-X-PROGRAM-DATE-TIME:%s\n#EXTINF:10.000,\n2024-01/02/1.ts\n",
+		start.Format(programDateTimeLayout))
+	writeTestFile(t, dir, "live/test/20240102.m3u8", []byte(playlist))
+	st := time.Date(2024, 1, 1, 16, 0, 0, 0, time.UTC)
+	tsInfos := r.findTsInfos("live/test", "", st, st.Add(time.Hour))
+	if len(tsInfos) != 1 || !tsInfos[0].Time.Equal(start) {
+		t.Fatalf("ts infos %+v", tsInfos)
+	}
+}
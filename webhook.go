@@ -0,0 +1,300 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 录像事件名称
+const (
+	RecordEventStart   = "start"   //开始录像
+	RecordEventSegment = "segment" //录像文件写完
+	RecordEventStop    = "stop"    //停止录像
+	RecordEventError   = "error"   //录像出错
+	RecordEventTest    = "test"    //测试接口发送
+)
+
+// 录像事件，作为webhook的请求体
+type RecordEvent struct {
+	ID         string //事件ID，重试时不变，可用于去重
+	Event      string //事件名称 start|segment|stop|error|test
+	RecorderID string
+	StreamPath string
+	Type       string    //录像类型 flv|mp4|fmp4|hls|raw|raw_audio
+	FilePath   string    `json:",omitempty"` //相对于存储根目录的文件路径
+	StartTime  time.Time `json:",omitempty"`
+	EndTime    time.Time `json:",omitempty"`
+	Reason     string    `json:",omitempty"` //错误原因
+	HardCut    bool      `json:",omitempty"` //文件不是从关键帧开始
+	Time       time.Time //事件发生时间
+}
+
+var recordEventSeq atomic.Uint64
+
+func newRecordEvent(event string) *RecordEvent {
+	now := time.Now()
+	return &RecordEvent{
+		ID:    fmt.Sprintf("%d-%d", now.UnixNano(), recordEventSeq.Add(1)),
+		Event: event,
+		Time:  now,
+	}
+}
+
+// webhook配置
+type WebhookConfig struct {
+	URL           string        //接收事件的地址，为空则不启用
+	Timeout       time.Duration //请求超时
+	MaxRetry      int           //发送失败重试次数，超过后放弃该事件继续发送后面的事件，-1:无限重试（送达前后面的事件一直等待）
+	RetryInterval time.Duration //首次重试间隔，之后每次加倍，最长1分钟
+	Outbox        string        //未送达事件的保存文件，重启后继续发送
+}
+
+// outbox中的一条记录，事件入队时记录Event，送达或放弃时记录Done
+type webhookEntry struct {
+	Event *RecordEvent `json:",omitempty"`
+	Done  string       `json:",omitempty"`
+}
+
+// webhook发送器，事件按顺序逐个发送，失败按退避间隔重试
+type Webhook struct {
+	WebhookConfig
+	sync.Mutex
+	pending []*RecordEvent
+	file    *os.File
+	garbage int //outbox中已完成的记录数
+	signal  chan struct{}
+	client  *http.Client
+}
+
+// 打开outbox，加载未送达的事件并开始发送
+func OpenWebhook(conf WebhookConfig) (w *Webhook, err error) {
+	w = &Webhook{
+		WebhookConfig: conf,
+		signal:        make(chan struct{}, 1),
+		client:        &http.Client{Timeout: conf.Timeout},
+	}
+	if w.RetryInterval <= 0 {
+		w.RetryInterval = time.Second
+	}
+	if w.Outbox != "" {
+		if err = os.MkdirAll(filepath.Dir(w.Outbox), 0777); err != nil {
+			return
+		}
+		if f, err := os.Open(w.Outbox); err == nil {
+			scanner := bufio.NewScanner(f)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				var entry webhookEntry
+				if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+					continue
+				}
+				if entry.Event != nil {
+					w.pending = append(w.pending, entry.Event)
+				} else {
+					w.remove(entry.Done)
+				}
+			}
+			f.Close()
+		}
+		if w.file, err = os.OpenFile(w.Outbox, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666); err != nil {
+			return
+		}
+		w.compact()
+	}
+	go w.run()
+	return
+}
+
+func (w *Webhook) remove(id string) {
+	for i, e := range w.pending {
+		if e.ID == id {
+			w.pending = append(w.pending[:i], w.pending[i+1:]...)
+			w.garbage++
+			return
+		}
+	}
+}
+
+func (w *Webhook) write(entry *webhookEntry) {
+	if w.file == nil {
+		return
+	}
+	if data, err := json.Marshal(entry); err == nil {
+		if _, err = w.file.Write(append(data, '\n')); err != nil {
+			plugin.Logger.Error("webhook outbox write", zap.Error(err))
+		}
+	}
+}
+
+// 重写outbox，只保留未送达的事件
+func (w *Webhook) compact() {
+	tempPath := w.Outbox + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		plugin.Logger.Error("webhook outbox compact", zap.Error(err))
+		return
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range w.pending {
+		enc.Encode(&webhookEntry{Event: e})
+	}
+	if err = f.Sync(); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tempPath, w.Outbox)
+	}
+	if err != nil {
+		plugin.Logger.Error("webhook outbox compact", zap.Error(err))
+		os.Remove(tempPath)
+		return
+	}
+	w.file.Close()
+	if w.file, err = os.OpenFile(w.Outbox, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666); err != nil {
+		plugin.Logger.Error("webhook outbox open", zap.Error(err))
+	}
+	w.garbage = 0
+}
+
+// 事件入队，先写入outbox再异步发送
+func (w *Webhook) Send(e *RecordEvent) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	w.pending = append(w.pending, e)
+	w.write(&webhookEntry{Event: e})
+	w.Unlock()
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// 事件已送达或放弃
+func (w *Webhook) done(e *RecordEvent) {
+	w.Lock()
+	defer w.Unlock()
+	w.remove(e.ID)
+	w.write(&webhookEntry{Done: e.ID})
+	if w.file != nil && w.garbage > 100 && len(w.pending) < w.garbage {
+		w.compact()
+	}
+}
+
+func (w *Webhook) run() {
+	for {
+		w.Lock()
+		var e *RecordEvent
+		if len(w.pending) > 0 {
+			e = w.pending[0]
+		}
+		w.Unlock()
+		if e == nil {
+			<-w.signal
+			continue
+		}
+		w.deliver(e)
+		w.done(e)
+	}
+}
+
+// 发送一个事件，直到成功、不可重试或超过重试次数
+func (w *Webhook) deliver(e *RecordEvent) {
+	interval := w.RetryInterval
+	for retry := 0; ; retry++ {
+		err, retryable := w.post(e)
+		if err == nil {
+			return
+		}
+		if !retryable || w.MaxRetry >= 0 && retry >= w.MaxRetry {
+			plugin.Logger.Error("webhook give up", zap.String("id", e.ID), zap.String("event", e.Event), zap.Int("retry", retry), zap.Error(err))
+			return
+		}
+		plugin.Logger.Warn("webhook retry", zap.String("id", e.ID), zap.Duration("after", interval), zap.Error(err))
+		time.Sleep(interval)
+		if interval *= 2; interval > time.Minute {
+			interval = time.Minute
+		}
+	}
+}
+
+// 发送请求，4xx错误（408、429除外）不再重试
+func (w *Webhook) post(e *RecordEvent) (err error, retryable bool) {
+	data, _ := json.Marshal(e)
+	resp, err := w.client.Post(w.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err, true
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil, false
+	}
+	err = fmt.Errorf("webhook response status %d", resp.StatusCode)
+	return err, resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// 打开webhook，配置了URL时才启用
+func (conf *RecordConfig) openWebhook() {
+	if conf.Webhook.URL == "" || conf.webhook != nil {
+		return
+	}
+	webhook, err := OpenWebhook(conf.Webhook)
+	if err != nil {
+		plugin.Logger.Error("open webhook", zap.String("outbox", conf.Webhook.Outbox), zap.Error(err))
+		return
+	}
+	conf.webhook = webhook
+}
+
+// 发送录像事件到引擎事件总线和webhook，seg不为空时带上该录像文件的信息
+func (r *Recorder) notify(event string, seg *SegmentInfo, err error) {
+	r.publishEvent(event, seg, err)
+	webhook := RecordPluginConfig.webhook
+	if webhook == nil {
+		return
+	}
+	e := newRecordEvent(event)
+	e.RecorderID = r.ID
+	e.StreamPath = r.StreamPath
+	e.Type = r.typ
+	e.StartTime = r.StartTime
+	if seg == nil {
+		seg = r.segment
+	} else {
+		e.StartTime, e.EndTime = seg.StartTime, seg.EndTime
+	}
+	if seg != nil {
+		e.FilePath = seg.Path
+		e.HardCut = seg.HardCut
+	}
+	if event == RecordEventStop {
+		e.EndTime = e.Time
+	}
+	if err != nil {
+		e.Reason = err.Error()
+	}
+	webhook.Send(e)
+}
+
+// 录像出错，发送事件后停止录像，停止前重复的错误只记录第一个
+func (r *Recorder) fail(err error) {
+	if r.err != nil {
+		return
+	}
+	r.err = err
+	r.notify(RecordEventError, nil, err)
+	r.Stop(zap.Error(err))
+}
@@ -0,0 +1,170 @@
+package record
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/log"
+)
+
+// 记录收到的事件，handler返回状态码
+type webhookServer struct {
+	sync.Mutex
+	*httptest.Server
+	requests []webhookRequest
+}
+
+type webhookRequest struct {
+	Event RecordEvent
+	Time  time.Time
+}
+
+func newWebhookServer(t *testing.T, handler func(e *RecordEvent, attempt int) int) *webhookServer {
+	s := &webhookServer{}
+	attempts := make(map[string]int)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e RecordEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		s.Lock()
+		s.requests = append(s.requests, webhookRequest{e, time.Now()})
+		attempts[e.ID]++
+		attempt := attempts[e.ID]
+		s.Unlock()
+		w.WriteHeader(handler(&e, attempt))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *webhookServer) received() []webhookRequest {
+	s.Lock()
+	defer s.Unlock()
+	return append([]webhookRequest(nil), s.requests...)
+}
+
+// 等待条件满足，超时则测试失败
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func pendingCount(w *Webhook) int {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.pending)
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	s := newWebhookServer(t, func(e *RecordEvent, attempt int) int {
+		if attempt <= 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	interval := 50 * time.Millisecond
+	w, err := OpenWebhook(WebhookConfig{URL: s.URL, Timeout: time.Second, MaxRetry: 5, RetryInterval: interval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newRecordEvent(RecordEventStart)
+	w.Send(e)
+	waitFor(t, func() bool { return pendingCount(w) == 0 })
+	reqs := s.received()
+	if len(reqs) != 3 {
+		t.Fatalf("got %d requests, want 3", len(reqs))
+	}
+	for i, req := range reqs {
+		if req.Event.ID != e.ID {
+			t.Errorf("request %d id = %s, want %s", i, req.Event.ID, e.ID)
+		}
+	}
+	// 重试间隔每次加倍
+	if d := reqs[1].Time.Sub(reqs[0].Time); d < interval {
+		t.Errorf("first retry after %v, want >= %v", d, interval)
+	}
+	if d := reqs[2].Time.Sub(reqs[1].Time); d < 2*interval {
+		t.Errorf("second retry after %v, want >= %v", d, 2*interval)
+	}
+}
+
+// 超过重试次数或不可重试的事件被放弃，后面的事件继续发送
+func TestWebhookGiveUp(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	s := newWebhookServer(t, func(e *RecordEvent, attempt int) int {
+		switch e.StreamPath {
+		case "down":
+			return http.StatusInternalServerError
+		case "bad":
+			return http.StatusBadRequest
+		}
+		return http.StatusNoContent
+	})
+	w, err := OpenWebhook(WebhookConfig{URL: s.URL, Timeout: time.Second, MaxRetry: 2, RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Send(&RecordEvent{ID: "1", Event: RecordEventStart, StreamPath: "down"})
+	w.Send(&RecordEvent{ID: "2", Event: RecordEventStart, StreamPath: "bad"})
+	w.Send(&RecordEvent{ID: "3", Event: RecordEventStart, StreamPath: "live"})
+	waitFor(t, func() bool { return pendingCount(w) == 0 })
+	var ids string
+	for _, req := range s.received() {
+		ids += req.Event.ID
+	}
+	if ids != "11123" {
+		t.Errorf("requests %s, want 11123", ids)
+	}
+}
+
+// 未送达的事件保存在outbox中，重新打开后按顺序继续发送，送达后不再保留
+func TestWebhookOutboxReplay(t *testing.T) {
+	plugin.Logger = &log.Logger{Logger: zap.NewNop()}
+	outbox := filepath.Join(t.TempDir(), "webhook.jsonl")
+	down := newWebhookServer(t, func(e *RecordEvent, attempt int) int {
+		return http.StatusServiceUnavailable
+	})
+	w, err := OpenWebhook(WebhookConfig{URL: down.URL, Timeout: time.Second, MaxRetry: -1, RetryInterval: time.Hour, Outbox: outbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Send(&RecordEvent{ID: "1", Event: RecordEventStart, StreamPath: "a"})
+	w.Send(&RecordEvent{ID: "2", Event: RecordEventSegment, StreamPath: "a"})
+	w.Send(&RecordEvent{ID: "3", Event: RecordEventStop, StreamPath: "a"})
+	waitFor(t, func() bool { return len(down.received()) > 0 })
+
+	up := newWebhookServer(t, func(e *RecordEvent, attempt int) int {
+		return http.StatusOK
+	})
+	w2, err := OpenWebhook(WebhookConfig{URL: up.URL, Timeout: time.Second, MaxRetry: -1, RetryInterval: 10 * time.Millisecond, Outbox: outbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return pendingCount(w2) == 0 })
+	var events []string
+	for _, req := range up.received() {
+		events = append(events, req.Event.Event)
+	}
+	if len(events) != 3 || events[0] != RecordEventStart || events[1] != RecordEventSegment || events[2] != RecordEventStop {
+		t.Errorf("replayed %v", events)
+	}
+	w3, err := OpenWebhook(WebhookConfig{URL: up.URL, Outbox: outbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pendingCount(w3); n != 0 {
+		t.Errorf("%d events pending after reopen", n)
+	}
+}